@@ -0,0 +1,232 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/go-micah/chat-cli/settings"
+	"github.com/spf13/cobra"
+)
+
+// agentSystemPrompt tells the model how to work with the built-in tools.
+// It is given the working directory and the operating system.
+const agentSystemPrompt = `You are a coding assistant working in the directory %s on %s.
+
+Use the tools to look around before making changes, and read a file before you replace it. Paths are relative to the working directory and can't leave it. Every change to a file and every command is shown to the user, who may decline it. If they do, don't try the same thing again.
+
+When the task is done, reply with a short summary of what you changed.`
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Let a LLM work on a task in the current directory",
+	Long: `Gives a LLM on Amazon Bedrock tools to read, search and change the files in
+the current directory, and to run commands you allow, like so:
+
+> chat-cli agent "add a --verbose flag to the build script" --allow-command go
+
+Every change to a file is shown as a diff and every command has to be
+approved before it runs.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		task := args[0]
+
+		modelId, err := cmd.PersistentFlags().GetString("model-id")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// validate model is supported
+		m, err := models.GetModel(modelId)
+		if err != nil {
+			return err
+		}
+
+		if !m.SupportsToolUse || !m.SupportsStreaming {
+			return errorf(kindUnsupportedModel, "model %s does not support streaming tool use so it can't be used as an agent", m.ModelID)
+		}
+
+		maxTokens, err := cmd.PersistentFlags().GetInt32("max-tokens")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		maxIterations, err := cmd.PersistentFlags().GetInt("max-tool-iterations")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if maxIterations < 1 {
+			return errorf(kindUsage, "--max-tool-iterations must be at least 1")
+		}
+
+		// get the commands the model may run, from the flags and the
+		// config file
+		allowed, err := cmd.PersistentFlags().GetStringArray("allow-command")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		s, err := settings.Load()
+		if err != nil {
+			return err
+		}
+
+		allowed = append(allowed, s.Agent.AllowedCommands...)
+		slices.Sort(allowed)
+		allowed = slices.Compact(allowed)
+
+		commandTimeout, err := cmd.PersistentFlags().GetDuration("command-timeout")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// apply the guardrail from the flags or the config file
+		guard, err := getGuardrail(cmd)
+		if err != nil {
+			return err
+		}
+
+		wd, err := os.Getwd()
+		if err != nil {
+			return fmt.Errorf("unable to get working directory: %w", err)
+		}
+
+		tools := &toolSet{
+			tools:         agentTools(allowed, commandTimeout),
+			maxIterations: maxIterations,
+		}
+
+		converseStreamInput := &bedrockruntime.ConverseStreamInput{
+			ModelId: aws.String(m.ModelID),
+			System: []types.SystemContentBlock{
+				&types.SystemContentBlockMemberText{
+					Value: fmt.Sprintf(agentSystemPrompt, wd, runtime.GOOS),
+				},
+			},
+			InferenceConfig: &types.InferenceConfiguration{
+				MaxTokens: &maxTokens,
+			},
+			ToolConfig:      tools.toolConfig(),
+			GuardrailConfig: guard.streamConfig(),
+		}
+
+		msgs := []types.Message{
+			{
+				Role: types.ConversationRoleUser,
+				Content: []types.ContentBlock{
+					&types.ContentBlockMemberText{
+						Value: task,
+					},
+				},
+			},
+		}
+
+		// print the first request instead of sending it
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if dryRun {
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
+			}
+
+			converseStreamInput.Messages = msgs
+
+			out, err := newConverseStreamDryRun(region, m, converseStreamInput)
+			if err != nil {
+				return err
+			}
+
+			return printDryRun(os.Stdout, out)
+		}
+
+		force, err := cmd.PersistentFlags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		budget, err := newBudgetGuard(force)
+		if err != nil {
+			return err
+		}
+
+		// set up connection to AWS
+		svc, err := newBedrockClient(cmd.Context(), cmd)
+		if err != nil {
+			return err
+		}
+
+		retries, err := getCallPolicy(cmd)
+		if err != nil {
+			return err
+		}
+
+		handler := newReasoningStreamHandler(textStreamHandler{w: os.Stdout})
+
+		turn, _, err := tools.converse(cmd.Context(), msgs, func(msgs []types.Message) (converseTurn, error) {
+			converseStreamInput.Messages = msgs
+
+			// every round sends the whole conversation again, so check
+			// the budget each time
+			estimate := m.Cost(estimateInputTokens(converseInputOf(converseStreamInput)), maxTokens)
+			if err := budget.confirm(cmd.Context(), estimate); err != nil {
+				return converseTurn{}, err
+			}
+
+			result, err := retries.converseStream(cmd.Context(), svc, converseStreamInput, handler)
+			budget.add(estimate, recordUsage("agent", m, result.Usage, showUsage))
+			if err != nil {
+				return converseTurn{}, fmt.Errorf("error from Bedrock, %w", err)
+			}
+
+			return converseTurn{
+				Message:    result.Message,
+				StopReason: result.StopReason,
+				Usage:      result.Usage,
+				Guardrail:  newGuardrailOutput(guardrailStreamTrace(result.Trace), result.StopReason),
+			}, nil
+		})
+
+		fmt.Println()
+
+		if err != nil {
+			return err
+		}
+
+		printGuardrail(os.Stderr, turn.Guardrail)
+
+		return stopReasonError(turn.StopReason, maxTokens)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.PersistentFlags().StringP("model-id", "m", "us.anthropic.claude-sonnet-4-20250514-v1:0", "set the model id")
+	agentCmd.PersistentFlags().Int32("max-tokens", 4096, "max tokens of each response")
+	agentCmd.PersistentFlags().Int("max-tool-iterations", 25, "stop if the model is still calling tools after this many rounds")
+	agentCmd.PersistentFlags().StringArray("allow-command", nil, "let the model run this program, after you approve each command (can be repeated)")
+	agentCmd.PersistentFlags().Duration("command-timeout", 2*time.Minute, "stop a command the model runs after this long")
+	agentCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	agentCmd.PersistentFlags().Bool("dry-run", false, "print the first request that would be sent to Bedrock without sending it")
+	agentCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr after each response")
+}
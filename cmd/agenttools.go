@@ -0,0 +1,521 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// maxGrepMatches is the most matches the grep tool returns
+const maxGrepMatches = 200
+
+// maxGrepFileSize is the size above which files are skipped by grep
+const maxGrepFileSize = 1024 * 1024
+
+// agentTools returns the built-in tools of the agent command. Every path
+// they are given is kept inside the working directory and out of hidden
+// files and directories. run_command is only offered if some commands are
+// allowed.
+func agentTools(allowedCommands []string, commandTimeout time.Duration) []tool {
+
+	tools := []tool{
+		readFileTool{},
+		listDirTool{},
+		grepTool{},
+		writeFileTool{},
+	}
+
+	if len(allowedCommands) > 0 {
+		tools = append(tools, runCommandTool{
+			allowed: allowedCommands,
+			timeout: commandTimeout,
+		})
+	}
+
+	return tools
+}
+
+// toolSpec describes a built-in tool whose input is an object with the
+// given properties
+func toolSpec(name string, description string, properties map[string]interface{}, required ...string) types.ToolSpecification {
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return types.ToolSpecification{
+		Name:        aws.String(name),
+		Description: aws.String(description),
+		InputSchema: &types.ToolInputSchemaMemberJson{
+			Value: document.NewLazyDocument(schema),
+		},
+	}
+}
+
+// agentPath resolves a path for a built-in tool like sandboxPath, and also
+// refuses hidden files and directories, which often hold secrets like
+// .env or .git/config
+func agentPath(filename string) (string, error) {
+
+	fullPath, err := sandboxPath(filename)
+	if err != nil {
+		return "", err
+	}
+
+	for _, part := range strings.Split(filepath.ToSlash(filepath.Clean(filename)), "/") {
+		if part != "." && isHidden(part) {
+			return "", fmt.Errorf("access denied: %s is hidden", filename)
+		}
+	}
+
+	return fullPath, nil
+}
+
+// isHidden reports whether a file or directory name is hidden
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+func stringProperty(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": description}
+}
+
+func integerProperty(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "description": description}
+}
+
+// readFileTool returns the contents of a file with line numbers
+type readFileTool struct{}
+
+func (readFileTool) spec() types.ToolSpecification {
+	return toolSpec("read_file",
+		"Read a text file. Each line is prefixed with its line number. Use start_line and end_line to read part of a large file.",
+		map[string]interface{}{
+			"path":       stringProperty("path of the file, relative to the working directory"),
+			"start_line": integerProperty("first line to read, starting at 1"),
+			"end_line":   integerProperty("last line to read"),
+		}, "path")
+}
+
+func (readFileTool) call(ctx context.Context, input []byte) (string, error) {
+
+	var in struct {
+		Path      string `json:"path"`
+		StartLine int    `json:"start_line"`
+		EndLine   int    `json:"end_line"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %w", err)
+	}
+
+	fullPath, err := agentPath(in.Path)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	if isBinary(data) {
+		return "", fmt.Errorf("%s is not a text file", in.Path)
+	}
+
+	lines := splitLines(string(data))
+	start := max(in.StartLine, 1)
+	end := len(lines)
+	if in.EndLine > 0 && in.EndLine < end {
+		end = in.EndLine
+	}
+
+	if start > end {
+		return fmt.Sprintf("%s has %d lines", in.Path, len(lines)), nil
+	}
+
+	var out strings.Builder
+	for i := start; i <= end; i++ {
+		fmt.Fprintf(&out, "%6d\t%s\n", i, lines[i-1])
+	}
+
+	return out.String(), nil
+}
+
+// listDirTool lists the entries of a directory
+type listDirTool struct{}
+
+func (listDirTool) spec() types.ToolSpecification {
+	return toolSpec("list_dir",
+		"List the files and directories in a directory. Directories end with a slash. Hidden files and directories are left out.",
+		map[string]interface{}{
+			"path": stringProperty("path of the directory, relative to the working directory. defaults to the working directory"),
+		})
+}
+
+func (listDirTool) call(ctx context.Context, input []byte) (string, error) {
+
+	var in struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %w", err)
+	}
+
+	fullPath, err := agentPath(cmp.Or(in.Path, "."))
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	for _, e := range entries {
+		if isHidden(e.Name()) {
+			continue
+		}
+		out.WriteString(e.Name())
+		if e.IsDir() {
+			out.WriteString("/")
+		}
+		out.WriteString("\n")
+	}
+
+	if out.Len() == 0 {
+		return "(empty directory)", nil
+	}
+
+	return out.String(), nil
+}
+
+// grepTool searches files below a directory for a regular expression
+type grepTool struct{}
+
+func (grepTool) spec() types.ToolSpecification {
+	return toolSpec("grep",
+		fmt.Sprintf("Search text files for a regular expression (Go RE2 syntax). Returns matching lines as path:line: text, up to %d matches. Hidden files and directories are skipped.", maxGrepMatches),
+		map[string]interface{}{
+			"pattern": stringProperty("regular expression to search for"),
+			"path":    stringProperty("file or directory to search, relative to the working directory. defaults to the working directory"),
+		}, "pattern")
+}
+
+func (grepTool) call(ctx context.Context, input []byte) (string, error) {
+
+	var in struct {
+		Pattern string `json:"pattern"`
+		Path    string `json:"path"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %w", err)
+	}
+
+	re, err := regexp.Compile(in.Pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	root, err := agentPath(cmp.Or(in.Path, "."))
+	if err != nil {
+		return "", err
+	}
+
+	baseDir, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("unable to get working directory: %w", err)
+	}
+
+	var out strings.Builder
+	matches := 0
+
+	errLimit := errors.New("too many matches")
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+
+		if d.IsDir() {
+			if path != root && isHidden(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// hidden files like .env are as likely to hold secrets as hidden
+		// directories
+		if isHidden(d.Name()) {
+			return nil
+		}
+
+		// symlinks could lead outside of the working directory
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Size() > maxGrepFileSize {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil || isBinary(data) {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(baseDir, path)
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxGrepFileSize)
+		for line := 1; scanner.Scan(); line++ {
+			if re.Match(scanner.Bytes()) {
+				if matches == maxGrepMatches {
+					return errLimit
+				}
+				matches++
+				fmt.Fprintf(&out, "%s:%d: %s\n", rel, line, scanner.Text())
+			}
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, errLimit) {
+		fmt.Fprintf(&out, "[stopped after %d matches]\n", maxGrepMatches)
+	} else if err != nil {
+		return "", err
+	}
+
+	if matches == 0 {
+		return "no matches", nil
+	}
+
+	return out.String(), nil
+}
+
+// writeFileTool creates or replaces a file. The change is shown as a diff
+// and only made once the user approves it.
+type writeFileTool struct{}
+
+func (writeFileTool) spec() types.ToolSpecification {
+	return toolSpec("write_file",
+		"Create a file or replace the whole contents of an existing file. The user is shown a diff and has to approve the change.",
+		map[string]interface{}{
+			"path":    stringProperty("path of the file, relative to the working directory"),
+			"content": stringProperty("the complete new contents of the file"),
+		}, "path", "content")
+}
+
+func (writeFileTool) call(ctx context.Context, input []byte) (string, error) {
+
+	var in struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %w", err)
+	}
+
+	fullPath, err := agentPath(in.Path)
+	if err != nil {
+		return "", err
+	}
+
+	var before []byte
+	mode := os.FileMode(0644)
+
+	info, err := os.Stat(fullPath)
+	switch {
+	case err == nil && info.IsDir():
+		return "", fmt.Errorf("%s is a directory", in.Path)
+	case err == nil:
+		mode = info.Mode().Perm()
+		before, err = os.ReadFile(fullPath)
+		if err != nil {
+			return "", err
+		}
+	case !os.IsNotExist(err):
+		return "", err
+	}
+
+	diff := unifiedDiff(filepath.ToSlash(filepath.Clean(in.Path)), string(before), in.Content)
+	if diff == "" && before != nil {
+		return fmt.Sprintf("%s already has this content", in.Path), nil
+	}
+
+	fmt.Fprint(os.Stderr, diff)
+	if !confirm(ctx, fmt.Sprintf("apply this change to %s?", in.Path)) {
+		return "", errDeclined
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(fullPath, []byte(in.Content), mode); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("wrote %d bytes to %s", len(in.Content), in.Path), nil
+}
+
+// runCommandTool runs a command from the allowlist in the working
+// directory, once the user approves it. Commands are run directly rather
+// than through a shell, so the allowlist can't be bypassed with ; or |.
+type runCommandTool struct {
+	allowed []string
+	timeout time.Duration
+}
+
+func (t runCommandTool) spec() types.ToolSpecification {
+	return toolSpec("run_command",
+		fmt.Sprintf("Run a command in the working directory and return its output. The command is not run through a shell, so pipes, redirects and ; are not supported. Only these programs are allowed: %s. The user has to approve every command.", strings.Join(t.allowed, ", ")),
+		map[string]interface{}{
+			"command": stringProperty("the command line to run, e.g. go test ./..."),
+		}, "command")
+}
+
+func (t runCommandTool) call(ctx context.Context, input []byte) (string, error) {
+
+	var in struct {
+		Command string `json:"command"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %w", err)
+	}
+
+	args, err := splitCommand(in.Command)
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	if strings.ContainsRune(args[0], filepath.Separator) || !slices.Contains(t.allowed, args[0]) {
+		return "", fmt.Errorf("%s is not an allowed command. allowed commands are: %s", args[0], strings.Join(t.allowed, ", "))
+	}
+
+	if !confirm(ctx, fmt.Sprintf("run `%s`?", in.Command)) {
+		return "", errDeclined
+	}
+
+	runCtx := ctx
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	var output bytes.Buffer
+	c := exec.CommandContext(runCtx, args[0], args[1:]...)
+	c.Stdout = &output
+	c.Stderr = &output
+
+	if err := c.Run(); err != nil {
+		if runCtx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", t.timeout)
+		}
+		return "", fmt.Errorf("%s\n%w", output.String(), err)
+	}
+
+	return output.String(), nil
+}
+
+// splitCommand splits a command line into its arguments, following the
+// quoting rules of a POSIX shell
+func splitCommand(line string) ([]string, error) {
+
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`+"`", runes[i+1]):
+				i++
+				arg.WriteRune(runes[i])
+			default:
+				arg.WriteRune(r)
+			}
+
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+
+		case r == '\\' && i+1 < len(runes):
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in command")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// isBinary guesses whether data is binary by looking for a NUL byte near
+// the start
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAgentToolsSkipHidden(t *testing.T) {
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"notes.txt":       "secret is not here\n",
+		".env":            "SECRET=1\n",
+		".git/config":     "secret = 2\n",
+		"src/.hidden.txt": "secret 3\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	ctx := context.Background()
+
+	for _, path := range []string{".env", ".git/config", "./.git/config", "src/.hidden.txt", "src/../.env"} {
+		if _, err := (readFileTool{}).call(ctx, []byte(`{"path":"`+path+`"}`)); err == nil {
+			t.Errorf("read_file read hidden file %s", path)
+		}
+	}
+
+	if _, err := (readFileTool{}).call(ctx, []byte(`{"path":"./notes.txt"}`)); err != nil {
+		t.Errorf("read_file: %v", err)
+	}
+
+	out, err := (listDirTool{}).call(ctx, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("list_dir: %v", err)
+	}
+	if out != "notes.txt\nsrc/\n" {
+		t.Errorf("list_dir = %q", out)
+	}
+
+	if _, err := (listDirTool{}).call(ctx, []byte(`{"path":".git"}`)); err == nil {
+		t.Error("list_dir listed a hidden directory")
+	}
+
+	out, err = (grepTool{}).call(ctx, []byte(`{"pattern":"(?i)secret"}`))
+	if err != nil {
+		t.Fatalf("grep: %v", err)
+	}
+	if !strings.Contains(out, "notes.txt") || strings.Count(out, "\n") != 1 {
+		t.Errorf("grep = %q, want only the match in notes.txt", out)
+	}
+}
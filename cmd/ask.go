@@ -0,0 +1,237 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/index"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/spf13/cobra"
+)
+
+// askSystemPrompt tells the model to answer from the retrieved chunks and
+// cite them
+const askSystemPrompt = `Answer the question using only the documents provided. Each document is part of a file, starting with its path and with a line number in front of every line.
+
+Cite the lines your answer is based on as path:line or path:start-end, for example docs/setup.md:12-18. If the documents don't contain the answer, say so rather than guessing.`
+
+// askCmd represents the ask command
+var askCmd = &cobra.Command{
+	Use:   "ask",
+	Short: "Answer a question from a local index",
+	Long: `Finds the parts of an index made with the index command that best match a
+question, and sends them to a LLM on Amazon Bedrock to answer it, like so:
+
+> chat-cli ask "How do I configure retries?" --index docs
+
+The answer cites the files and lines it is based on.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		question := args[0]
+
+		name, err := cmd.PersistentFlags().GetString("index")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		topK, err := cmd.PersistentFlags().GetInt("top-k")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if topK < 1 {
+			return errorf(kindUsage, "--top-k must be at least 1")
+		}
+
+		idx, err := index.Load(name)
+		if errors.Is(err, index.ErrCorrupt) {
+			return fmt.Errorf("%w. run index again to rebuild it", err)
+		}
+		if err != nil {
+			return withKind(kindUsage, err)
+		}
+
+		// the question is embedded with the same model as the index
+		em, err := models.GetModel(idx.ModelID)
+		if err != nil {
+			return err
+		}
+
+		e, err := newEmbedder(cmd, em, idx.Dimensions)
+		if err != nil {
+			return err
+		}
+		e.inputType = "search_query"
+
+		modelId, err := cmd.PersistentFlags().GetString("model-id")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// validate model is supported
+		m, err := models.GetModel(modelId)
+		if err != nil {
+			return err
+		}
+
+		if m.ModelType != "text" || !m.SupportsStreaming {
+			return errorf(kindUnsupportedModel, "model %s does not support streaming text generation. please use a different model", m.ModelID)
+		}
+
+		maxTokens, err := cmd.PersistentFlags().GetInt32("max-tokens")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// apply the guardrail from the flags or the config file
+		guard, err := getGuardrail(cmd)
+		if err != nil {
+			return err
+		}
+
+		// print the request that embeds the question instead of sending it,
+		// since the rest depends on its result
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if dryRun {
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
+			}
+
+			body, err := e.body([]string{question})
+			if err != nil {
+				return err
+			}
+
+			out, err := newInvokeModelDryRun(region, em, question, e.input(body))
+			if err != nil {
+				return err
+			}
+
+			return printDryRun(os.Stdout, out)
+		}
+
+		force, err := cmd.PersistentFlags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		budget, err := newBudgetGuard(force)
+		if err != nil {
+			return err
+		}
+
+		// set up connection to AWS
+		svc, err := newBedrockClient(cmd.Context(), cmd)
+		if err != nil {
+			return err
+		}
+		e.svc = svc
+
+		// the question is cheap to embed, so it isn't checked first
+		vectors, tokens, err := e.embed(cmd.Context(), []string{question})
+		budget.add(0, recordUsage("ask", em, &types.TokenUsage{
+			InputTokens:  aws.Int32(tokens),
+			OutputTokens: aws.Int32(0),
+			TotalTokens:  aws.Int32(tokens),
+		}, showUsage))
+		if err != nil {
+			return err
+		}
+
+		// wrap the best matches in document tags, as prompt does with stdin
+		var prompt strings.Builder
+		for _, r := range idx.Search(vectors[0], topK) {
+			prompt.WriteString("<document>\n\n" + numberChunk(r.Chunk) + "\n\n</document>\n\n")
+		}
+		prompt.WriteString(question)
+
+		converseStreamInput := &bedrockruntime.ConverseStreamInput{
+			ModelId: aws.String(m.ModelID),
+			System: []types.SystemContentBlock{
+				&types.SystemContentBlockMemberText{
+					Value: askSystemPrompt,
+				},
+			},
+			Messages: []types.Message{
+				{
+					Role: types.ConversationRoleUser,
+					Content: []types.ContentBlock{
+						&types.ContentBlockMemberText{
+							Value: prompt.String(),
+						},
+					},
+				},
+			},
+			InferenceConfig: &types.InferenceConfiguration{
+				MaxTokens: &maxTokens,
+			},
+			GuardrailConfig: guard.streamConfig(),
+		}
+
+		estimate := m.Cost(estimateInputTokens(converseInputOf(converseStreamInput)), maxTokens)
+		if err := budget.confirm(cmd.Context(), estimate); err != nil {
+			return err
+		}
+
+		retries, err := getCallPolicy(cmd)
+		if err != nil {
+			return err
+		}
+
+		result, err := retries.converseStream(cmd.Context(), svc, converseStreamInput, newReasoningStreamHandler(textStreamHandler{w: os.Stdout}))
+		fmt.Println()
+		recordUsage("ask", m, result.Usage, showUsage)
+		if err != nil {
+			return fmt.Errorf("error from Bedrock, %w", err)
+		}
+
+		printGuardrail(os.Stderr, newGuardrailOutput(guardrailStreamTrace(result.Trace), result.StopReason))
+
+		return stopReasonError(result.StopReason, maxTokens)
+	},
+}
+
+// numberChunk returns the text of a chunk with its path in front and a
+// line number in front of every line, so the model can cite it
+func numberChunk(c index.Chunk) string {
+
+	var out strings.Builder
+	out.WriteString(c.Path + "\n")
+
+	for i, line := range splitLines(c.Text) {
+		fmt.Fprintf(&out, "%6d\t%s\n", c.StartLine+i, line)
+	}
+
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+func init() {
+	rootCmd.AddCommand(askCmd)
+	askCmd.PersistentFlags().String("index", "", "name of the index to search")
+	askCmd.PersistentFlags().StringP("model-id", "m", "anthropic.claude-3-haiku-20240307-v1:0", "set the model id")
+	askCmd.PersistentFlags().Int("top-k", 5, "number of chunks to send with the question")
+	askCmd.PersistentFlags().Int32("max-tokens", 1000, "max tokens of the answer")
+	askCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	askCmd.PersistentFlags().Bool("dry-run", false, "print the request that embeds the question without sending it")
+	askCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr")
+	askCmd.MarkPersistentFlagRequired("index")
+}
@@ -0,0 +1,516 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/spf13/cobra"
+)
+
+// batchRequest is a single line of a batch input file. Any field left
+// empty falls back to the value set by the matching command line flag.
+type batchRequest struct {
+	ID          string   `json:"id,omitempty"`
+	Prompt      string   `json:"prompt"`
+	System      string   `json:"system,omitempty"`
+	ModelID     string   `json:"model_id,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	MaxTokens   *int32   `json:"max_tokens,omitempty"`
+}
+
+// batchResult is a single line of a batch output file
+type batchResult struct {
+	Line       int          `json:"line"`
+	ID         string       `json:"id,omitempty"`
+	ModelID    string       `json:"model_id,omitempty"`
+	Response   string       `json:"response,omitempty"`
+	StopReason string       `json:"stop_reason,omitempty"`
+	Usage      *outputUsage `json:"usage,omitempty"`
+	Error      string       `json:"error,omitempty"`
+
+	Guardrail *guardrailOutput `json:"guardrail,omitempty"`
+
+	cost float64
+}
+
+type batchJob struct {
+	line    int
+	request batchRequest
+	err     error
+}
+
+// batchCmd represents the batch command
+var batchCmd = &cobra.Command{
+	Use:   "batch",
+	Short: "Run prompts from a JSONL file",
+	Long: `Reads prompts from a JSONL file, sends each one to Amazon Bedrock and writes
+the results to another JSONL file like so:
+
+> chat-cli batch --input prompts.jsonl --output results.jsonl
+
+Each input line is a JSON object with a "prompt" and optionally an "id",
+"system", "model_id", "temperature", "top_p" and "max_tokens". Lines that
+are already in the output file without an error are skipped, so an
+interrupted job can be resumed by running the same command again.
+
+Lines that failed are run again and their new result is appended, so the
+output file can have more than one result for a line. The last one is the
+one that counts.`,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		input, err := cmd.PersistentFlags().GetString("input")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		outputFile, err := cmd.PersistentFlags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		concurrency, err := cmd.PersistentFlags().GetInt("concurrency")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+		if concurrency < 1 {
+			return errorf(kindUsage, "concurrency must be at least 1")
+		}
+
+		rpm, err := cmd.PersistentFlags().GetInt("rpm")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// get defaults for fields not set on a line
+		defaults := batchRequest{}
+
+		defaults.ModelID, err = cmd.PersistentFlags().GetString("model-id")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		defaults.System, err = cmd.PersistentFlags().GetString("system")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		temperature, err := cmd.PersistentFlags().GetFloat32("temperature")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+		defaults.Temperature = &temperature
+
+		topP, err := cmd.PersistentFlags().GetFloat32("topP")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+		defaults.TopP = &topP
+
+		maxTokens, err := cmd.PersistentFlags().GetInt32("max-tokens")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+		defaults.MaxTokens = &maxTokens
+
+		// apply the guardrail from the flags or the config file
+		guard, err := getGuardrail(cmd)
+		if err != nil {
+			return err
+		}
+
+		force, err := cmd.PersistentFlags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		budget, err := newBudgetGuard(force)
+		if err != nil {
+			return err
+		}
+
+		// find lines that have already been completed
+		completed, err := readCompletedLines(outputFile)
+		if err != nil {
+			return fmt.Errorf("unable to read output file: %w", err)
+		}
+
+		in, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("unable to open input file: %w", err)
+		}
+		defer in.Close()
+
+		// print the requests instead of sending them
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if dryRun {
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
+			}
+
+			return dryRunBatch(region, in, completed, defaults, guard)
+		}
+
+		out, err := os.OpenFile(outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("unable to open output file: %w", err)
+		}
+		defer out.Close()
+
+		ctx := cmd.Context()
+
+		// set up connection to AWS
+		svc, err := newBedrockClient(ctx, cmd)
+		if err != nil {
+			return err
+		}
+
+		retries, err := getCallPolicy(cmd)
+		if err != nil {
+			return err
+		}
+
+		// limit how fast requests are sent
+		var throttle <-chan time.Time
+		if rpm > 0 {
+			ticker := time.NewTicker(time.Minute / time.Duration(rpm))
+			defer ticker.Stop()
+			throttle = ticker.C
+		}
+
+		jobs := make(chan batchJob)
+		results := make(chan batchResult)
+
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					results <- runBatchJob(ctx, svc, retries, budget, job, defaults, guard)
+				}
+			}()
+		}
+
+		// write results as they arrive so an interrupted job can be resumed
+		var processed, failed int
+		var cost float64
+		done := make(chan error)
+		go func() {
+			enc := json.NewEncoder(out)
+			var writeErr error
+			for result := range results {
+				processed++
+				cost += result.cost
+				if result.Error != "" {
+					failed++
+					log.Printf("line %d: %s", result.Line, result.Error)
+				}
+				if result.Guardrail != nil && result.Guardrail.Intervened {
+					log.Printf("line %d: content was blocked by a guardrail", result.Line)
+				}
+				if writeErr == nil {
+					writeErr = enc.Encode(result)
+				}
+			}
+			done <- writeErr
+		}()
+
+		skipped := 0
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+		// stop sending lines once the command is cancelled. lines already
+		// in flight are cancelled too and can be resumed later.
+		line := 0
+	scan:
+		for scanner.Scan() {
+			line++
+
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+
+			if completed[line] {
+				skipped++
+				continue
+			}
+
+			job := batchJob{line: line}
+			job.err = json.Unmarshal([]byte(text), &job.request)
+
+			if throttle != nil && job.err == nil {
+				select {
+				case <-throttle:
+				case <-ctx.Done():
+					break scan
+				}
+			}
+
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				break scan
+			}
+		}
+		close(jobs)
+
+		wg.Wait()
+		close(results)
+
+		if err := <-done; err != nil {
+			return fmt.Errorf("error writing to file: %w", err)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("unable to read input file: %w", err)
+		}
+
+		log.Printf("processed %d lines (%d failed), skipped %d already completed, estimated cost $%.4f", processed, failed, skipped, cost)
+
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+
+		return nil
+	},
+}
+
+// runBatchJob sends a single batch request to Bedrock and returns its result
+func runBatchJob(ctx context.Context, svc *bedrockruntime.Client, retries callPolicy, budget *budgetGuard, job batchJob, defaults batchRequest, guard *guardrail) batchResult {
+
+	result := batchResult{
+		Line: job.line,
+		ID:   job.request.ID,
+	}
+
+	if job.err != nil {
+		result.Error = fmt.Sprintf("invalid input: %v", job.err)
+		return result
+	}
+
+	m, converseInput, err := newBatchInput(job.request, defaults, guard)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.ModelID = m.ModelID
+
+	// lines over budget fail so they can be resumed later
+	estimate := m.Cost(estimateInputTokens(converseInput), aws.ToInt32(converseInput.InferenceConfig.MaxTokens))
+	if err := budget.check(estimate); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	output, err := retries.converse(ctx, svc, converseInput)
+	if err != nil {
+		budget.add(estimate, 0)
+		result.Error = fmt.Sprintf("error from Bedrock, %v", err)
+		return result
+	}
+
+	result.StopReason = string(output.StopReason)
+	result.Guardrail = newGuardrailOutput(guardrailTrace(output.Trace), output.StopReason)
+
+	result.Usage = newOutputUsage(output.Usage)
+	result.cost = recordUsage("batch", m, output.Usage, false)
+	budget.add(estimate, result.cost)
+
+	if response, ok := output.Output.(*types.ConverseOutputMemberMessage); ok {
+		for _, block := range response.Value.Content {
+			if text, ok := block.(*types.ContentBlockMemberText); ok {
+				result.Response += text.Value
+			}
+		}
+	}
+
+	return result
+}
+
+// newBatchInput builds the Converse request for a batch line, using the
+// defaults for any field the line doesn't set
+func newBatchInput(req batchRequest, defaults batchRequest, guard *guardrail) (models.Model, *bedrockruntime.ConverseInput, error) {
+
+	if req.Prompt == "" {
+		return models.Model{}, nil, errors.New("invalid input: prompt is required")
+	}
+
+	if req.ModelID == "" {
+		req.ModelID = defaults.ModelID
+	}
+	if req.System == "" {
+		req.System = defaults.System
+	}
+	if req.Temperature == nil {
+		req.Temperature = defaults.Temperature
+	}
+	if req.TopP == nil {
+		req.TopP = defaults.TopP
+	}
+	if req.MaxTokens == nil {
+		req.MaxTokens = defaults.MaxTokens
+	}
+
+	// validate model is supported
+	m, err := models.GetModel(req.ModelID)
+	if err != nil {
+		return m, nil, err
+	}
+
+	if m.ModelType != "text" {
+		return m, nil, fmt.Errorf("model %s does not support text generation", m.ModelID)
+	}
+
+	converseInput := &bedrockruntime.ConverseInput{
+		ModelId: aws.String(m.ModelID),
+		InferenceConfig: &types.InferenceConfiguration{
+			MaxTokens:   req.MaxTokens,
+			TopP:        req.TopP,
+			Temperature: req.Temperature,
+		},
+		Messages: []types.Message{
+			{
+				Role: types.ConversationRoleUser,
+				Content: []types.ContentBlock{
+					&types.ContentBlockMemberText{
+						Value: req.Prompt,
+					},
+				},
+			},
+		},
+		GuardrailConfig: guard.config(),
+	}
+
+	if req.System != "" {
+		converseInput.System = []types.SystemContentBlock{
+			&types.SystemContentBlockMemberText{
+				Value: req.System,
+			},
+		}
+	}
+
+	return m, converseInput, nil
+}
+
+// dryRunBatch prints the request for every line that hasn't been completed
+// yet, one line of JSON each, instead of sending them
+func dryRunBatch(region string, in io.Reader, completed map[int]bool, defaults batchRequest, guard *guardrail) error {
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || completed[line] {
+			continue
+		}
+
+		var req batchRequest
+		if err := json.Unmarshal([]byte(text), &req); err != nil {
+			log.Printf("line %d: invalid input: %v", line, err)
+			continue
+		}
+
+		m, input, err := newBatchInput(req, defaults, guard)
+		if err != nil {
+			log.Printf("line %d: %v", line, err)
+			continue
+		}
+
+		out, err := newConverseDryRun("Converse", region, m, input)
+		if err != nil {
+			return err
+		}
+		out.Line = line
+
+		if err := writeJSON(os.Stdout, out); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read input file: %w", err)
+	}
+
+	return nil
+}
+
+// readCompletedLines returns the line numbers already written to a batch
+// output file without an error. A line that failed and was run again has
+// more than one result, and only the last one counts.
+func readCompletedLines(filename string) (map[int]bool, error) {
+
+	completed := make(map[int]bool)
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return completed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var result batchResult
+
+		// ignore a partially written last line from an interrupted run
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			continue
+		}
+
+		completed[result.Line] = result.Error == ""
+	}
+
+	return completed, scanner.Err()
+}
+
+func init() {
+	rootCmd.AddCommand(batchCmd)
+	batchCmd.PersistentFlags().String("input", "", "path to a JSONL file of prompts")
+	batchCmd.PersistentFlags().String("output", "", "path to a JSONL file to write results to")
+	batchCmd.MarkPersistentFlagRequired("input")
+	batchCmd.MarkPersistentFlagRequired("output")
+
+	batchCmd.PersistentFlags().Int("concurrency", 4, "number of requests to run at the same time")
+	batchCmd.PersistentFlags().Int("rpm", 0, "maximum requests per minute (0 for no limit)")
+	batchCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	batchCmd.PersistentFlags().Bool("dry-run", false, "print the requests that would be sent to Bedrock without sending them")
+
+	batchCmd.PersistentFlags().StringP("model-id", "m", "anthropic.claude-3-haiku-20240307-v1:0", "set the default model id")
+	batchCmd.PersistentFlags().String("system", "", "set the default system prompt")
+
+	batchCmd.PersistentFlags().Float32("temperature", 1.0, "temperature setting")
+	batchCmd.PersistentFlags().Float32("topP", 0.999, "topP setting")
+	batchCmd.PersistentFlags().Int32("max-tokens", 500, "max tokens")
+}
@@ -0,0 +1,278 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/ledger"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/go-micah/chat-cli/settings"
+	"github.com/mattn/go-isatty"
+)
+
+// budgetGuard refuses calls that would go over the spend limits in the
+// config file. It keeps track of spend made while the command is running,
+// and of the estimated cost of calls that are still in flight, so calls
+// made at the same time can't go over a limit between them.
+type budgetGuard struct {
+	limits settings.Budget
+	force  bool
+
+	mu       sync.Mutex
+	daily    float64
+	monthly  float64
+	reserved float64
+}
+
+// newBudgetGuard loads the spend limits and what has already been spent
+// this day and month from the usage ledger
+func newBudgetGuard(force bool) (*budgetGuard, error) {
+
+	s, err := settings.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &budgetGuard{
+		limits: s.Budget,
+		force:  force,
+	}
+
+	if force || (g.limits.Daily == 0 && g.limits.Monthly == 0) {
+		return g, nil
+	}
+
+	now := time.Now()
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	entries, err := ledger.Read(startOfMonth)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read usage ledger: %w", err)
+	}
+
+	for _, e := range entries {
+		g.monthly += e.Cost
+		if !e.Time.Before(startOfDay) {
+			g.daily += e.Cost
+		}
+	}
+
+	return g, nil
+}
+
+// check returns an error if a call with the estimated cost would go over
+// one of the limits. Otherwise the estimate is reserved until add is
+// called with the actual cost.
+func (g *budgetGuard) check(estimate float64) error {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.force {
+		if g.limits.PerRequest > 0 && estimate > g.limits.PerRequest {
+			return fmt.Errorf("estimated cost $%.4f is over the per-request limit of $%.2f", estimate, g.limits.PerRequest)
+		}
+
+		if g.limits.Daily > 0 && g.daily+g.reserved+estimate > g.limits.Daily {
+			return fmt.Errorf("estimated cost $%.4f would go over the daily budget of $%.2f ($%.4f spent today)", estimate, g.limits.Daily, g.daily+g.reserved)
+		}
+
+		if g.limits.Monthly > 0 && g.monthly+g.reserved+estimate > g.limits.Monthly {
+			return fmt.Errorf("estimated cost $%.4f would go over the monthly budget of $%.2f ($%.4f spent this month)", estimate, g.limits.Monthly, g.monthly+g.reserved)
+		}
+	}
+
+	g.reserved += estimate
+
+	return nil
+}
+
+// confirm checks the estimated cost against the limits and, if it would go
+// over one, asks the user whether to continue. It returns an error if the
+// call should not be made.
+func (g *budgetGuard) confirm(ctx context.Context, estimate float64) error {
+
+	err := g.check(estimate)
+	if err == nil {
+		return nil
+	}
+
+	if !confirm(ctx, err.Error()+". continue anyway?") {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		return fmt.Errorf("%w. use --force to override", err)
+	}
+
+	// the call goes ahead, so its estimate is reserved like any other
+	g.mu.Lock()
+	g.reserved += estimate
+	g.mu.Unlock()
+
+	return nil
+}
+
+// add records spend made while the command is running, in place of the
+// estimate reserved for the call by check
+func (g *budgetGuard) add(reserved float64, cost float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.reserved = max(g.reserved-reserved, 0)
+	g.daily += cost
+	g.monthly += cost
+}
+
+// guardCalls wraps a converseFunc so that every call after the first is
+// checked against the limits before it is made, since tool use and
+// auto-continue send the conversation again. The first call is covered by
+// the estimate the caller has already reserved.
+func (g *budgetGuard) guardCalls(ctx context.Context, m models.Model, maxTokens int32, reserved float64, send converseFunc) converseFunc {
+
+	first := true
+
+	return func(msgs []types.Message) (converseTurn, error) {
+
+		estimate := reserved
+		if !first {
+			estimate = m.Cost(estimateMessageTokens(msgs), maxTokens)
+			if err := g.confirm(ctx, estimate); err != nil {
+				return converseTurn{}, err
+			}
+		}
+		first = false
+
+		turn, err := send(msgs)
+
+		var cost float64
+		if turn.Usage != nil {
+			cost = m.Cost(aws.ToInt32(turn.Usage.InputTokens), aws.ToInt32(turn.Usage.OutputTokens))
+		}
+		g.add(estimate, cost)
+
+		return turn, err
+	}
+}
+
+// confirm asks a yes/no question on the terminal. It returns false if
+// there is no terminal to ask or ctx is done first.
+func confirm(ctx context.Context, question string) bool {
+
+	answer, ok := askTerminal(ctx, question+" [y/N] ")
+	answer = strings.ToLower(answer)
+
+	return ok && (answer == "y" || answer == "yes")
+}
+
+// askTerminal asks a question on the terminal and returns the answer
+// without surrounding space. Since stdin is often used to pipe in a
+// document, the answer is read from the controlling terminal. It returns
+// false if there is no terminal to ask or ctx is done first.
+func askTerminal(ctx context.Context, question string) (string, bool) {
+
+	in := stdinReader
+	if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return "", false
+		}
+		defer tty.Close()
+		in = bufio.NewReader(tty)
+	}
+
+	fmt.Fprint(os.Stderr, question)
+
+	answer, err := readLine(ctx, in)
+	if err != nil && answer == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(answer), true
+}
+
+// estimateTokens gives a rough count of the tokens in a piece of text
+func estimateTokens(text string) int32 {
+	return int32((len(text) + 3) / 4)
+}
+
+// estimateImageTokens gives a rough count of the tokens used by an image,
+// based on its size in pixels
+func estimateImageTokens(data []byte) int32 {
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// formats we can't decode are counted as the largest image
+		return 1600
+	}
+
+	tokens := int32(cfg.Width * cfg.Height / 750)
+	if tokens > 1600 {
+		tokens = 1600
+	}
+
+	return tokens
+}
+
+// estimateInputTokens gives a rough count of the input tokens of a Converse
+// request, including its system prompt
+func estimateInputTokens(input *bedrockruntime.ConverseInput) int32 {
+
+	tokens := estimateMessageTokens(input.Messages)
+	for _, block := range input.System {
+		if v, ok := block.(*types.SystemContentBlockMemberText); ok {
+			tokens += estimateTokens(v.Value)
+		}
+	}
+
+	return tokens
+}
+
+// estimateMessageTokens gives a rough count of the input tokens of a
+// conversation
+func estimateMessageTokens(msgs []types.Message) int32 {
+
+	var tokens int32
+
+	for _, msg := range msgs {
+		for _, block := range msg.Content {
+			switch v := block.(type) {
+			case *types.ContentBlockMemberText:
+				tokens += estimateTokens(v.Value)
+			case *types.ContentBlockMemberImage:
+				if src, ok := v.Value.Source.(*types.ImageSourceMemberBytes); ok {
+					tokens += estimateImageTokens(src.Value)
+				}
+			case *types.ContentBlockMemberToolUse:
+				if v.Value.Input != nil {
+					b, _ := v.Value.Input.MarshalSmithyDocument()
+					tokens += estimateTokens(string(b))
+				}
+			case *types.ContentBlockMemberToolResult:
+				for _, c := range v.Value.Content {
+					if text, ok := c.(*types.ToolResultContentBlockMemberText); ok {
+						tokens += estimateTokens(text.Value)
+					}
+				}
+			}
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/go-micah/chat-cli/settings"
+)
+
+func TestBudgetGuardReserves(t *testing.T) {
+
+	g := &budgetGuard{limits: settings.Budget{Daily: 1}}
+
+	// calls that are all checked before any of them is added can't go
+	// over the limit between them
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if g.check(0.3) == nil {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 3 {
+		t.Fatalf("%d calls were allowed, want 3", allowed.Load())
+	}
+
+	// the actual cost replaces the estimate
+	g.add(0.3, 0.1)
+	g.add(0.3, 0.1)
+	g.add(0.3, 0.1)
+
+	if err := g.check(0.7); err != nil {
+		t.Errorf("check after the reservations were replaced: %v", err)
+	}
+	if err := g.check(0.1); err == nil {
+		t.Error("check allowed a call over the daily limit")
+	}
+}
+
+func TestBudgetGuardCalls(t *testing.T) {
+
+	m := models.Model{ModelID: "test", InputTokenPrice: 1, OutputTokenPrice: 1}
+	g := &budgetGuard{limits: settings.Budget{Daily: 100}}
+
+	// the first call is confirmed by the caller
+	if err := g.check(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// every call uses 1000 input and 1000 output tokens, $2
+	calls := 0
+	send := g.guardCalls(context.Background(), m, 1000, 5, func(msgs []types.Message) (converseTurn, error) {
+		calls++
+		return converseTurn{Usage: &types.TokenUsage{InputTokens: aws.Int32(1000), OutputTokens: aws.Int32(1000)}}, nil
+	})
+
+	for range 3 {
+		if _, err := send(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls != 3 || g.daily != 6 || g.reserved != 0 {
+		t.Errorf("after %d calls spent $%.2f with $%.2f reserved, want 3 calls, $6 and nothing reserved", calls, g.daily, g.reserved)
+	}
+}
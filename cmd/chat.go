@@ -4,14 +4,14 @@ Copyright © 2024 Micah Walter
 package cmd
 
 import (
-	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"slices"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
 	"github.com/go-micah/chat-cli/models"
@@ -27,79 +27,213 @@ var chatCmd = &cobra.Command{
 To quit the chat, just type "quit"	
 `,
 
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		var err error
 
 		modelId, err := cmd.PersistentFlags().GetString("model-id")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		// validate model is supported
 		m, err := models.GetModel(modelId)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			return err
+		}
+
+		if m.ModelType != "text" {
+			return errorf(kindUnsupportedModel, "model %s does not support text generation. please use a different model", m.ModelID)
 		}
 
 		// check if model supports streaming
 		if !m.SupportsStreaming {
-			log.Fatalf("model %s does not support streaming so it can't be used with the chat function", m.ModelID)
+			return errorf(kindUnsupportedModel, "model %s does not support streaming so it can't be used with the chat function", m.ModelID)
 		}
 
 		// get options
 		temperature, err := cmd.PersistentFlags().GetFloat32("temperature")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		topP, err := cmd.PersistentFlags().GetFloat32("topP")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		maxTokens, err := cmd.PersistentFlags().GetInt32("max-tokens")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
-		// set up connection to AWS
-		region, err := cmd.Parent().PersistentFlags().GetString("region")
+		// get prefill and stop sequences to steer the output
+		prefill, err := cmd.PersistentFlags().GetString("prefill")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		stop, err := cmd.PersistentFlags().GetStringArray("stop")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if err := validateSteering(m, prefill, stop); err != nil {
+			return err
+		}
+
+		// get model-specific request fields
+		params, err := cmd.PersistentFlags().GetStringArray("param")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		paramsFile, err := cmd.PersistentFlags().GetString("params-file")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		modelParams, err := buildModelParams(m, paramsFile, params)
+		if err != nil {
+			return err
+		}
+
+		responseFields, err := cmd.PersistentFlags().GetStringArray("response-field")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		autoContinue, err := cmd.PersistentFlags().GetInt("auto-continue")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// enable extended thinking
+		thinkingBudget, err := cmd.PersistentFlags().GetInt32("thinking-budget")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if thinkingBudget > 0 {
+			err = enableThinking(m, thinkingBudget, thinkingOptions{
+				maxTokens:    maxTokens,
+				temperature:  temperature,
+				topP:         topP,
+				prefill:      prefill,
+				autoContinue: autoContinue,
+			}, modelParams)
+			if err != nil {
+				return err
+			}
+		}
+
+		// start the MCP servers named with --mcp and --mcp-resource
+		servers, err := startMCP(cmd, m)
+		if err != nil {
+			return err
+		}
+		defer servers.close()
+
+		// get the tools the model can call
+		tools, err := getToolSet(cmd, m, servers.toolList())
+		if err != nil {
+			return err
+		}
+
+		if tools != nil {
+			if prefill != "" {
+				return errorf(kindUsage, "--tools and --mcp can't be combined with --prefill")
+			}
+
+			if autoContinue > 0 {
+				return errorf(kindUsage, "--tools and --mcp can't be combined with --auto-continue")
+			}
+		}
+
+		// apply the guardrail from the flags or the config file
+		guard, err := getGuardrail(cmd)
+		if err != nil {
+			return err
+		}
+
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
-		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+		// refuse calls that would go over budget
+		force, err := cmd.PersistentFlags().GetBool("force")
 		if err != nil {
-			log.Fatalf("unable to load AWS config: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
-		svc := bedrockruntime.NewFromConfig(cfg)
+		budget, err := newBudgetGuard(force)
+		if err != nil {
+			return err
+		}
+
+		// print the request for the first turn instead of sending it
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// set up connection to AWS
+		var svc *bedrockruntime.Client
+		if !dryRun {
+			svc, err = newBedrockClient(cmd.Context(), cmd)
+			if err != nil {
+				return err
+			}
+		}
+
+		retries, err := getCallPolicy(cmd)
+		if err != nil {
+			return err
+		}
 
 		conf := types.InferenceConfiguration{
-			MaxTokens:   &maxTokens,
-			TopP:        &topP,
-			Temperature: &temperature,
+			MaxTokens:     &maxTokens,
+			TopP:          &topP,
+			Temperature:   &temperature,
+			StopSequences: stop,
 		}
 
 		converseStreamInput := &bedrockruntime.ConverseStreamInput{
-			ModelId:         aws.String(m.ModelID),
-			InferenceConfig: &conf,
+			ModelId:                           aws.String(m.ModelID),
+			InferenceConfig:                   &conf,
+			AdditionalModelRequestFields:      modelParamsDocument(modelParams),
+			AdditionalModelResponseFieldPaths: responseFields,
+			ToolConfig:                        tools.toolConfig(),
+			GuardrailConfig:                   guard.streamConfig(),
 		}
 
 		// initial prompt
-		fmt.Printf("Hi there. You can ask me stuff!\n")
+		if !dryRun {
+			fmt.Printf("Hi there. You can ask me stuff!\n")
+		}
 
 		// tty-loop
 		for {
 
 			// gets user input
-			prompt := stringPrompt(">")
+			prompt, err := stringPrompt(cmd.Context(), ">")
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
 
 			// check for special words
 
 			// quit the program
 			if prompt == "quit\n" {
-				os.Exit(0)
+				return nil
+			}
+
+			// resources from MCP servers go with the first message
+			if len(converseStreamInput.Messages) == 0 {
+				prompt = servers.attach(prompt)
 			}
 
 			userMsg := types.Message{
@@ -113,27 +247,67 @@ To quit the chat, just type "quit"
 
 			converseStreamInput.Messages = append(converseStreamInput.Messages, userMsg)
 
-			output, err := svc.ConverseStream(context.Background(), converseStreamInput)
+			if dryRun {
+				return printChatDryRun(cmd, m, converseStreamInput, prefill)
+			}
 
-			if err != nil {
-				log.Fatal(err)
+			estimate := m.Cost(estimateMessageTokens(converseStreamInput.Messages), maxTokens)
+			if err := budget.confirm(cmd.Context(), estimate); err != nil {
+				if cmd.Context().Err() != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				converseStreamInput.Messages = converseStreamInput.Messages[:len(converseStreamInput.Messages)-1]
+				continue
 			}
 
-			fmt.Print("[Assistant]: ")
+			// the model only streams what comes after the prefill
+			fmt.Print("[Assistant]: " + prefill)
 
-			assistantMsg, err := processStreamingOutput(output, func(ctx context.Context, part string) error {
-				fmt.Print(part)
-				return nil
-			})
+			history := converseStreamInput.Messages
+			msgs := history
+			if prefill != "" {
+				msgs = append(slices.Clone(history), prefillMessage(prefill))
+			}
+
+			// keep tool calls and their results in the history
+			var toolMsgs []types.Message
+
+			turn, err := converseWithContinue(msgs, autoContinue, tools.send(cmd.Context(), budget.guardCalls(cmd.Context(), m, maxTokens, estimate, func(msgs []types.Message) (converseTurn, error) {
+				converseStreamInput.Messages = msgs
+
+				result, err := retries.converseStream(cmd.Context(), svc, converseStreamInput, newReasoningStreamHandler(&continueStreamHandler{w: os.Stdout}))
+				if err != nil {
+					return converseTurn{}, err
+				}
+
+				return converseTurn{
+					Message:                       result.Message,
+					StopReason:                    result.StopReason,
+					AdditionalModelResponseFields: result.AdditionalModelResponseFields,
+					Usage:                         result.Usage,
+					Guardrail:                     newGuardrailOutput(guardrailStreamTrace(result.Trace), result.StopReason),
+				}, nil
+			}), &toolMsgs))
 
 			if err != nil {
-				log.Fatal("streaming output processing error: ", err)
+				fmt.Println()
+				return err
 			}
 
-			converseStreamInput.Messages = append(converseStreamInput.Messages, assistantMsg)
+			converseStreamInput.Messages = append(append(history, toolMsgs...), turn.Message)
 
 			fmt.Println()
 
+			recordUsage("chat", m, turn.Usage, showUsage)
+
+			if err := printResponseFields(turn.AdditionalModelResponseFields); err != nil {
+				log.Printf("error: %v", err)
+			}
+
+			maxTokensNotice(turn.StopReason, maxTokens)
+			printGuardrail(os.Stderr, turn.Guardrail)
+
 		}
 	},
 }
@@ -145,20 +319,78 @@ func init() {
 	chatCmd.PersistentFlags().Float32("temperature", 1.0, "temperature setting")
 	chatCmd.PersistentFlags().Float32("topP", 0.999, "topP setting")
 	chatCmd.PersistentFlags().Int32("max-tokens", 500, "max tokens")
+	chatCmd.PersistentFlags().String("prefill", "", "start each of the assistant's responses with this text")
+	chatCmd.PersistentFlags().StringArray("stop", nil, "stop generating when this sequence is produced (can be repeated)")
+	chatCmd.PersistentFlags().StringArray("param", nil, "set a model-specific request field as key=value (can be repeated)")
+	chatCmd.PersistentFlags().String("params-file", "", "path to a JSON file of model-specific request fields")
+	chatCmd.PersistentFlags().StringArray("response-field", nil, "JSON pointer of a model-specific response field to return (can be repeated)")
+	chatCmd.PersistentFlags().Int32("thinking-budget", 0, "enable extended thinking with this many tokens")
+	chatCmd.PersistentFlags().Int("auto-continue", 0, "continue a response cut off by max tokens up to this many times")
+	chatCmd.PersistentFlags().String("tools", "", "path to a YAML file of local tools the model can call")
+	chatCmd.PersistentFlags().StringArray("mcp", nil, "start this MCP server from the config file and let the model call its tools (can be repeated)")
+	chatCmd.PersistentFlags().StringArray("mcp-resource", nil, "attach a resource from an MCP server, given as server:uri (can be repeated)")
+	chatCmd.PersistentFlags().Int("max-tool-iterations", 10, "stop if the model is still calling tools after this many rounds")
+	chatCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	chatCmd.PersistentFlags().Bool("dry-run", false, "print the request for the first turn without sending it")
+	chatCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr after each response")
 }
 
-func stringPrompt(label string) string {
+// printChatDryRun prints the request for the first turn of a chat
+func printChatDryRun(cmd *cobra.Command, m models.Model, input *bedrockruntime.ConverseStreamInput, prefill string) error {
+
+	region, err := getRegion(cmd)
+	if err != nil {
+		return err
+	}
+
+	msgs := input.Messages
+	if prefill != "" {
+		msgs = append(slices.Clone(msgs), prefillMessage(prefill))
+	}
+
+	out, err := newConverseStreamDryRun(region, m, &bedrockruntime.ConverseStreamInput{
+		ModelId:                           input.ModelId,
+		Messages:                          msgs,
+		InferenceConfig:                   input.InferenceConfig,
+		AdditionalModelRequestFields:      input.AdditionalModelRequestFields,
+		AdditionalModelResponseFieldPaths: input.AdditionalModelResponseFieldPaths,
+		ToolConfig:                        input.ToolConfig,
+		GuardrailConfig:                   input.GuardrailConfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	return printDryRun(os.Stdout, out)
+}
+
+// stringPrompt asks for a line of input. It returns io.EOF once stdin is
+// closed, or any other error reading it.
+func stringPrompt(ctx context.Context, label string) (string, error) {
 
 	var s string
-	r := bufio.NewReader(os.Stdin)
+	var err error
 
 	for {
 		fmt.Fprint(os.Stderr, label+" ")
-		s, _ = r.ReadString('\n')
+		s, err = readLine(ctx, stdinReader)
+		if ctx.Err() != nil {
+			return "", context.Cause(ctx)
+		}
+		if err != nil {
+			// a last line without a newline is read like any other
+			if s != "" {
+				return s + "\n", nil
+			}
+			if err == io.EOF {
+				fmt.Fprintln(os.Stderr)
+			}
+			return "", err
+		}
 		if s != "" {
 			break
 		}
 	}
 
-	return s
+	return s, nil
 }
@@ -0,0 +1,32 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStringPromptPipedLines(t *testing.T) {
+
+	defer func(r *bufio.Reader) { stdinReader = r }(stdinReader)
+	stdinReader = bufio.NewReader(strings.NewReader("first\nsecond\nlast"))
+
+	ctx := context.Background()
+
+	// every line is read, including one without a newline at the end
+	for _, want := range []string{"first\n", "second\n", "last\n"} {
+		got, err := stringPrompt(ctx, ">")
+		if err != nil || got != want {
+			t.Fatalf("stringPrompt = %q, %v, want %q", got, err, want)
+		}
+	}
+
+	if _, err := stringPrompt(ctx, ">"); err != io.EOF {
+		t.Errorf("stringPrompt at the end of input = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,354 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/go-micah/chat-cli/models"
+	"github.com/spf13/cobra"
+)
+
+// strategies for documents that don't fit the context window, set with
+// --chunking
+const (
+	chunkingMapReduce = "map-reduce"
+	chunkingRefine    = "refine"
+)
+
+// chunkOverhead leaves room in the context window for the instructions
+// wrapped around each chunk
+const chunkOverhead = 500
+
+// chunkPlan splits a document that is too big for the model into chunks
+// and works through them. The result is a prompt for the final call.
+type chunkPlan struct {
+	strategy    string
+	request     string
+	chunks      []string
+	concurrency int
+}
+
+// chunkFunc sends a single prompt and returns the text of the response
+type chunkFunc func(ctx context.Context, prompt string) (string, error)
+
+// getChunkPlan returns a plan for the document if --chunking is set and
+// the document with the request doesn't fit the model's context window.
+// It returns nil otherwise.
+func getChunkPlan(cmd *cobra.Command, m models.Model, document string, request string, maxTokens int32) (*chunkPlan, error) {
+
+	strategy, err := cmd.PersistentFlags().GetString("chunking")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	chunkTokens, err := cmd.PersistentFlags().GetInt("chunk-tokens")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	concurrency, err := cmd.PersistentFlags().GetInt("chunk-concurrency")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	switch strategy {
+	case "":
+		return nil, nil
+	case chunkingMapReduce, chunkingRefine:
+	default:
+		return nil, errorf(kindUsage, "invalid chunking %q. please use map-reduce or refine", strategy)
+	}
+
+	if concurrency < 1 {
+		return nil, errorf(kindUsage, "--chunk-concurrency must be at least 1")
+	}
+
+	if chunkTokens == 0 {
+		// each chunk goes with the request and the response, and with
+		// refine also the answer so far
+		chunkTokens = m.ContextWindow - int(maxTokens) - int(estimateTokens(request)) - chunkOverhead
+		if strategy == chunkingRefine {
+			chunkTokens -= int(maxTokens)
+		}
+		if chunkTokens < chunkOverhead {
+			return nil, errorf(kindUsage, "model %s doesn't leave room for chunks with --max-tokens %d. please use a smaller --max-tokens or set --chunk-tokens", m.ModelID, maxTokens)
+		}
+	}
+
+	if chunkTokens < 1 {
+		return nil, errorf(kindUsage, "--chunk-tokens must be at least 1")
+	}
+
+	if int(estimateTokens(document)) <= chunkTokens {
+		return nil, nil
+	}
+
+	// estimateTokens counts 4 bytes to a token
+	chunks := splitDocument(document, chunkTokens*4)
+	if len(chunks) < 2 {
+		return nil, nil
+	}
+
+	return &chunkPlan{
+		strategy:    strategy,
+		request:     request,
+		chunks:      chunks,
+		concurrency: concurrency,
+	}, nil
+}
+
+// splitDocument splits text into chunks of at most size bytes. Chunks end
+// on a blank line, a line break or a space where possible, in that order.
+func splitDocument(text string, size int) []string {
+
+	var chunks []string
+
+	for len(text) > size {
+		window := text[:size]
+
+		// only look for a boundary in the second half, so chunks don't get
+		// too small
+		cut := -1
+		for _, sep := range []string{"\n\n", "\n", " "} {
+			if i := strings.LastIndex(window, sep); i >= size/2 {
+				cut = i + len(sep)
+				break
+			}
+		}
+
+		if cut < 0 {
+			// don't split a multi-byte character
+			cut = size
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				cut = size
+			}
+		}
+
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+
+	if strings.TrimSpace(text) != "" {
+		chunks = append(chunks, text)
+	}
+
+	return chunks
+}
+
+// firstPrompt is the prompt of the first call of the plan
+func (p *chunkPlan) firstPrompt() string {
+	return chunkPrompt(p.chunks[0], 1, len(p.chunks), p.request)
+}
+
+// estimate returns the estimated cost of every call of the plan, including
+// the final one
+func (p *chunkPlan) estimate(m models.Model, maxTokens int32) float64 {
+
+	var cost float64
+	request := estimateTokens(p.request) + chunkOverhead
+
+	for _, c := range p.chunks {
+		input := estimateTokens(c) + request
+		if p.strategy == chunkingRefine {
+			input += maxTokens
+		}
+		cost += m.Cost(input, maxTokens)
+	}
+
+	// combining takes every partial answer
+	if p.strategy == chunkingMapReduce {
+		cost += m.Cost(int32(len(p.chunks))*maxTokens+request, maxTokens)
+	}
+
+	return cost
+}
+
+// run works through the chunks and returns the prompt for the final call,
+// which is left to the caller so it can be streamed. Progress is shown on
+// stderr.
+func (p *chunkPlan) run(ctx context.Context, send chunkFunc) (string, error) {
+
+	fmt.Fprintf(os.Stderr, "[document split into %d chunks, using %s]\n", len(p.chunks), p.strategy)
+
+	if p.strategy == chunkingRefine {
+		return p.refine(ctx, send)
+	}
+
+	return p.mapReduce(ctx, send)
+}
+
+// mapReduce answers the request for every chunk concurrently and returns a
+// prompt that combines the answers. If the answers are too long to combine
+// in one call, they are combined in groups first.
+func (p *chunkPlan) mapReduce(ctx context.Context, send chunkFunc) (string, error) {
+
+	prompts := make([]string, len(p.chunks))
+	for i, c := range p.chunks {
+		prompts[i] = chunkPrompt(c, i+1, len(p.chunks), p.request)
+	}
+
+	answers, err := p.sendAll(ctx, send, prompts, "chunk")
+	if err != nil {
+		return "", err
+	}
+
+	// the size a chunk could take is also the size the answers can take
+	size := len(p.chunks[0])
+
+	for {
+		groups := groupAnswers(answers, size)
+		if len(groups) == 1 {
+			return combinePrompt(answers, p.request), nil
+		}
+
+		fmt.Fprintf(os.Stderr, "[combining %d answers in %d groups]\n", len(answers), len(groups))
+
+		prompts := make([]string, len(groups))
+		for i, g := range groups {
+			prompts[i] = combinePrompt(g, p.request)
+		}
+
+		answers, err = p.sendAll(ctx, send, prompts, "group")
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// refine answers the request from the first chunk, then improves the
+// answer with each chunk in turn. The prompt for the last chunk is returned.
+func (p *chunkPlan) refine(ctx context.Context, send chunkFunc) (string, error) {
+
+	answer := ""
+	n := len(p.chunks)
+
+	for i, c := range p.chunks[:n-1] {
+		prompt := chunkPrompt(c, 1, n, p.request)
+		if i > 0 {
+			prompt = refinePrompt(answer, c, i+1, n, p.request)
+		}
+
+		var err error
+		answer, err = send(ctx, prompt)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(os.Stderr, "[chunk %d/%d done]\n", i+1, n)
+	}
+
+	return refinePrompt(answer, p.chunks[n-1], n, n, p.request), nil
+}
+
+// sendAll sends prompts concurrently and returns the answers in the same
+// order. The first error stops the rest.
+func (p *chunkPlan) sendAll(ctx context.Context, send chunkFunc, prompts []string, what string) ([]string, error) {
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	answers := make([]string, len(prompts))
+	jobs := make(chan int)
+
+	var mu sync.Mutex
+	done := 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < p.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				answer, err := send(ctx, prompts[i])
+				if err != nil {
+					cancel(err)
+					continue
+				}
+				answers[i] = answer
+
+				mu.Lock()
+				done++
+				fmt.Fprintf(os.Stderr, "[%s %d/%d done]\n", what, done, len(prompts))
+				mu.Unlock()
+			}
+		}()
+	}
+
+send:
+	for i := range prompts {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+
+	return answers, nil
+}
+
+// groupAnswers splits answers into groups of about size bytes, keeping
+// their order. Every group but the last has at least two answers, so each
+// round of combining makes progress.
+func groupAnswers(answers []string, size int) [][]string {
+
+	var groups [][]string
+	var group []string
+	n := 0
+
+	for _, a := range answers {
+		if len(group) > 1 && n+len(a) > size {
+			groups = append(groups, group)
+			group, n = nil, 0
+		}
+		group = append(group, a)
+		n += len(a)
+	}
+
+	return append(groups, group)
+}
+
+// chunkPrompt asks for an answer from a single chunk
+func chunkPrompt(chunk string, i int, n int, request string) string {
+	return "<document>\n\n" + chunk + "\n\n</document>\n\n" +
+		fmt.Sprintf("The document above is part %d of %d of a larger document. Answer the request below from this part only. The answers for every part will be combined afterwards.\n\n", i, n) +
+		request
+}
+
+// combinePrompt asks for the answers from several chunks to be combined
+// into one
+func combinePrompt(answers []string, request string) string {
+
+	var b strings.Builder
+	for i, a := range answers {
+		fmt.Fprintf(&b, "<answer part=\"%d\">\n\n%s\n\n</answer>\n\n", i+1, a)
+	}
+
+	b.WriteString("Each answer above was written for the same request from a different part of a larger document, in order. Combine them into a single answer to the request below, as if it had been written from the whole document.\n\n")
+	b.WriteString(request)
+
+	return b.String()
+}
+
+// refinePrompt asks for an answer to be improved with the next chunk
+func refinePrompt(answer string, chunk string, i int, n int, request string) string {
+	return "<answer>\n\n" + answer + "\n\n</answer>\n\n" +
+		"<document>\n\n" + chunk + "\n\n</document>\n\n" +
+		fmt.Sprintf("The answer above was written from parts 1 to %d of a larger document. The document above is part %d of %d. Refine the answer to the request below with anything this part adds, and reply with the full answer.\n\n", i-1, i, n) +
+		request
+}
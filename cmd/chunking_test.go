@@ -0,0 +1,111 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitDocument(t *testing.T) {
+
+	tests := []struct {
+		name string
+		text string
+		size int
+		want []string
+	}{
+		{"fits", "short text", 20, []string{"short text"}},
+		{"exactly the size", "0123456789", 10, []string{"0123456789"}},
+		{"at a blank line", "aaaa bbbb\ncc\n\ndddd", 16, []string{"aaaa bbbb\ncc\n\n", "dddd"}},
+		{"at a newline", "aaaa bbbb\ncccc dddd", 16, []string{"aaaa bbbb\n", "cccc dddd"}},
+		{"at a space", "aaaa bbbb cccc dddd", 16, []string{"aaaa bbbb cccc ", "dddd"}},
+		{"separator too early", "a\n\nbbbbbbbbbbbbbbbbbb", 10, []string{"a\n\nbbbbbbb", "bbbbbbbbbb", "b"}},
+		{"no separator", strings.Repeat("x", 25), 10, []string{"xxxxxxxxxx", "xxxxxxxxxx", "xxxxx"}},
+		{"whitespace left over", "aaaa bbbb\n\n  \n", 11, []string{"aaaa bbbb\n\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitDocument(tt.text, tt.size); !slices.Equal(got, tt.want) {
+				t.Errorf("splitDocument(%q, %d) = %q, want %q", tt.text, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitDocumentMultiByte(t *testing.T) {
+
+	// 3 and 4 byte characters and no separators, so every cut has to back
+	// up to the start of a character
+	text := strings.Repeat("€😀", 100)
+
+	for _, size := range []int{10, 11, 12, 13, 100} {
+		chunks := splitDocument(text, size)
+
+		for _, c := range chunks {
+			if !utf8.ValidString(c) {
+				t.Errorf("size %d: chunk %q was cut inside a character", size, c)
+			}
+			if len(c) > size {
+				t.Errorf("size %d: chunk is %d bytes", size, len(c))
+			}
+		}
+		if strings.Join(chunks, "") != text {
+			t.Errorf("size %d: the chunks don't add up to the text", size)
+		}
+	}
+}
+
+func TestGroupAnswers(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		answers []string
+		size    int
+		want    [][]string
+	}{
+		{"one answer", []string{"a"}, 10, [][]string{{"a"}}},
+		{"all fit", []string{"aa", "bb", "cc"}, 10, [][]string{{"aa", "bb", "cc"}}},
+		{"two groups", []string{"aaaa", "bbbb", "cccc", "dddd"}, 10, [][]string{{"aaaa", "bbbb"}, {"cccc", "dddd"}}},
+		{"every answer too large", []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"}, 3, [][]string{{"aaaa", "bbbb"}, {"cccc", "dddd"}, {"eeee"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := groupAnswers(tt.answers, tt.size)
+			if !slices.EqualFunc(got, tt.want, slices.Equal[[]string]) {
+				t.Errorf("groupAnswers(%q, %d) = %q, want %q", tt.answers, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupAnswersTerminates(t *testing.T) {
+
+	// combining a group of answers that are each larger than the size gives
+	// an answer just as large, as mapReduce could get back
+	answers := make([]string, 37)
+	for i := range answers {
+		answers[i] = strings.Repeat("x", 100)
+	}
+
+	for round := 0; ; round++ {
+		if round > 10 {
+			t.Fatalf("answers still in %d groups after %d rounds", len(answers), round)
+		}
+
+		groups := groupAnswers(answers, 50)
+		if len(groups) == 1 {
+			break
+		}
+		if len(groups) >= len(answers) {
+			t.Fatalf("%d answers were put in %d groups", len(answers), len(groups))
+		}
+
+		answers = answers[:len(groups)]
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/spf13/cobra"
+)
+
+// newBedrockClient sets up a connection to Amazon Bedrock in the region
+// set on the root command. Retries are handled by callPolicy, so the
+// SDK's own retries are turned off.
+func newBedrockClient(ctx context.Context, cmd *cobra.Command) (*bedrockruntime.Client, error) {
+
+	region, err := getRegion(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %w", err)
+	}
+
+	// resolve credentials now so missing or expired credentials are
+	// reported as such rather than as a failed call. they are cached for
+	// the calls that follow.
+	if cfg.Credentials == nil {
+		return nil, errorf(kindAuth, "no AWS credentials found")
+	}
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, withKind(kindAuth, fmt.Errorf("unable to load AWS credentials: %w", err))
+	}
+
+	return bedrockruntime.NewFromConfig(cfg, func(o *bedrockruntime.Options) {
+		o.Retryer = aws.NopRetryer{}
+		if tracing() {
+			o.APIOptions = append(o.APIOptions, addTraceMiddleware)
+		}
+	}), nil
+}
+
+// getRegion returns the region set on the root command
+func getRegion(cmd *cobra.Command) (string, error) {
+	region, err := cmd.Root().PersistentFlags().GetString("region")
+	if err != nil {
+		return "", fmt.Errorf("unable to get flag: %w", err)
+	}
+	return region, nil
+}
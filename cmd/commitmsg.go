@@ -0,0 +1,333 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/spf13/cobra"
+)
+
+// commitMsgSystemPrompt asks for a commit message in the conventional
+// commits style
+const commitMsgSystemPrompt = `Write a git commit message for the staged diff, following the Conventional Commits style:
+
+<type>(<optional scope>): <subject>
+
+<optional body>
+
+The type is one of feat, fix, docs, style, refactor, perf, test, build, ci or chore. Add ! after the type or scope for a breaking change. The subject is in the imperative mood, starts with a lower case letter, has no period at the end and keeps the first line under 72 characters. Add a body, wrapped at 72 characters, only when the reason for the change isn't obvious from the subject. If recent commit subjects are given, use the same scopes they do.
+
+Reply with the commit message only, without quotes or code fences.`
+
+// commitMsgHookMarker is written into the hook installed by --install-hook,
+// so it can be told apart from hooks written by hand
+const commitMsgHookMarker = "# installed by chat-cli commit-msg --install-hook"
+
+// commitMsgCmd represents the commit-msg command
+var commitMsgCmd = &cobra.Command{
+	Use:   "commit-msg [file [source [sha]]]",
+	Short: "Write a commit message for the staged changes",
+	Long: `Sends the staged diff of the git repository in the current directory to a
+LLM on Amazon Bedrock and prints a commit message in the Conventional Commits
+style, like so:
+
+> git commit -m "$(chat-cli commit-msg)"
+
+Use --install-hook to install it as a prepare-commit-msg hook, so git commit
+opens your editor with the message already written. As a hook it is given the
+file to write the message into, and leaves messages given with -m, merges and
+amends alone.`,
+	Args: cobra.MaximumNArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if err := checkGitRepo(cmd.Context()); err != nil {
+			return err
+		}
+
+		installHook, err := cmd.PersistentFlags().GetBool("install-hook")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if installHook {
+			return installCommitMsgHook(cmd)
+		}
+
+		// run as a prepare-commit-msg hook. git already has a message
+		// for every source but a plain commit.
+		if len(args) > 0 {
+			if len(args) > 1 && args[1] != "" {
+				return nil
+			}
+
+			// a failed hook stops the commit, so only warn
+			if err := writeCommitMsgFile(cmd, args[0]); err != nil {
+				log.Printf("unable to write a commit message: %v", err)
+			}
+			return nil
+		}
+
+		msg, err := commitMessage(cmd)
+		if err != nil || msg == "" {
+			return err
+		}
+
+		fmt.Println(msg)
+
+		return nil
+	},
+}
+
+// commitMessage returns a commit message for the staged diff. It returns
+// an empty message when the request is only printed by --dry-run.
+func commitMessage(cmd *cobra.Command) (string, error) {
+
+	diff, err := git(cmd.Context(), "diff", "--cached", "--no-color", "--no-ext-diff")
+	if err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(diff) == "" {
+		return "", errorf(kindUsage, "nothing is staged. use git add to stage your changes first")
+	}
+
+	modelId, err := cmd.PersistentFlags().GetString("model-id")
+	if err != nil {
+		return "", fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	// validate model is supported
+	m, err := models.GetModel(modelId)
+	if err != nil {
+		return "", err
+	}
+
+	if m.ModelType != "text" {
+		return "", errorf(kindUnsupportedModel, "model %s does not support text generation. please use a different model", m.ModelID)
+	}
+
+	maxTokens, err := cmd.PersistentFlags().GetInt32("max-tokens")
+	if err != nil {
+		return "", fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
+	if err != nil {
+		return "", fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	// apply the guardrail from the flags or the config file
+	guard, err := getGuardrail(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	// recent subjects show the scopes the repository uses. a repository
+	// without commits has none.
+	var prompt strings.Builder
+	if subjects, err := git(cmd.Context(), "log", "-n", "10", "--format=%s"); err == nil && subjects != "" {
+		prompt.WriteString("Recent commit subjects:\n\n" + subjects + "\n")
+	}
+	prompt.WriteString("<diff>\n\n" + truncateDiff(diff) + "\n</diff>")
+
+	converseInput := &bedrockruntime.ConverseInput{
+		ModelId: aws.String(m.ModelID),
+		System: []types.SystemContentBlock{
+			&types.SystemContentBlockMemberText{
+				Value: commitMsgSystemPrompt,
+			},
+		},
+		Messages: []types.Message{
+			{
+				Role: types.ConversationRoleUser,
+				Content: []types.ContentBlock{
+					&types.ContentBlockMemberText{
+						Value: prompt.String(),
+					},
+				},
+			},
+		},
+		InferenceConfig: &types.InferenceConfiguration{
+			MaxTokens: &maxTokens,
+		},
+		GuardrailConfig: guard.config(),
+	}
+
+	// print the request instead of sending it
+	dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+	if err != nil {
+		return "", fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	if dryRun {
+		region, err := getRegion(cmd)
+		if err != nil {
+			return "", err
+		}
+
+		out, err := newConverseDryRun("Converse", region, m, converseInput)
+		if err != nil {
+			return "", err
+		}
+
+		return "", printDryRun(os.Stdout, out)
+	}
+
+	force, err := cmd.PersistentFlags().GetBool("force")
+	if err != nil {
+		return "", fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	budget, err := newBudgetGuard(force)
+	if err != nil {
+		return "", err
+	}
+
+	if err := budget.confirm(cmd.Context(), m.Cost(estimateInputTokens(converseInput), maxTokens)); err != nil {
+		return "", err
+	}
+
+	// set up connection to AWS
+	svc, err := newBedrockClient(cmd.Context(), cmd)
+	if err != nil {
+		return "", err
+	}
+
+	retries, err := getCallPolicy(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := retries.converse(cmd.Context(), svc, converseInput)
+	if err != nil {
+		return "", fmt.Errorf("error from Bedrock, %w", err)
+	}
+
+	recordUsage("commit-msg", m, output.Usage, showUsage)
+
+	printGuardrail(os.Stderr, newGuardrailOutput(guardrailTrace(output.Trace), output.StopReason))
+	if err := stopReasonError(output.StopReason, maxTokens); err != nil {
+		return "", err
+	}
+
+	var msg string
+	if reponse, ok := output.Output.(*types.ConverseOutputMemberMessage); ok {
+		msg = messageText(reponse.Value)
+	}
+
+	return cleanCommitMessage(msg), nil
+}
+
+// cleanCommitMessage removes the code fence and surrounding space models
+// sometimes add to a commit message
+func cleanCommitMessage(msg string) string {
+
+	msg = strings.TrimSpace(msg)
+
+	if strings.HasPrefix(msg, "```") && strings.HasSuffix(msg, "```") {
+		msg = strings.TrimSuffix(msg, "```")
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[i+1:]
+		} else {
+			msg = ""
+		}
+	}
+
+	return strings.TrimSpace(msg)
+}
+
+// writeCommitMsgFile puts a commit message in front of what git has
+// already written to the message file, which is usually its comments
+func writeCommitMsgFile(cmd *cobra.Command, filename string) error {
+
+	existing, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// nothing staged is left for git to report
+	if _, err := git(cmd.Context(), "diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+
+	msg, err := commitMessage(cmd)
+	if err != nil || msg == "" {
+		return err
+	}
+
+	return os.WriteFile(filename, append([]byte(msg+"\n"), existing...), 0644)
+}
+
+// installCommitMsgHook writes a prepare-commit-msg hook that runs this
+// command. A hook that wasn't installed by it is left alone.
+func installCommitMsgHook(cmd *cobra.Command) error {
+
+	out, err := git(cmd.Context(), "rev-parse", "--git-path", "hooks/prepare-commit-msg")
+	if err != nil {
+		return err
+	}
+
+	hook, err := filepath.Abs(strings.TrimSpace(out))
+	if err != nil {
+		return err
+	}
+
+	existing, err := os.ReadFile(hook)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil && !strings.Contains(string(existing), commitMsgHookMarker) {
+		return errorf(kindUsage, "a prepare-commit-msg hook already exists at %s. remove it or call chat-cli commit-msg \"$@\" from it", hook)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find chat-cli: %w", err)
+	}
+
+	script := "#!/bin/sh\n" + commitMsgHookMarker + "\nexec " + shellQuote(exe) + " commit-msg \"$@\"\n"
+
+	if err := os.MkdirAll(filepath.Dir(hook), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(hook, []byte(script), 0755); err != nil {
+		return err
+	}
+
+	// WriteFile keeps the mode of a file that already exists
+	if err := os.Chmod(hook, 0755); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "installed prepare-commit-msg hook at %s\n", hook)
+
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func init() {
+	rootCmd.AddCommand(commitMsgCmd)
+	commitMsgCmd.PersistentFlags().StringP("model-id", "m", "anthropic.claude-3-haiku-20240307-v1:0", "set the model id")
+	commitMsgCmd.PersistentFlags().Int32("max-tokens", 500, "max tokens of the commit message")
+	commitMsgCmd.PersistentFlags().Bool("install-hook", false, "install as the prepare-commit-msg hook of the repository")
+	commitMsgCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	commitMsgCmd.PersistentFlags().Bool("dry-run", false, "print the request that would be sent to Bedrock without sending it")
+	commitMsgCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr")
+}
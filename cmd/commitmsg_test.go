@@ -0,0 +1,28 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import "testing"
+
+func TestCleanCommitMessage(t *testing.T) {
+
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"", ""},
+		{"Fix the parser", "Fix the parser"},
+		{"\n  Fix the parser\n\nIt was broken.\n\n", "Fix the parser\n\nIt was broken."},
+		{"```\nFix the parser\n```", "Fix the parser"},
+		{"```text\nFix the parser\n\nIt was broken.\n```\n", "Fix the parser\n\nIt was broken."},
+		{"Fix the parser\n\nUse ``` for code.", "Fix the parser\n\nUse ``` for code."},
+		{"```\nFix the parser", "```\nFix the parser"},
+	}
+
+	for _, tt := range tests {
+		if got := cleanCommitMessage(tt.msg); got != tt.want {
+			t.Errorf("cleanCommitMessage(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
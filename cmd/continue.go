@@ -0,0 +1,177 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+)
+
+// converseTurn is a single response from the model
+type converseTurn struct {
+	Message                       types.Message
+	StopReason                    types.StopReason
+	AdditionalModelResponseFields document.Interface
+	Usage                         *types.TokenUsage
+	Guardrail                     *guardrailOutput
+}
+
+// converseFunc sends a conversation to the model and returns its response
+type converseFunc func(msgs []types.Message) (converseTurn, error)
+
+// converseWithContinue sends a conversation and, while the response is cut
+// off by the max tokens limit, sends it again up to autoContinue more times
+// with the partial answer as an assistant prefix. The pieces are stitched
+// together into a single response. If the conversation ends with an
+// assistant message (a prefill), it is treated as the start of the answer.
+func converseWithContinue(msgs []types.Message, autoContinue int, send converseFunc) (converseTurn, error) {
+
+	base := msgs
+	prefill := ""
+	if n := len(msgs); n > 0 && msgs[n-1].Role == types.ConversationRoleAssistant {
+		base = msgs[:n-1]
+		prefill = messageText(msgs[n-1])
+	}
+
+	turn, err := send(msgs)
+	if prefill != "" {
+		turn.Message = withPrefill(turn.Message, prefill)
+	}
+	if err != nil {
+		return turn, err
+	}
+
+	for i := 0; i < autoContinue && turn.StopReason == types.StopReasonMaxTokens; i++ {
+
+		// the API rejects an assistant prefix that ends with whitespace.
+		// continueStreamHandler doesn't print it either, so the streamed
+		// text matches the stitched response.
+		partial := strings.TrimRightFunc(messageText(turn.Message), unicode.IsSpace)
+		if partial == "" {
+			break
+		}
+
+		next, err := send(append(slices.Clone(base), prefillMessage(partial)))
+		turn = stitchTurns(turn, partial, next)
+		if err != nil {
+			return turn, err
+		}
+	}
+
+	return turn, nil
+}
+
+// stitchTurns joins a partial response with its continuation
+func stitchTurns(first converseTurn, partial string, next converseTurn) converseTurn {
+
+	msg := types.Message{
+		Role: types.ConversationRoleAssistant,
+	}
+
+	for _, block := range first.Message.Content {
+		if _, ok := block.(*types.ContentBlockMemberText); !ok {
+			msg.Content = append(msg.Content, block)
+		}
+	}
+
+	msg.Content = append(msg.Content, &types.ContentBlockMemberText{
+		Value: partial + messageText(next.Message),
+	})
+
+	for _, block := range next.Message.Content {
+		if _, ok := block.(*types.ContentBlockMemberText); !ok {
+			msg.Content = append(msg.Content, block)
+		}
+	}
+
+	return converseTurn{
+		Message:                       msg,
+		StopReason:                    next.StopReason,
+		AdditionalModelResponseFields: next.AdditionalModelResponseFields,
+		Usage:                         addUsage(addUsage(nil, first.Usage), next.Usage),
+		Guardrail:                     addGuardrail(first.Guardrail, next.Guardrail),
+	}
+}
+
+// prefillMessage returns a partial assistant message for the model to
+// continue from
+func prefillMessage(text string) types.Message {
+	return types.Message{
+		Role: types.ConversationRoleAssistant,
+		Content: []types.ContentBlock{
+			&types.ContentBlockMemberText{
+				Value: text,
+			},
+		},
+	}
+}
+
+// withPrefill adds the prefill to the start of the text of a response, since
+// the model only returns what comes after it
+func withPrefill(msg types.Message, prefill string) types.Message {
+
+	content := slices.Clone(msg.Content)
+
+	for i, block := range content {
+		if v, ok := block.(*types.ContentBlockMemberText); ok {
+			content[i] = &types.ContentBlockMemberText{Value: prefill + v.Value}
+			msg.Content = content
+			return msg
+		}
+	}
+
+	msg.Content = append(content, &types.ContentBlockMemberText{Value: prefill})
+	return msg
+}
+
+// validateSteering checks that the model supports a prefill and stop
+// sequences if they are set
+func validateSteering(m models.Model, prefill string, stop []string) error {
+
+	if prefill != "" {
+		if !m.SupportsPrefill {
+			return errorf(kindUnsupportedModel, "model %s does not support --prefill. please use a different model", m.ModelID)
+		}
+		if strings.TrimRightFunc(prefill, unicode.IsSpace) != prefill {
+			return errorf(kindUsage, "--prefill can't end with whitespace")
+		}
+	}
+
+	if len(stop) > 0 && !m.SupportsStopSequences {
+		return errorf(kindUnsupportedModel, "model %s does not support --stop. please use a different model", m.ModelID)
+	}
+
+	return nil
+}
+
+// messageText returns the text blocks of a message joined together
+func messageText(msg types.Message) string {
+
+	var text strings.Builder
+
+	for _, block := range msg.Content {
+		if v, ok := block.(*types.ContentBlockMemberText); ok {
+			text.WriteString(v.Value)
+		}
+	}
+
+	return text.String()
+}
+
+// maxTokensNotice tells the user on stderr that a response was cut off
+func maxTokensNotice(stopReason types.StopReason, maxTokens int32) {
+
+	if stopReason != types.StopReasonMaxTokens {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "[response stopped at the max tokens limit of %d. use --max-tokens or --auto-continue to get the rest]\n", maxTokens)
+}
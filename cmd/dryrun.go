@@ -0,0 +1,393 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+)
+
+// minSummarizedBase64 is the length above which base64 strings in an
+// InvokeModel body are summarized instead of printed
+const minSummarizedBase64 = 256
+
+// dryRunOutput is written by --dry-run instead of calling Bedrock. The
+// request is in the JSON form Bedrock receives, with binary data left out.
+type dryRunOutput struct {
+	Line                 int         `json:"line,omitempty"`
+	Operation            string      `json:"operation"`
+	ModelID              string      `json:"model_id"`
+	Region               string      `json:"region"`
+	EstimatedInputTokens int32       `json:"estimated_input_tokens"`
+	EstimatedCost        float64     `json:"estimated_cost"`
+	Request              interface{} `json:"request"`
+}
+
+// newConverseDryRun describes a Converse or ConverseStream call. The
+// estimated cost assumes the response uses all of the max tokens.
+func newConverseDryRun(operation string, region string, m models.Model, input *bedrockruntime.ConverseInput) (dryRunOutput, error) {
+
+	tokens := estimateInputTokens(input)
+
+	var maxTokens int32
+	if input.InferenceConfig != nil {
+		maxTokens = aws.ToInt32(input.InferenceConfig.MaxTokens)
+	}
+
+	request, err := converseRequestJSON(input)
+	if err != nil {
+		return dryRunOutput{}, err
+	}
+
+	return dryRunOutput{
+		Operation:            operation,
+		ModelID:              m.ModelID,
+		Region:               region,
+		EstimatedInputTokens: tokens,
+		EstimatedCost:        m.Cost(tokens, maxTokens),
+		Request:              request,
+	}, nil
+}
+
+// newConverseStreamDryRun describes a ConverseStream call
+func newConverseStreamDryRun(region string, m models.Model, input *bedrockruntime.ConverseStreamInput) (dryRunOutput, error) {
+
+	out, err := newConverseDryRun("ConverseStream", region, m, converseInputOf(input))
+	if err != nil {
+		return out, err
+	}
+
+	out.Request, err = converseStreamRequestJSON(input)
+	if err != nil {
+		return dryRunOutput{}, err
+	}
+
+	return out, nil
+}
+
+// newInvokeModelDryRun describes an InvokeModel call made to generate
+// images or embeddings from a prompt
+func newInvokeModelDryRun(region string, m models.Model, prompt string, input *bedrockruntime.InvokeModelInput) (dryRunOutput, error) {
+
+	var body interface{}
+	if err := json.Unmarshal(input.Body, &body); err != nil {
+		return dryRunOutput{}, fmt.Errorf("unable to read request body: %w", err)
+	}
+
+	// image models are priced per image, embedding models per token
+	tokens := estimateTokens(prompt)
+	cost := m.ImagePrice
+	if m.ModelType != "image" {
+		cost = m.Cost(tokens, 0)
+	}
+
+	return dryRunOutput{
+		Operation:            "InvokeModel",
+		ModelID:              m.ModelID,
+		Region:               region,
+		EstimatedInputTokens: tokens,
+		EstimatedCost:        cost,
+		Request: map[string]interface{}{
+			"modelId":     aws.ToString(input.ModelId),
+			"contentType": aws.ToString(input.ContentType),
+			"accept":      aws.ToString(input.Accept),
+			"body":        summarizeBase64(body),
+		},
+	}, nil
+}
+
+// printDryRun writes a dry run as indented JSON
+func printDryRun(w io.Writer, out dryRunOutput) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// converseRequestJSON converts a ConverseInput to the JSON Bedrock receives
+func converseRequestJSON(input *bedrockruntime.ConverseInput) (map[string]interface{}, error) {
+
+	req := map[string]interface{}{
+		"modelId": aws.ToString(input.ModelId),
+	}
+
+	var messages []interface{}
+	for _, msg := range input.Messages {
+		var content []interface{}
+		for _, block := range msg.Content {
+			c, err := contentBlockJSON(block)
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, c)
+		}
+		messages = append(messages, map[string]interface{}{
+			"role":    msg.Role,
+			"content": content,
+		})
+	}
+	req["messages"] = messages
+
+	if len(input.System) > 0 {
+		var system []interface{}
+		for _, block := range input.System {
+			if v, ok := block.(*types.SystemContentBlockMemberText); ok {
+				system = append(system, map[string]interface{}{"text": v.Value})
+			}
+		}
+		req["system"] = system
+	}
+
+	if conf := input.InferenceConfig; conf != nil {
+		inference := map[string]interface{}{}
+		if conf.MaxTokens != nil {
+			inference["maxTokens"] = *conf.MaxTokens
+		}
+		if conf.Temperature != nil {
+			inference["temperature"] = *conf.Temperature
+		}
+		if conf.TopP != nil {
+			inference["topP"] = *conf.TopP
+		}
+		if len(conf.StopSequences) > 0 {
+			inference["stopSequences"] = conf.StopSequences
+		}
+		req["inferenceConfig"] = inference
+	}
+
+	if input.ToolConfig != nil {
+		tools, err := toolConfigJSON(input.ToolConfig)
+		if err != nil {
+			return nil, err
+		}
+		req["toolConfig"] = tools
+	}
+
+	if input.AdditionalModelRequestFields != nil {
+		fields, err := documentJSON(input.AdditionalModelRequestFields)
+		if err != nil {
+			return nil, err
+		}
+		req["additionalModelRequestFields"] = fields
+	}
+
+	if len(input.AdditionalModelResponseFieldPaths) > 0 {
+		req["additionalModelResponseFieldPaths"] = input.AdditionalModelResponseFieldPaths
+	}
+
+	if g := input.GuardrailConfig; g != nil {
+		req["guardrailConfig"] = map[string]interface{}{
+			"guardrailIdentifier": aws.ToString(g.GuardrailIdentifier),
+			"guardrailVersion":    aws.ToString(g.GuardrailVersion),
+			"trace":               g.Trace,
+		}
+	}
+
+	return req, nil
+}
+
+// converseStreamRequestJSON converts a ConverseStreamInput to the JSON
+// Bedrock receives
+func converseStreamRequestJSON(input *bedrockruntime.ConverseStreamInput) (map[string]interface{}, error) {
+
+	req, err := converseRequestJSON(converseInputOf(input))
+	if err != nil {
+		return nil, err
+	}
+
+	if g := input.GuardrailConfig; g != nil {
+		req["guardrailConfig"] = map[string]interface{}{
+			"guardrailIdentifier":  aws.ToString(g.GuardrailIdentifier),
+			"guardrailVersion":     aws.ToString(g.GuardrailVersion),
+			"streamProcessingMode": g.StreamProcessingMode,
+			"trace":                g.Trace,
+		}
+	}
+
+	return req, nil
+}
+
+// converseInputOf returns the parts of a ConverseStreamInput that it
+// shares with a ConverseInput
+func converseInputOf(input *bedrockruntime.ConverseStreamInput) *bedrockruntime.ConverseInput {
+	return &bedrockruntime.ConverseInput{
+		ModelId:                           input.ModelId,
+		Messages:                          input.Messages,
+		System:                            input.System,
+		InferenceConfig:                   input.InferenceConfig,
+		ToolConfig:                        input.ToolConfig,
+		AdditionalModelRequestFields:      input.AdditionalModelRequestFields,
+		AdditionalModelResponseFieldPaths: input.AdditionalModelResponseFieldPaths,
+	}
+}
+
+// contentBlockJSON converts a content block to JSON, summarizing binary
+// data by its size
+func contentBlockJSON(block types.ContentBlock) (interface{}, error) {
+
+	switch v := block.(type) {
+	case *types.ContentBlockMemberText:
+		return map[string]interface{}{"text": v.Value}, nil
+
+	case *types.ContentBlockMemberImage:
+		source := map[string]interface{}{}
+		if src, ok := v.Value.Source.(*types.ImageSourceMemberBytes); ok {
+			source["bytes"] = bytesSummary(len(src.Value))
+		}
+		return map[string]interface{}{
+			"image": map[string]interface{}{
+				"format": v.Value.Format,
+				"source": source,
+			},
+		}, nil
+
+	case *types.ContentBlockMemberToolUse:
+		input, err := documentJSON(v.Value.Input)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"toolUse": map[string]interface{}{
+				"toolUseId": aws.ToString(v.Value.ToolUseId),
+				"name":      aws.ToString(v.Value.Name),
+				"input":     input,
+			},
+		}, nil
+
+	case *types.ContentBlockMemberToolResult:
+		var content []interface{}
+		for _, c := range v.Value.Content {
+			switch r := c.(type) {
+			case *types.ToolResultContentBlockMemberText:
+				content = append(content, map[string]interface{}{"text": r.Value})
+			case *types.ToolResultContentBlockMemberJson:
+				j, err := documentJSON(r.Value)
+				if err != nil {
+					return nil, err
+				}
+				content = append(content, map[string]interface{}{"json": j})
+			}
+		}
+		result := map[string]interface{}{
+			"toolUseId": aws.ToString(v.Value.ToolUseId),
+			"content":   content,
+		}
+		if v.Value.Status != "" {
+			result["status"] = v.Value.Status
+		}
+		return map[string]interface{}{"toolResult": result}, nil
+
+	case *types.ContentBlockMemberReasoningContent:
+		switch r := v.Value.(type) {
+		case *types.ReasoningContentBlockMemberReasoningText:
+			return map[string]interface{}{
+				"reasoningContent": map[string]interface{}{
+					"reasoningText": map[string]interface{}{
+						"text":      aws.ToString(r.Value.Text),
+						"signature": aws.ToString(r.Value.Signature),
+					},
+				},
+			}, nil
+		case *types.ReasoningContentBlockMemberRedactedContent:
+			return map[string]interface{}{
+				"reasoningContent": map[string]interface{}{
+					"redactedContent": bytesSummary(len(r.Value)),
+				},
+			}, nil
+		}
+	}
+
+	return map[string]interface{}{"unknown": fmt.Sprintf("%T", block)}, nil
+}
+
+// toolConfigJSON converts a tool config to JSON
+func toolConfigJSON(conf *types.ToolConfiguration) (map[string]interface{}, error) {
+
+	var tools []interface{}
+	for _, tool := range conf.Tools {
+		spec, ok := tool.(*types.ToolMemberToolSpec)
+		if !ok {
+			continue
+		}
+
+		s := map[string]interface{}{
+			"name": aws.ToString(spec.Value.Name),
+		}
+		if spec.Value.Description != nil {
+			s["description"] = aws.ToString(spec.Value.Description)
+		}
+		if schema, ok := spec.Value.InputSchema.(*types.ToolInputSchemaMemberJson); ok {
+			j, err := documentJSON(schema.Value)
+			if err != nil {
+				return nil, err
+			}
+			s["inputSchema"] = map[string]interface{}{"json": j}
+		}
+
+		tools = append(tools, map[string]interface{}{"toolSpec": s})
+	}
+
+	out := map[string]interface{}{"tools": tools}
+
+	switch choice := conf.ToolChoice.(type) {
+	case *types.ToolChoiceMemberAuto:
+		out["toolChoice"] = map[string]interface{}{"auto": map[string]interface{}{}}
+	case *types.ToolChoiceMemberAny:
+		out["toolChoice"] = map[string]interface{}{"any": map[string]interface{}{}}
+	case *types.ToolChoiceMemberTool:
+		out["toolChoice"] = map[string]interface{}{
+			"tool": map[string]interface{}{"name": aws.ToString(choice.Value.Name)},
+		}
+	}
+
+	return out, nil
+}
+
+// documentJSON converts a document to raw JSON
+func documentJSON(doc document.Interface) (json.RawMessage, error) {
+	if doc == nil {
+		return json.RawMessage("null"), nil
+	}
+	b, err := doc.MarshalSmithyDocument()
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal document: %w", err)
+	}
+	return json.RawMessage(b), nil
+}
+
+// summarizeBase64 replaces long base64 strings in a decoded JSON value,
+// such as images in a request body, with their size
+func summarizeBase64(v interface{}) interface{} {
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = summarizeBase64(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = summarizeBase64(e)
+		}
+	case string:
+		if len(v) >= minSummarizedBase64 {
+			if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+				return bytesSummary(len(b))
+			}
+		}
+	}
+
+	return v
+}
+
+func bytesSummary(n int) string {
+	return fmt.Sprintf("<%d bytes>", n)
+}
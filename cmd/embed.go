@@ -0,0 +1,632 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+// outputNPY writes embeddings in NumPy's binary format
+const outputNPY = "npy"
+
+// defaultEmbedConcurrency is the number of embedding requests sent at once
+const defaultEmbedConcurrency = 4
+
+// cohereMaxTexts is the most texts Cohere Embed takes in one request
+const cohereMaxTexts = 96
+
+// cohereInputTypes are the values Cohere Embed takes for input_type
+var cohereInputTypes = []string{"search_document", "search_query", "classification", "clustering"}
+
+// embedRequest is a single line of an embed input file
+type embedRequest struct {
+	ID   string `json:"id,omitempty"`
+	Text string `json:"text"`
+}
+
+// embedding is a single vector written by the embed command
+type embedding struct {
+	Index     int       `json:"index"`
+	ID        string    `json:"id,omitempty"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// embedOutput is the full response written by --output json
+type embedOutput struct {
+	ModelID    string      `json:"model_id"`
+	Dimensions int         `json:"dimensions"`
+	Embeddings []embedding `json:"embeddings"`
+	Usage      struct {
+		InputTokens int32 `json:"input_tokens"`
+	} `json:"usage"`
+}
+
+// titanEmbedBody is the request body of Titan Embeddings. Only v2 takes
+// dimensions and normalize.
+type titanEmbedBody struct {
+	InputText  string `json:"inputText"`
+	Dimensions int    `json:"dimensions,omitempty"`
+	Normalize  *bool  `json:"normalize,omitempty"`
+}
+
+type titanEmbedResponse struct {
+	Embedding           []float32 `json:"embedding"`
+	InputTextTokenCount int32     `json:"inputTextTokenCount"`
+}
+
+// cohereEmbedBody is the request body of Cohere Embed
+type cohereEmbedBody struct {
+	Texts     []string `json:"texts"`
+	InputType string   `json:"input_type"`
+}
+
+type cohereEmbedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+// embedder turns texts into vectors with an embedding model
+type embedder struct {
+	svc         *bedrockruntime.Client
+	retries     callPolicy
+	model       models.Model
+	dimensions  int
+	normalize   bool
+	inputType   string
+	concurrency int
+}
+
+// embedCmd represents the embed command
+var embedCmd = &cobra.Command{
+	Use:   "embed",
+	Short: "Turn text into embedding vectors",
+	Long: `Sends text to one of the embedding models on Amazon Bedrock and prints the
+vectors, like so:
+
+> chat-cli embed "What is your name?"
+
+Text can also be piped in on stdin, or read from a JSONL file with --input
+where each line is a JSON object with a "text" and optionally an "id".`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		input, err := cmd.PersistentFlags().GetString("input")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if len(args) > 0 && input != "" {
+			return errorf(kindUsage, "text can't be given both as an argument and with --input")
+		}
+
+		outputFormat, err := cmd.PersistentFlags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if !slices.Contains([]string{outputJSON, outputNDJSON, outputNPY}, outputFormat) {
+			return errorf(kindUsage, "invalid output format %q. please use json, ndjson or npy", outputFormat)
+		}
+
+		filename, err := cmd.PersistentFlags().GetString("filename")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// get the texts to embed
+		var requests []embedRequest
+
+		switch {
+		case len(args) > 0:
+			requests = []embedRequest{{Text: args[0]}}
+		case input != "":
+			requests, err = readEmbedRequests(input)
+			if err != nil {
+				return fmt.Errorf("unable to read input file: %w", err)
+			}
+		case !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()):
+			stdin, err := readAll(cmd.Context(), os.Stdin)
+			if err != nil {
+				return fmt.Errorf("unable to read stdin: %w", err)
+			}
+			requests = []embedRequest{{Text: string(stdin)}}
+		}
+
+		if len(requests) == 0 || strings.TrimSpace(requests[0].Text) == "" {
+			return errorf(kindUsage, "please provide text as an argument, on stdin or with --input")
+		}
+
+		modelId, err := cmd.PersistentFlags().GetString("model-id")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// validate model is supported
+		m, err := models.GetModel(modelId)
+		if err != nil {
+			return err
+		}
+
+		dimensions, err := cmd.PersistentFlags().GetInt("dimensions")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		e, err := newEmbedder(cmd, m, dimensions)
+		if err != nil {
+			return err
+		}
+
+		e.normalize, err = cmd.PersistentFlags().GetBool("normalize")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		e.inputType, err = cmd.PersistentFlags().GetString("input-type")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if !slices.Contains(cohereInputTypes, e.inputType) {
+			return errorf(kindUsage, "invalid input type %q. please use %s", e.inputType, strings.Join(cohereInputTypes, ", "))
+		}
+
+		e.concurrency, err = cmd.PersistentFlags().GetInt("concurrency")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if e.concurrency < 1 {
+			return errorf(kindUsage, "concurrency must be at least 1")
+		}
+
+		texts := make([]string, len(requests))
+		for i, r := range requests {
+			texts[i] = r.Text
+		}
+
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// print the first request instead of sending it
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if dryRun {
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
+			}
+
+			batches := e.batches(texts)
+			body, err := e.body(batches[0])
+			if err != nil {
+				return err
+			}
+
+			out, err := newInvokeModelDryRun(region, m, strings.Join(batches[0], "\n"), e.input(body))
+			if err != nil {
+				return err
+			}
+
+			return printDryRun(os.Stdout, out)
+		}
+
+		// npy is binary, so don't write it to a terminal
+		if outputFormat == outputNPY && filename == "" && (isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd())) {
+			return errorf(kindUsage, "--output npy needs --filename or stdout redirected to a file")
+		}
+
+		// refuse calls that would go over budget
+		force, err := cmd.PersistentFlags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		budget, err := newBudgetGuard(force)
+		if err != nil {
+			return err
+		}
+
+		if err := budget.confirm(cmd.Context(), m.Cost(estimateTextTokens(texts), 0)); err != nil {
+			return err
+		}
+
+		// set up connection to AWS
+		e.svc, err = newBedrockClient(cmd.Context(), cmd)
+		if err != nil {
+			return err
+		}
+
+		vectors, tokens, err := e.embed(cmd.Context(), texts)
+		recordUsage("embed", m, &types.TokenUsage{
+			InputTokens:  aws.Int32(tokens),
+			OutputTokens: aws.Int32(0),
+			TotalTokens:  aws.Int32(tokens),
+		}, showUsage)
+		if err != nil {
+			return err
+		}
+
+		w := io.Writer(os.Stdout)
+		if filename != "" {
+			f, err := os.Create(filename)
+			if err != nil {
+				return fmt.Errorf("error writing to file: %w", err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		bw := bufio.NewWriter(w)
+
+		switch outputFormat {
+		case outputNPY:
+			err = writeNPY(bw, vectors)
+		case outputNDJSON:
+			enc := json.NewEncoder(bw)
+			for i, v := range vectors {
+				if err = enc.Encode(embedding{Index: i, ID: requests[i].ID, Embedding: v}); err != nil {
+					break
+				}
+			}
+		default:
+			out := embedOutput{
+				ModelID:    m.ModelID,
+				Dimensions: len(vectors[0]),
+			}
+			out.Usage.InputTokens = tokens
+			for i, v := range vectors {
+				out.Embeddings = append(out.Embeddings, embedding{Index: i, ID: requests[i].ID, Embedding: v})
+			}
+			err = json.NewEncoder(bw).Encode(out)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing output: %w", err)
+		}
+
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("error writing output: %w", err)
+		}
+
+		return nil
+	},
+}
+
+// newEmbedder checks that the model can return vectors of the given size,
+// zero meaning the model's default. The Bedrock client is left for the
+// caller to set up.
+func newEmbedder(cmd *cobra.Command, m models.Model, dimensions int) (*embedder, error) {
+
+	if m.ModelType != "embedding" {
+		return nil, errorf(kindUnsupportedModel, "model %s does not support embeddings. please use a different model", m.ModelID)
+	}
+
+	if dimensions == 0 {
+		dimensions = m.EmbeddingDimensions[0]
+	}
+
+	if !slices.Contains(m.EmbeddingDimensions, dimensions) {
+		return nil, errorf(kindUsage, "model %s does not support %d dimensions. supported dimensions: %s", m.ModelID, dimensions, strings.Trim(fmt.Sprint(m.EmbeddingDimensions), "[]"))
+	}
+
+	retries, err := getCallPolicy(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &embedder{
+		retries:     retries,
+		model:       m,
+		dimensions:  dimensions,
+		normalize:   true,
+		inputType:   "search_document",
+		concurrency: defaultEmbedConcurrency,
+	}, nil
+}
+
+// readEmbedRequests reads the texts in a JSONL file. Blank lines are
+// skipped.
+func readEmbedRequests(filename string) ([]embedRequest, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []embedRequest
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var r embedRequest
+		if err := json.Unmarshal([]byte(text), &r); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if strings.TrimSpace(r.Text) == "" {
+			return nil, fmt.Errorf("line %d: no text", line)
+		}
+
+		requests = append(requests, r)
+	}
+
+	return requests, scanner.Err()
+}
+
+// batches groups texts into as few requests as the model allows
+func (e *embedder) batches(texts []string) [][]string {
+
+	size := 1
+	if e.model.ModelFamily == "cohere-embed" {
+		size = cohereMaxTexts
+	}
+
+	var batches [][]string
+	for start := 0; start < len(texts); start += size {
+		batches = append(batches, texts[start:min(start+size, len(texts))])
+	}
+
+	return batches
+}
+
+// body returns the request body for a batch of texts
+func (e *embedder) body(texts []string) ([]byte, error) {
+
+	var body interface{}
+
+	switch e.model.ModelFamily {
+	case "titan-embed":
+		b := titanEmbedBody{InputText: texts[0]}
+		if e.titanV2() {
+			b.Dimensions = e.dimensions
+			b.Normalize = aws.Bool(e.normalize)
+		}
+		body = b
+	case "cohere-embed":
+		body = cohereEmbedBody{
+			Texts:     texts,
+			InputType: e.inputType,
+		}
+	default:
+		return nil, errorf(kindUnsupportedModel, "invalid model: %s", e.model.ModelID)
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal body: %w", err)
+	}
+
+	return b, nil
+}
+
+// titanV2 reports whether the model takes dimensions and normalize
+func (e *embedder) titanV2() bool {
+	return e.model.ModelFamily == "titan-embed" && e.model.ModelID != "amazon.titan-embed-text-v1"
+}
+
+func (e *embedder) input(body []byte) *bedrockruntime.InvokeModelInput {
+	return &bedrockruntime.InvokeModelInput{
+		Accept:      aws.String("application/json"),
+		ContentType: aws.String("application/json"),
+		ModelId:     aws.String(e.model.ModelID),
+		Body:        body,
+	}
+}
+
+// embed returns a vector for every text, in the same order, and the number
+// of input tokens used. Requests are sent concurrently and the first error
+// stops the rest.
+func (e *embedder) embed(ctx context.Context, texts []string) ([][]float32, int32, error) {
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	batches := e.batches(texts)
+	vectors := make([][]float32, 0, len(texts))
+	results := make([][][]float32, len(batches))
+
+	var mu sync.Mutex
+	var tokens int32
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for i := 0; i < e.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				v, n, err := e.send(ctx, batches[j])
+				if err != nil {
+					cancel(err)
+					continue
+				}
+				results[j] = v
+
+				mu.Lock()
+				tokens += n
+				mu.Unlock()
+			}
+		}()
+	}
+
+send:
+	for j := range batches {
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, tokens, context.Cause(ctx)
+	}
+
+	for _, v := range results {
+		vectors = append(vectors, v...)
+	}
+
+	return vectors, tokens, nil
+}
+
+// send embeds a single batch of texts
+func (e *embedder) send(ctx context.Context, texts []string) ([][]float32, int32, error) {
+
+	body, err := e.body(texts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := e.retries.invokeModel(ctx, e.svc, e.input(body))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error from Bedrock, %w", err)
+	}
+
+	var vectors [][]float32
+	var tokens int32
+
+	switch e.model.ModelFamily {
+	case "titan-embed":
+		var out titanEmbedResponse
+		if err := json.Unmarshal(resp.Body, &out); err != nil {
+			return nil, 0, fmt.Errorf("unable to unmarshal response from Bedrock: %w", err)
+		}
+		vectors = [][]float32{out.Embedding}
+		tokens = out.InputTextTokenCount
+	case "cohere-embed":
+		var out cohereEmbedResponse
+		if err := json.Unmarshal(resp.Body, &out); err != nil {
+			return nil, 0, fmt.Errorf("unable to unmarshal response from Bedrock: %w", err)
+		}
+		vectors = out.Embeddings
+
+		// Cohere doesn't return a token count, so estimate it
+		tokens = estimateTextTokens(texts)
+	}
+
+	if len(vectors) != len(texts) {
+		return nil, 0, fmt.Errorf("expected %d embeddings from Bedrock, got %d", len(texts), len(vectors))
+	}
+
+	// only Titan v2 can normalize its vectors itself
+	if e.normalize && !e.titanV2() {
+		for _, v := range vectors {
+			normalizeVector(v)
+		}
+	}
+
+	return vectors, tokens, nil
+}
+
+// estimateTextTokens gives a rough count of the tokens in a list of texts
+func estimateTextTokens(texts []string) int32 {
+	var tokens int32
+	for _, t := range texts {
+		tokens += estimateTokens(t)
+	}
+	return tokens
+}
+
+// normalizeVector scales a vector to unit length
+func normalizeVector(v []float32) {
+
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return
+	}
+
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+}
+
+// writeNPY writes vectors as a two dimensional array of little endian
+// float32 in NumPy's .npy format
+func writeNPY(w io.Writer, vectors [][]float32) error {
+
+	dims := 0
+	if len(vectors) > 0 {
+		dims = len(vectors[0])
+	}
+
+	header := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%d, %d), }", len(vectors), dims)
+
+	// the magic string, version and header length take 10 bytes, and the
+	// data has to start on a multiple of 64
+	pad := 64 - (10+len(header)+1)%64
+	header += strings.Repeat(" ", pad%64) + "\n"
+
+	if _, err := w.Write([]byte("\x93NUMPY\x01\x00")); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(header))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+
+	for _, v := range vectors {
+		if len(v) != dims {
+			return fmt.Errorf("embeddings have different dimensions")
+		}
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(embedCmd)
+	embedCmd.PersistentFlags().StringP("model-id", "m", "amazon.titan-embed-text-v2:0", "set the model id")
+	embedCmd.PersistentFlags().String("input", "", "path to a JSONL file of texts to embed")
+	embedCmd.PersistentFlags().StringP("output", "o", outputJSON, "output format: json, ndjson or npy")
+	embedCmd.PersistentFlags().StringP("filename", "f", "", "write the output to a file instead of stdout")
+	embedCmd.PersistentFlags().Int("dimensions", 0, "size of the vectors, if the model supports more than one (default is the model's)")
+	embedCmd.PersistentFlags().Bool("normalize", true, "scale vectors to unit length")
+	embedCmd.PersistentFlags().String("input-type", "search_document", "what the text is used for, for Cohere models: search_document, search_query, classification or clustering")
+	embedCmd.PersistentFlags().Int("concurrency", defaultEmbedConcurrency, "number of requests to send at once")
+	embedCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	embedCmd.PersistentFlags().Bool("dry-run", false, "print the first request that would be sent to Bedrock without sending it")
+	embedCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr")
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWriteNPY(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		vectors [][]float32
+		shape   string
+	}{
+		{"empty", nil, "(0, 0)"},
+		{"one vector", [][]float32{{1, 2, 3}}, "(1, 3)"},
+		{"several vectors", [][]float32{{1, 2}, {3, 4}, {5, 6}}, "(3, 2)"},
+		{"many vectors", make([][]float32, 12345), "(12345, 0)"},
+		{"long vector", [][]float32{make([]float32, 1024)}, "(1, 1024)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var buf bytes.Buffer
+			if err := writeNPY(&buf, tt.vectors); err != nil {
+				t.Fatalf("writeNPY: %v", err)
+			}
+			b := buf.Bytes()
+
+			if string(b[:8]) != "\x93NUMPY\x01\x00" {
+				t.Fatalf("magic = %q", b[:8])
+			}
+
+			headerLen := int(binary.LittleEndian.Uint16(b[8:10]))
+			header := string(b[10 : 10+headerLen])
+
+			// the data starts on a multiple of 64 bytes
+			if (10+headerLen)%64 != 0 {
+				t.Errorf("data starts at %d, not a multiple of 64", 10+headerLen)
+			}
+			if !strings.HasSuffix(header, "\n") {
+				t.Errorf("header %q doesn't end with a newline", header)
+			}
+			if !strings.Contains(header, "'shape': "+tt.shape) {
+				t.Errorf("header %q doesn't have shape %s", header, tt.shape)
+			}
+
+			data := b[10+headerLen:]
+			var want []float32
+			for _, v := range tt.vectors {
+				want = append(want, v...)
+			}
+			if len(data) != len(want)*4 {
+				t.Fatalf("data is %d bytes, want %d", len(data), len(want)*4)
+			}
+			for i, f := range want {
+				if got := math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:])); got != f {
+					t.Fatalf("value %d = %v, want %v", i, got, f)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteNPYPadding(t *testing.T) {
+
+	// the shape changes the length of the header, which has to be padded
+	// to the boundary whatever its length
+	for _, rows := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		for _, dims := range []int{0, 1, 10, 100, 1000} {
+			if rows*dims > 100000 {
+				continue
+			}
+
+			vectors := make([][]float32, rows)
+			for i := range vectors {
+				vectors[i] = make([]float32, dims)
+			}
+
+			var buf bytes.Buffer
+			if err := writeNPY(&buf, vectors); err != nil {
+				t.Fatal(err)
+			}
+			headerLen := int(binary.LittleEndian.Uint16(buf.Bytes()[8:10]))
+			if (10+headerLen)%64 != 0 {
+				t.Errorf("with shape (%d, %d) the data starts at %d", rows, dims, 10+headerLen)
+			}
+		}
+	}
+}
+
+func TestWriteNPYDifferentDimensions(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeNPY(&buf, [][]float32{{1, 2}, {3}}); err == nil {
+		t.Error("writeNPY succeeded with vectors of different dimensions")
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/aws/smithy-go"
+	"github.com/go-micah/chat-cli/models"
+)
+
+// errorKind groups errors that scripts may want to handle differently.
+// Each kind exits with its own code.
+type errorKind string
+
+const (
+	kindGeneral          errorKind = "error"
+	kindUsage            errorKind = "usage"
+	kindUnsupportedModel errorKind = "unsupported_model"
+	kindAuth             errorKind = "auth"
+	kindThrottled        errorKind = "throttled"
+	kindContentFiltered  errorKind = "content_filtered"
+	kindMaxTokens        errorKind = "max_tokens"
+	kindGuardrail        errorKind = "guardrail_intervened"
+	kindTimeout          errorKind = "timeout"
+	kindCanceled         errorKind = "canceled"
+)
+
+// exitCodes are part of the command line interface, so existing codes
+// must never change. timeout and canceled follow timeout(1) and the shell
+// convention for SIGINT.
+var exitCodes = map[errorKind]int{
+	kindGeneral:          1,
+	kindUsage:            2,
+	kindUnsupportedModel: 3,
+	kindAuth:             4,
+	kindThrottled:        5,
+	kindContentFiltered:  6,
+	kindMaxTokens:        7,
+	kindGuardrail:        8,
+	kindTimeout:          124,
+	kindCanceled:         130,
+}
+
+// authErrorCodes are the error codes AWS returns for missing, invalid or
+// expired credentials and for credentials without access to the model
+var authErrorCodes = map[string]bool{
+	"AccessDeniedException":       true,
+	"UnrecognizedClientException": true,
+	"InvalidSignatureException":   true,
+	"ExpiredTokenException":       true,
+	"InvalidClientTokenId":        true,
+	"MissingAuthenticationToken":  true,
+	"IncompleteSignature":         true,
+}
+
+// cliError is an error with the kind that decides its exit code
+type cliError struct {
+	kind errorKind
+	err  error
+}
+
+func (e *cliError) Error() string { return e.err.Error() }
+func (e *cliError) Unwrap() error { return e.err }
+
+// errorf formats an error of the given kind
+func errorf(kind errorKind, format string, a ...interface{}) error {
+	return &cliError{kind: kind, err: fmt.Errorf(format, a...)}
+}
+
+// withKind marks an existing error with a kind
+func withKind(kind errorKind, err error) error {
+	return &cliError{kind: kind, err: err}
+}
+
+// errorKindOf works out the kind of an error, either from the kind it was
+// marked with or from the errors returned by AWS
+func errorKindOf(err error) errorKind {
+
+	var cliErr *cliError
+	if errors.As(err, &cliErr) {
+		return cliErr.kind
+	}
+
+	var (
+		throttling   *types.ThrottlingException
+		quota        *types.ServiceQuotaExceededException
+		modelTimeout *types.ModelTimeoutException
+		notFound     *types.ResourceNotFoundException
+		signing      *v4.SigningError
+		apiErr       smithy.APIError
+	)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &modelTimeout):
+		return kindTimeout
+	case errors.Is(err, context.Canceled):
+		return kindCanceled
+	case errors.As(err, &throttling), errors.As(err, &quota):
+		return kindThrottled
+	case errors.As(err, &signing):
+		return kindAuth
+	case errors.Is(err, models.ErrUnsupportedModel), errors.As(err, &notFound):
+		return kindUnsupportedModel
+	case errors.As(err, &apiErr) && authErrorCodes[apiErr.ErrorCode()]:
+		return kindAuth
+	}
+
+	return kindGeneral
+}
+
+// requestIDOf returns the AWS request id of a failed call, if there is one
+func requestIDOf(err error) string {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.ServiceRequestID()
+	}
+	return ""
+}
+
+// stopReasonError returns an error if the model didn't finish its
+// response, so a script can tell a cut off or filtered response apart
+// from a complete one
+func stopReasonError(stopReason types.StopReason, maxTokens int32) error {
+
+	switch stopReason {
+	case types.StopReasonMaxTokens:
+		return errorf(kindMaxTokens, "response stopped at the max tokens limit of %d. use --max-tokens or --auto-continue to get the rest", maxTokens)
+	case types.StopReasonContentFiltered:
+		return errorf(kindContentFiltered, "response was blocked by a content filter")
+	case types.StopReasonGuardrailIntervened:
+		return errorf(kindGuardrail, "content was blocked by a guardrail")
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// maxDiffSize is the most of a diff sent to the model. Larger diffs are cut
+// short, with a note saying so.
+const maxDiffSize = 200_000
+
+// git runs git with args in the current directory and returns its output.
+// Errors include what git printed to stderr.
+func git(ctx context.Context, args ...string) (string, error) {
+
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, "git", args...)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	if err := c.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", errors.New("git is not installed or not on the PATH")
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+
+	return stdout.String(), nil
+}
+
+// checkGitRepo returns a usage error if the current directory isn't in a
+// git work tree
+func checkGitRepo(ctx context.Context) error {
+	if _, err := git(ctx, "rev-parse", "--is-inside-work-tree"); err != nil {
+		return withKind(kindUsage, err)
+	}
+	return nil
+}
+
+// truncateDiff cuts a diff down to maxDiffSize at a line break
+func truncateDiff(diff string) string {
+
+	if len(diff) <= maxDiffSize {
+		return diff
+	}
+
+	cut := strings.LastIndexByte(diff[:maxDiffSize], '\n') + 1
+	return diff[:cut] + fmt.Sprintf("\n[diff truncated, %d of %d bytes shown]\n", cut, len(diff))
+}
@@ -0,0 +1,335 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/settings"
+	"github.com/spf13/cobra"
+)
+
+// guardrail is the Bedrock guardrail applied to Converse and
+// ConverseStream requests. Its trace is always enabled so interventions
+// can be reported.
+type guardrail struct {
+	id         string
+	version    string
+	streamMode types.GuardrailStreamProcessingMode
+}
+
+// guardrailOutput describes what a guardrail found in a request and its
+// response
+type guardrailOutput struct {
+	Intervened   bool               `json:"intervened,omitempty"`
+	ActionReason string             `json:"action_reason,omitempty"`
+	Findings     []guardrailFinding `json:"findings,omitempty"`
+}
+
+// guardrailFinding is a single policy that matched. Matched text is only
+// included for word policies, since sensitive information must not be
+// repeated in the output.
+type guardrailFinding struct {
+	Source     string `json:"source"`
+	Policy     string `json:"policy"`
+	Type       string `json:"type,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Match      string `json:"match,omitempty"`
+	Action     string `json:"action"`
+	Confidence string `json:"confidence,omitempty"`
+}
+
+// getGuardrail reads the guardrail from the config file, overridden by any
+// guardrail flags set on the command line. It returns nil if no guardrail
+// is set.
+func getGuardrail(cmd *cobra.Command) (*guardrail, error) {
+
+	flags := cmd.Root().PersistentFlags()
+
+	s, err := settings.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := flags.GetString("guardrail-id")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+	if !flags.Changed("guardrail-id") {
+		id = s.Guardrail.ID
+	}
+
+	version, err := flags.GetString("guardrail-version")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+	if !flags.Changed("guardrail-version") {
+		version = s.Guardrail.Version
+	}
+
+	streamMode, err := flags.GetString("guardrail-stream-mode")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+	if !flags.Changed("guardrail-stream-mode") {
+		streamMode = s.Guardrail.StreamProcessingMode
+	}
+
+	if id == "" {
+		if flags.Changed("guardrail-version") || flags.Changed("guardrail-stream-mode") {
+			return nil, errorf(kindUsage, "--guardrail-version and --guardrail-stream-mode need a guardrail id")
+		}
+		return nil, nil
+	}
+
+	if version == "" {
+		return nil, errorf(kindUsage, "guardrail %s needs a version. please use --guardrail-version", id)
+	}
+
+	mode := types.GuardrailStreamProcessingMode(streamMode)
+	switch mode {
+	case "":
+		mode = types.GuardrailStreamProcessingModeSync
+	case types.GuardrailStreamProcessingModeSync, types.GuardrailStreamProcessingModeAsync:
+	default:
+		return nil, errorf(kindUsage, "invalid guardrail stream mode: %s. please use sync or async", streamMode)
+	}
+
+	return &guardrail{
+		id:         id,
+		version:    version,
+		streamMode: mode,
+	}, nil
+}
+
+// config returns the guardrail config for a Converse request, or nil if
+// there is no guardrail
+func (g *guardrail) config() *types.GuardrailConfiguration {
+	if g == nil {
+		return nil
+	}
+	return &types.GuardrailConfiguration{
+		GuardrailIdentifier: aws.String(g.id),
+		GuardrailVersion:    aws.String(g.version),
+		Trace:               types.GuardrailTraceEnabled,
+	}
+}
+
+// streamConfig returns the guardrail config for a ConverseStream request,
+// or nil if there is no guardrail
+func (g *guardrail) streamConfig() *types.GuardrailStreamConfiguration {
+	if g == nil {
+		return nil
+	}
+	return &types.GuardrailStreamConfiguration{
+		GuardrailIdentifier:  aws.String(g.id),
+		GuardrailVersion:     aws.String(g.version),
+		StreamProcessingMode: g.streamMode,
+		Trace:                types.GuardrailTraceEnabled,
+	}
+}
+
+// newGuardrailOutput summarizes a guardrail trace. It returns nil if no
+// guardrail was applied.
+func newGuardrailOutput(trace *types.GuardrailTraceAssessment, stopReason types.StopReason) *guardrailOutput {
+
+	intervened := stopReason == types.StopReasonGuardrailIntervened
+	if trace == nil && !intervened {
+		return nil
+	}
+
+	out := &guardrailOutput{
+		Intervened: intervened,
+	}
+
+	if trace == nil {
+		return out
+	}
+
+	out.ActionReason = aws.ToString(trace.ActionReason)
+
+	// assessments are keyed by guardrail id, so sort them for stable output
+	for _, id := range sortedKeys(trace.InputAssessment) {
+		out.Findings = append(out.Findings, guardrailFindings("input", trace.InputAssessment[id])...)
+	}
+	for _, id := range sortedKeys(trace.OutputAssessments) {
+		for _, assessment := range trace.OutputAssessments[id] {
+			out.Findings = append(out.Findings, guardrailFindings("output", assessment)...)
+		}
+	}
+
+	return out
+}
+
+// guardrailFindings lists the policies of an assessment that matched
+// something, including ones that only detect without taking action
+func guardrailFindings(source string, a types.GuardrailAssessment) []guardrailFinding {
+
+	var findings []guardrailFinding
+	add := func(f guardrailFinding, detected *bool) {
+		if f.Action != "NONE" || aws.ToBool(detected) {
+			f.Source = source
+			findings = append(findings, f)
+		}
+	}
+
+	if a.ContentPolicy != nil {
+		for _, f := range a.ContentPolicy.Filters {
+			add(guardrailFinding{
+				Policy:     "content",
+				Type:       string(f.Type),
+				Action:     string(f.Action),
+				Confidence: string(f.Confidence),
+			}, f.Detected)
+		}
+	}
+
+	if a.TopicPolicy != nil {
+		for _, t := range a.TopicPolicy.Topics {
+			add(guardrailFinding{
+				Policy: "topic",
+				Name:   aws.ToString(t.Name),
+				Action: string(t.Action),
+			}, t.Detected)
+		}
+	}
+
+	if a.WordPolicy != nil {
+		for _, w := range a.WordPolicy.CustomWords {
+			add(guardrailFinding{
+				Policy: "word",
+				Match:  aws.ToString(w.Match),
+				Action: string(w.Action),
+			}, w.Detected)
+		}
+		for _, w := range a.WordPolicy.ManagedWordLists {
+			add(guardrailFinding{
+				Policy: "word",
+				Type:   string(w.Type),
+				Match:  aws.ToString(w.Match),
+				Action: string(w.Action),
+			}, w.Detected)
+		}
+	}
+
+	if a.SensitiveInformationPolicy != nil {
+		for _, e := range a.SensitiveInformationPolicy.PiiEntities {
+			add(guardrailFinding{
+				Policy: "sensitive_information",
+				Type:   string(e.Type),
+				Action: string(e.Action),
+			}, e.Detected)
+		}
+		for _, r := range a.SensitiveInformationPolicy.Regexes {
+			add(guardrailFinding{
+				Policy: "sensitive_information",
+				Name:   aws.ToString(r.Name),
+				Action: string(r.Action),
+			}, r.Detected)
+		}
+	}
+
+	if a.ContextualGroundingPolicy != nil {
+		for _, f := range a.ContextualGroundingPolicy.Filters {
+			add(guardrailFinding{
+				Policy: "contextual_grounding",
+				Type:   string(f.Type),
+				Action: string(f.Action),
+			}, f.Detected)
+		}
+	}
+
+	return findings
+}
+
+// guardrailTrace returns the guardrail part of the trace of a Converse
+// response
+func guardrailTrace(trace *types.ConverseTrace) *types.GuardrailTraceAssessment {
+	if trace == nil {
+		return nil
+	}
+	return trace.Guardrail
+}
+
+// guardrailStreamTrace returns the guardrail part of the trace of a
+// ConverseStream response
+func guardrailStreamTrace(trace *types.ConverseStreamTrace) *types.GuardrailTraceAssessment {
+	if trace == nil {
+		return nil
+	}
+	return trace.Guardrail
+}
+
+// addGuardrail combines what a guardrail found in a response and its
+// continuation
+func addGuardrail(a *guardrailOutput, b *guardrailOutput) *guardrailOutput {
+
+	if b == nil {
+		return a
+	}
+	if a == nil {
+		return b
+	}
+
+	return &guardrailOutput{
+		Intervened:   a.Intervened || b.Intervened,
+		ActionReason: cmp.Or(b.ActionReason, a.ActionReason),
+		Findings:     append(slices.Clone(a.Findings), b.Findings...),
+	}
+}
+
+// printGuardrail tells the user on stderr what a guardrail did. Nothing is
+// printed if the guardrail didn't find anything.
+func printGuardrail(w io.Writer, out *guardrailOutput) {
+
+	if out == nil || (!out.Intervened && len(out.Findings) == 0) {
+		return
+	}
+
+	if out.Intervened {
+		reason := out.ActionReason
+		if reason == "" {
+			reason = "content was blocked"
+		}
+		fmt.Fprintf(w, "[guardrail intervened: %s]\n", reason)
+	}
+
+	for _, f := range out.Findings {
+		var what []string
+		for _, s := range []string{f.Type, f.Name} {
+			if s != "" {
+				what = append(what, s)
+			}
+		}
+		if f.Match != "" {
+			what = append(what, fmt.Sprintf("%q", f.Match))
+		}
+
+		line := fmt.Sprintf("[guardrail %s: %s policy", f.Source, strings.ReplaceAll(f.Policy, "_", " "))
+		if len(what) > 0 {
+			line += " " + strings.Join(what, " ")
+		}
+		line += " " + f.Action
+		if f.Confidence != "" {
+			line += " (confidence " + f.Confidence + ")"
+		}
+
+		fmt.Fprintln(w, line+"]")
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -4,16 +4,13 @@ Copyright © 2024 Micah Walter
 package cmd
 
 import (
-	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	"github.com/go-micah/chat-cli/models"
 	"github.com/go-micah/go-bedrock/providers"
@@ -28,7 +25,7 @@ var imageCmd = &cobra.Command{
 	Long:  `Send a prompt to one of the models on Amazon Bedrock that supports image generation and save the reuslt to disk.`,
 
 	Args: cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 
 		prompt := args[0]
 
@@ -38,10 +35,9 @@ var imageCmd = &cobra.Command{
 		if isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd()) {
 			// do nothing
 		} else {
-			stdin, err := io.ReadAll(os.Stdin)
-
+			stdin, err := readAll(cmd.Context(), os.Stdin)
 			if err != nil {
-				panic(err)
+				return fmt.Errorf("unable to read stdin: %w", err)
 			}
 			document = string(stdin)
 		}
@@ -59,103 +55,151 @@ var imageCmd = &cobra.Command{
 
 		modelId, err := cmd.PersistentFlags().GetString("model-id")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		// validate model is supported
 		m, err := models.GetModel(modelId)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			return err
 		}
 
 		// validate model supports image generation
 		if m.ModelType != "image" {
-			log.Fatalf("model %s does not support image generation. please use a different model", m.ModelID)
+			return errorf(kindUnsupportedModel, "model %s does not support image generation. please use a different model", m.ModelID)
 		}
 
 		// get options
 		scale, err := cmd.PersistentFlags().GetFloat64("scale")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		steps, err := cmd.PersistentFlags().GetInt("steps")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		seed, err := cmd.PersistentFlags().GetInt("seed")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		filename, err := cmd.PersistentFlags().GetString("filename")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// an existing image to change, if any
+		edit, err := getImageEdit(cmd, m)
+		if err != nil {
+			return err
 		}
 
 		// serialize body
 		switch m.ModelFamily {
 		case "stability":
-			body := providers.StabilityAIStableDiffusionInvokeModelInput{
-				Prompt: []providers.StabilityAIStableDiffusionTextPrompt{
-					{
-						Text: prompt,
+			body := stabilityImageBody{
+				StabilityAIStableDiffusionInvokeModelInput: providers.StabilityAIStableDiffusionInvokeModelInput{
+					Prompt: []providers.StabilityAIStableDiffusionTextPrompt{
+						{
+							Text: prompt,
+						},
 					},
+					Scale: scale,
+					Steps: steps,
+					Seed:  seed,
 				},
-				Scale: scale,
-				Steps: steps,
-				Seed:  seed,
 			}
+			edit.stabilityBody(&body)
 
 			bodyString, err = json.Marshal(body)
 			if err != nil {
-				log.Fatalf("unable to marshal body: %v", err)
+				return fmt.Errorf("unable to marshal body: %w", err)
 			}
 		case "titan-image":
-			body := providers.AmazonTitanImageInvokeModelInput{
-				TaskType: "TEXT_IMAGE",
-				TextToImageParams: providers.AmazonTitanImageInvokeModelInputTextToImageParams{
-					Text: prompt,
-				},
+			body := titanImageBody{
 				ImageGenerationConfig: providers.AmazonTitanImageInvokeModelInputImageGenerationConfig{
 					NumberOfImages: 1,
 					Scale:          scale,
 					Seed:           seed,
 				},
 			}
+			edit.titanBody(&body, prompt)
 
 			bodyString, err = json.Marshal(body)
 			if err != nil {
-				log.Fatalf("unable to marshal body: %v", err)
+				return fmt.Errorf("unable to marshal body: %w", err)
 			}
 		default:
-			log.Fatalf("invalid model: %s", m.ModelID)
+			return errorf(kindUnsupportedModel, "invalid model: %s", m.ModelID)
 		}
 
-		// set up connection to AWS
-		region, err := cmd.Parent().PersistentFlags().GetString("region")
+		input := &bedrockruntime.InvokeModelInput{
+			Accept:      &accept,
+			ModelId:     &m.ModelID,
+			ContentType: &contentType,
+			Body:        bodyString,
+		}
+
+		// print the request instead of sending it
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if dryRun {
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
+			}
+
+			out, err := newInvokeModelDryRun(region, m, prompt, input)
+			if err != nil {
+				return err
+			}
+
+			return printDryRun(os.Stdout, out)
+		}
+
+		// refuse calls that would go over budget
+		force, err := cmd.PersistentFlags().GetBool("force")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
-		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+		budget, err := newBudgetGuard(force)
 		if err != nil {
-			log.Fatalf("unable to load AWS config: %v", err)
+			return err
 		}
 
-		svc := bedrockruntime.NewFromConfig(cfg)
+		if err := budget.confirm(cmd.Context(), m.ImagePrice); err != nil {
+			return err
+		}
 
-		resp, err := svc.InvokeModel(context.TODO(), &bedrockruntime.InvokeModelInput{
-			Accept:      &accept,
-			ModelId:     &m.ModelID,
-			ContentType: &contentType,
-			Body:        bodyString,
-		})
+		// set up connection to AWS
+		svc, err := newBedrockClient(cmd.Context(), cmd)
+		if err != nil {
+			return err
+		}
+
+		retries, err := getCallPolicy(cmd)
+		if err != nil {
+			return err
+		}
+
+		resp, err := retries.invokeModel(cmd.Context(), svc, input)
 		if err != nil {
-			log.Fatalf("error from Bedrock, %v", err)
+			return fmt.Errorf("error from Bedrock, %w", err)
 		}
 
+		recordImageUsage("image", m, 1, showUsage)
+
 		// save images to disk
 		switch m.ModelFamily {
 		case "stability":
@@ -163,12 +207,20 @@ var imageCmd = &cobra.Command{
 
 			err = json.Unmarshal(resp.Body, &out)
 			if err != nil {
-				log.Fatalf("unable to unmarshal response from Bedrock: %v", err)
+				return fmt.Errorf("unable to unmarshal response from Bedrock: %w", err)
+			}
+
+			if len(out.Artifacts) == 0 {
+				return fmt.Errorf("no image returned from Bedrock")
+			}
+
+			if out.Artifacts[0].FinishReason == "CONTENT_FILTERED" {
+				return errorf(kindContentFiltered, "image was blocked by a content filter")
 			}
 
 			decoded, err := decodeImage(out.Artifacts[0].Base64)
 			if err != nil {
-				log.Fatalf("unable to decode image: %v", err)
+				return fmt.Errorf("unable to decode image: %w", err)
 			}
 
 			outputFile := fmt.Sprintf("%s-%d.jpg", m.ModelFamily, time.Now().Unix())
@@ -180,7 +232,7 @@ var imageCmd = &cobra.Command{
 
 			err = os.WriteFile(outputFile, decoded, 0644)
 			if err != nil {
-				log.Fatalf("error writing to file: %v", err)
+				return fmt.Errorf("error writing to file: %w", err)
 			}
 
 			log.Println("image written to file", outputFile)
@@ -189,12 +241,20 @@ var imageCmd = &cobra.Command{
 
 			err = json.Unmarshal(resp.Body, &out)
 			if err != nil {
-				log.Fatalf("unable to unmarshal response from Bedrock: %v", err)
+				return fmt.Errorf("unable to unmarshal response from Bedrock: %w", err)
+			}
+
+			if out.Error != "" {
+				return fmt.Errorf("error from Bedrock, %s", out.Error)
+			}
+
+			if len(out.Images) == 0 {
+				return fmt.Errorf("no image returned from Bedrock")
 			}
 
 			decoded, err := decodeImage(out.Images[0])
 			if err != nil {
-				log.Fatalf("unable to decode image: %v", err)
+				return fmt.Errorf("unable to decode image: %w", err)
 			}
 
 			outputFile := fmt.Sprintf("%s-%d.jpg", m.ModelFamily, time.Now().Unix())
@@ -206,11 +266,13 @@ var imageCmd = &cobra.Command{
 
 			err = os.WriteFile(outputFile, decoded, 0644)
 			if err != nil {
-				log.Fatalf("error writing to file: %v", err)
+				return fmt.Errorf("error writing to file: %w", err)
 			}
 
 			log.Println("image written to file", outputFile)
 		}
+
+		return nil
 	},
 }
 
@@ -230,6 +292,14 @@ func init() {
 	// imageCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	imageCmd.PersistentFlags().StringP("model-id", "m", "stability.stable-diffusion-xl-v1", "set the model id")
 	imageCmd.PersistentFlags().StringP("filename", "f", "", "provide an output filename")
+	imageCmd.PersistentFlags().String("init-image", "", "path to an image to change instead of starting from nothing")
+	imageCmd.PersistentFlags().String("mask-image", "", "path to a mask of the init image, black where it should be painted in (or kept, with outpaint)")
+	imageCmd.PersistentFlags().String("mask-prompt", "", "describe the part of the init image to change, instead of a mask image")
+	imageCmd.PersistentFlags().String("mode", "", "how to change the init image: inpaint, outpaint or variation (default is inpaint with a mask, otherwise variation)")
+	imageCmd.PersistentFlags().Float64("image-strength", 0.35, "how much of the init image to keep, from 0 to 1 (stability only)")
+	imageCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	imageCmd.PersistentFlags().Bool("dry-run", false, "print the request that would be sent to Bedrock without sending it")
+	imageCmd.PersistentFlags().Bool("show-usage", false, "print estimated cost to stderr")
 
 }
 
@@ -0,0 +1,249 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+
+	"github.com/go-micah/chat-cli/models"
+	"github.com/go-micah/go-bedrock/providers"
+	"github.com/spf13/cobra"
+)
+
+// ways of changing an existing image, set with --mode
+const (
+	imageModeInpaint   = "inpaint"
+	imageModeOutpaint  = "outpaint"
+	imageModeVariation = "variation"
+)
+
+// imageEdit is an existing image to change instead of generating one from
+// the prompt alone. Black pixels in the mask mark the area to paint in, or
+// with outpainting the area to keep.
+type imageEdit struct {
+	mode       string
+	image      string // base64
+	mask       string // base64
+	maskPrompt string
+	strength   float64
+}
+
+// stabilityImageBody is a SDXL request, with the fields for image to image
+// and masking next to the text to image ones
+type stabilityImageBody struct {
+	providers.StabilityAIStableDiffusionInvokeModelInput
+
+	InitImage     string   `json:"init_image,omitempty"`
+	InitImageMode string   `json:"init_image_mode,omitempty"`
+	ImageStrength *float64 `json:"image_strength,omitempty"` // 0 is a valid strength
+	MaskSource    string   `json:"mask_source,omitempty"`
+	MaskImage     string   `json:"mask_image,omitempty"`
+}
+
+// titanImageBody is a Titan Image Generator request. Only the params of
+// its task type are set.
+type titanImageBody struct {
+	TaskType              string                                                          `json:"taskType"`
+	TextToImageParams     *providers.AmazonTitanImageInvokeModelInputTextToImageParams    `json:"textToImageParams,omitempty"`
+	InPaintingParams      *titanPaintingParams                                            `json:"inPaintingParams,omitempty"`
+	OutPaintingParams     *titanPaintingParams                                            `json:"outPaintingParams,omitempty"`
+	ImageVariationParams  *titanImageVariationParams                                      `json:"imageVariationParams,omitempty"`
+	ImageGenerationConfig providers.AmazonTitanImageInvokeModelInputImageGenerationConfig `json:"imageGenerationConfig"`
+}
+
+type titanPaintingParams struct {
+	Image      string `json:"image"`
+	Text       string `json:"text,omitempty"`
+	MaskPrompt string `json:"maskPrompt,omitempty"`
+	MaskImage  string `json:"maskImage,omitempty"`
+}
+
+type titanImageVariationParams struct {
+	Images []string `json:"images"`
+	Text   string   `json:"text,omitempty"`
+}
+
+// getImageEdit reads the image to change and its mask from the flags. It
+// returns nil when there is no --init-image.
+func getImageEdit(cmd *cobra.Command, m models.Model) (*imageEdit, error) {
+
+	initImage, err := cmd.PersistentFlags().GetString("init-image")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	maskImage, err := cmd.PersistentFlags().GetString("mask-image")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	maskPrompt, err := cmd.PersistentFlags().GetString("mask-prompt")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	mode, err := cmd.PersistentFlags().GetString("mode")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	strength, err := cmd.PersistentFlags().GetFloat64("image-strength")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	if initImage == "" {
+		if mode != "" || maskImage != "" || maskPrompt != "" {
+			return nil, errorf(kindUsage, "--mode, --mask-image and --mask-prompt need an --init-image")
+		}
+		return nil, nil
+	}
+
+	if maskImage != "" && maskPrompt != "" {
+		return nil, errorf(kindUsage, "please use either --mask-image or --mask-prompt, not both")
+	}
+
+	masked := maskImage != "" || maskPrompt != ""
+
+	// a mask says which part to paint, otherwise the whole image is varied
+	if mode == "" {
+		mode = imageModeVariation
+		if masked {
+			mode = imageModeInpaint
+		}
+	}
+
+	switch mode {
+	case imageModeInpaint, imageModeOutpaint:
+		if !masked {
+			return nil, errorf(kindUsage, "--mode %s needs a --mask-image or --mask-prompt", mode)
+		}
+	case imageModeVariation:
+		if masked {
+			return nil, errorf(kindUsage, "--mode variation changes the whole image and can't be used with a mask")
+		}
+	default:
+		return nil, errorf(kindUsage, "invalid mode %q. please use inpaint, outpaint or variation", mode)
+	}
+
+	switch m.ModelFamily {
+	case "stability":
+		if mode == imageModeOutpaint {
+			return nil, errorf(kindUnsupportedModel, "model %s does not support outpainting. please use a titan-image model", m.ModelID)
+		}
+		if maskPrompt != "" {
+			return nil, errorf(kindUnsupportedModel, "model %s does not support --mask-prompt. please use --mask-image or a titan-image model", m.ModelID)
+		}
+		if strength < 0 || strength > 1 {
+			return nil, errorf(kindUsage, "--image-strength must be between 0 and 1")
+		}
+	case "titan-image":
+		if cmd.PersistentFlags().Changed("image-strength") {
+			return nil, errorf(kindUsage, "--image-strength is only used by stability models")
+		}
+	}
+
+	edit := &imageEdit{
+		mode:       mode,
+		maskPrompt: maskPrompt,
+		strength:   strength,
+	}
+
+	var size image.Config
+	edit.image, size, err = readEditImage(initImage)
+	if err != nil {
+		return nil, err
+	}
+
+	if maskImage != "" {
+		var maskSize image.Config
+		edit.mask, maskSize, err = readEditImage(maskImage)
+		if err != nil {
+			return nil, err
+		}
+
+		if maskSize.Width != size.Width || maskSize.Height != size.Height {
+			return nil, errorf(kindUsage, "mask image is %dx%d but the init image is %dx%d. they must be the same size", maskSize.Width, maskSize.Height, size.Width, size.Height)
+		}
+	}
+
+	return edit, nil
+}
+
+// readEditImage reads an image to send to an image model, in the same way
+// as images sent with a prompt. Image models only take PNG and JPEG.
+func readEditImage(filename string) (string, image.Config, error) {
+
+	data, imageType, err := readImage(filename)
+	if err != nil {
+		return "", image.Config{}, withKind(kindUsage, err)
+	}
+
+	if imageType != "png" && imageType != "jpeg" {
+		return "", image.Config{}, errorf(kindUsage, "%s is a %s image. image models only take png or jpeg", filename, imageType)
+	}
+
+	size, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", image.Config{}, errorf(kindUsage, "unable to read image %s: %v", filename, err)
+	}
+
+	return base64.StdEncoding.EncodeToString(data), size, nil
+}
+
+// stabilityBody adds the image and mask to a SDXL request
+func (e *imageEdit) stabilityBody(body *stabilityImageBody) {
+
+	if e == nil {
+		return
+	}
+
+	body.InitImage = e.image
+
+	if e.mode == imageModeInpaint {
+		body.MaskSource = "MASK_IMAGE_BLACK"
+		body.MaskImage = e.mask
+		return
+	}
+
+	body.InitImageMode = "IMAGE_STRENGTH"
+	body.ImageStrength = &e.strength
+}
+
+// titanBody sets the task type and params of a Titan request
+func (e *imageEdit) titanBody(body *titanImageBody, prompt string) {
+
+	if e == nil {
+		body.TaskType = "TEXT_IMAGE"
+		body.TextToImageParams = &providers.AmazonTitanImageInvokeModelInputTextToImageParams{
+			Text: prompt,
+		}
+		return
+	}
+
+	painting := &titanPaintingParams{
+		Image:      e.image,
+		Text:       prompt,
+		MaskPrompt: e.maskPrompt,
+		MaskImage:  e.mask,
+	}
+
+	switch e.mode {
+	case imageModeInpaint:
+		body.TaskType = "INPAINTING"
+		body.InPaintingParams = painting
+	case imageModeOutpaint:
+		body.TaskType = "OUTPAINTING"
+		body.OutPaintingParams = painting
+	case imageModeVariation:
+		body.TaskType = "IMAGE_VARIATION"
+		body.ImageVariationParams = &titanImageVariationParams{
+			Images: []string{e.image},
+			Text:   prompt,
+		}
+	}
+}
@@ -0,0 +1,370 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/index"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/spf13/cobra"
+)
+
+// maxIndexFileSize is the size above which files are not indexed
+const maxIndexFileSize = 1024 * 1024
+
+// maxChunkLineLength is the most of a single line that goes into a chunk,
+// so minified files don't make chunks larger than the model takes
+const maxChunkLineLength = 2000
+
+// indexCmd represents the index command
+var indexCmd = &cobra.Command{
+	Use:   "index <dir>",
+	Short: "Build a local search index of a directory",
+	Long: `Splits the text files in a directory into chunks, embeds them with an
+embedding model on Amazon Bedrock and saves them in a local index, like so:
+
+> chat-cli index ./docs --name docs
+
+Use the ask command to answer questions from the index. Running index again
+only embeds the files that changed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		root, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return errorf(kindUsage, "%s is not a directory", args[0])
+		}
+
+		name, err := cmd.PersistentFlags().GetString("name")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if name == "" {
+			name = filepath.Base(root)
+		}
+
+		if err := index.ValidateName(name); err != nil {
+			return withKind(kindUsage, err)
+		}
+
+		modelId, err := cmd.PersistentFlags().GetString("model-id")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// validate model is supported
+		m, err := models.GetModel(modelId)
+		if err != nil {
+			return err
+		}
+
+		dimensions, err := cmd.PersistentFlags().GetInt("dimensions")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		e, err := newEmbedder(cmd, m, dimensions)
+		if err != nil {
+			return err
+		}
+
+		e.concurrency, err = cmd.PersistentFlags().GetInt("concurrency")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if e.concurrency < 1 {
+			return errorf(kindUsage, "concurrency must be at least 1")
+		}
+
+		chunkSize, err := cmd.PersistentFlags().GetInt("chunk-size")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if chunkSize < 100 {
+			return errorf(kindUsage, "--chunk-size must be at least 100")
+		}
+
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// files that haven't changed keep their chunks, as long as the
+		// index was made with the same model and chunk size. A corrupt
+		// index is built again from scratch.
+		old, err := index.Load(name)
+		if err != nil && !errors.Is(err, index.ErrNotFound) && !errors.Is(err, index.ErrCorrupt) {
+			return err
+		}
+		if old != nil && (old.ModelID != m.ModelID || old.Dimensions != e.dimensions || old.ChunkSize != chunkSize) {
+			old = nil
+		}
+
+		idx := &index.Index{
+			Name:       name,
+			Root:       root,
+			ModelID:    m.ModelID,
+			Dimensions: e.dimensions,
+			ChunkSize:  chunkSize,
+			Files:      map[string]index.File{},
+		}
+
+		// the chunks of each file in the old index
+		oldChunks := map[string][]int{}
+		if old != nil {
+			for i, c := range old.Chunks {
+				oldChunks[c.Path] = append(oldChunks[c.Path], i)
+			}
+		}
+
+		var pending []index.Chunk
+		unchanged := 0
+
+		err = walkTextFiles(cmd.Context(), root, func(path string, data []byte) {
+			rel, _ := filepath.Rel(root, path)
+			rel = filepath.ToSlash(rel)
+
+			sum := sha256.Sum256(data)
+			hash := hex.EncodeToString(sum[:])
+			idx.Files[rel] = index.File{Hash: hash}
+
+			if old != nil && old.Files[rel].Hash == hash {
+				unchanged++
+				for _, i := range oldChunks[rel] {
+					idx.Chunks = append(idx.Chunks, old.Chunks[i])
+					idx.Vectors = append(idx.Vectors, old.Vectors[i])
+				}
+				return
+			}
+
+			pending = append(pending, chunkText(rel, string(data), chunkSize)...)
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(idx.Files) == 0 {
+			return fmt.Errorf("no text files found in %s", args[0])
+		}
+
+		// the path is embedded with each chunk to help match questions
+		// about a file by its name
+		texts := make([]string, len(pending))
+		for i, c := range pending {
+			texts[i] = chunkEmbedText(c)
+		}
+
+		log.Printf("%d files, %d unchanged, %d chunks to embed", len(idx.Files), unchanged, len(pending))
+
+		// print the first request instead of sending it
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if dryRun {
+			if len(texts) == 0 {
+				return nil
+			}
+
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
+			}
+
+			batch := e.batches(texts)[0]
+			body, err := e.body(batch)
+			if err != nil {
+				return err
+			}
+
+			out, err := newInvokeModelDryRun(region, m, strings.Join(texts, "\n"), e.input(body))
+			if err != nil {
+				return err
+			}
+
+			return printDryRun(os.Stdout, out)
+		}
+
+		if len(texts) > 0 {
+
+			// refuse calls that would go over budget
+			force, err := cmd.PersistentFlags().GetBool("force")
+			if err != nil {
+				return fmt.Errorf("unable to get flag: %w", err)
+			}
+
+			budget, err := newBudgetGuard(force)
+			if err != nil {
+				return err
+			}
+
+			if err := budget.confirm(cmd.Context(), m.Cost(estimateTextTokens(texts), 0)); err != nil {
+				return err
+			}
+
+			// set up connection to AWS
+			e.svc, err = newBedrockClient(cmd.Context(), cmd)
+			if err != nil {
+				return err
+			}
+
+			vectors, tokens, err := e.embed(cmd.Context(), texts)
+			recordUsage("index", m, &types.TokenUsage{
+				InputTokens:  aws.Int32(tokens),
+				OutputTokens: aws.Int32(0),
+				TotalTokens:  aws.Int32(tokens),
+			}, showUsage)
+			if err != nil {
+				return err
+			}
+
+			idx.Chunks = append(idx.Chunks, pending...)
+			idx.Vectors = append(idx.Vectors, vectors...)
+		}
+
+		idx.Updated = time.Now().UTC()
+
+		if err := idx.Save(); err != nil {
+			return fmt.Errorf("unable to save index: %w", err)
+		}
+
+		log.Printf("index %s saved with %d chunks", name, len(idx.Chunks))
+
+		return nil
+	},
+}
+
+// walkTextFiles calls fn with the contents of every text file under root.
+// Hidden files and directories, symlinks, binary files and files over
+// maxIndexFileSize are skipped.
+func walkTextFiles(ctx context.Context, root string, fn func(path string, data []byte)) error {
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Size() > maxIndexFileSize {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil || isBinary(data) {
+			return nil
+		}
+
+		fn(path, data)
+		return nil
+	})
+}
+
+// chunkText splits a file into chunks of about size bytes. Chunks end on a
+// blank line where possible, so paragraphs and functions stay together.
+func chunkText(path string, text string, size int) []index.Chunk {
+
+	var chunks []index.Chunk
+	var b strings.Builder
+	start := 1
+
+	flush := func(end int) {
+		if strings.TrimSpace(b.String()) != "" {
+			chunks = append(chunks, index.Chunk{
+				Path:      path,
+				StartLine: start,
+				EndLine:   end,
+				Text:      b.String(),
+			})
+		}
+		b.Reset()
+		start = end + 1
+	}
+
+	lines := splitLines(text)
+	for i, line := range lines {
+		n := i + 1
+
+		// don't split a multi-byte character
+		if len(line) > maxChunkLineLength {
+			cut := maxChunkLineLength
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			line = line[:cut]
+		}
+
+		// start a new chunk rather than go over the size
+		if b.Len() > 0 && b.Len()+len(line) > size {
+			flush(n - 1)
+		}
+
+		b.WriteString(line)
+		b.WriteByte('\n')
+
+		// a blank line past half the size is a good place to stop
+		if strings.TrimSpace(line) == "" && b.Len() >= size/2 {
+			flush(n)
+		}
+	}
+	flush(len(lines))
+
+	return chunks
+}
+
+// chunkEmbedText is the text embedded for a chunk
+func chunkEmbedText(c index.Chunk) string {
+	return c.Path + "\n\n" + c.Text
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+	indexCmd.PersistentFlags().String("name", "", "name of the index (default is the name of the directory)")
+	indexCmd.PersistentFlags().StringP("model-id", "m", "amazon.titan-embed-text-v2:0", "set the embedding model id")
+	indexCmd.PersistentFlags().Int("dimensions", 0, "size of the vectors, if the model supports more than one (default is the model's)")
+	indexCmd.PersistentFlags().Int("chunk-size", 1500, "size of each chunk in bytes")
+	indexCmd.PersistentFlags().Int("concurrency", defaultEmbedConcurrency, "number of requests to send at once")
+	indexCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	indexCmd.PersistentFlags().Bool("dry-run", false, "print the first request that would be sent to Bedrock without sending it")
+	indexCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr")
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/go-micah/chat-cli/index"
+)
+
+func TestChunkText(t *testing.T) {
+
+	// a paragraph of 4 lines of 10 bytes each, counting the newline
+	para := strings.Repeat("123456789\n", 4)
+
+	tests := []struct {
+		name  string
+		text  string
+		size  int
+		lines [][2]int // start and end line of each chunk
+	}{
+		{"empty", "", 100, nil},
+		{"only blank lines", "\n\n  \n", 100, nil},
+		{"fits in one chunk", para, 100, [][2]int{{1, 4}}},
+		{"no newline at the end", strings.TrimSuffix(para, "\n"), 100, [][2]int{{1, 4}}},
+		{"split at a blank line", para + "\n" + para, 60, [][2]int{{1, 5}, {6, 9}}},
+		{"blank line too early to split at", "1\n\n" + para, 60, [][2]int{{1, 6}}},
+		{"split between lines without a blank line", para + para, 50, [][2]int{{1, 5}, {6, 8}}},
+		{"line longer than the size", "short\n" + strings.Repeat("x", 300) + "\nshort\n", 100, [][2]int{{1, 1}, {2, 2}, {3, 3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			chunks := chunkText("a.txt", tt.text, tt.size)
+
+			var lines [][2]int
+			for _, c := range chunks {
+				lines = append(lines, [2]int{c.StartLine, c.EndLine})
+				if c.Path != "a.txt" {
+					t.Errorf("chunk path = %q", c.Path)
+				}
+			}
+
+			if len(lines) != len(tt.lines) {
+				t.Fatalf("chunks cover lines %v, want %v", lines, tt.lines)
+			}
+			for i := range lines {
+				if lines[i] != tt.lines[i] {
+					t.Fatalf("chunks cover lines %v, want %v", lines, tt.lines)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkTextKeepsEveryLine(t *testing.T) {
+
+	var b strings.Builder
+	for i := range 500 {
+		b.WriteString(strings.Repeat("word ", i%30))
+		b.WriteString("\n")
+	}
+	text := b.String()
+
+	chunks := chunkText("a.txt", text, 300)
+
+	var joined strings.Builder
+	next := 1
+	for _, c := range chunks {
+		if c.StartLine < next {
+			t.Fatalf("chunk starts at line %d, before line %d", c.StartLine, next)
+		}
+		// only whitespace is left out between chunks
+		for _, line := range splitLines(text)[next-1 : c.StartLine-1] {
+			if strings.TrimSpace(line) != "" {
+				t.Fatalf("line %q is in no chunk", line)
+			}
+		}
+		if len(c.Text) > 300 && c.StartLine != c.EndLine {
+			t.Errorf("chunk of lines %d-%d is %d bytes", c.StartLine, c.EndLine, len(c.Text))
+		}
+		joined.WriteString(c.Text)
+		next = c.EndLine + 1
+	}
+
+	if strings.Join(strings.Fields(joined.String()), " ") != strings.Join(strings.Fields(text), " ") {
+		t.Error("the chunks don't hold the text")
+	}
+}
+
+func TestChunkTextMultiByteLine(t *testing.T) {
+
+	// 3 byte characters, so maxChunkLineLength falls inside one
+	line := strings.Repeat("€", maxChunkLineLength)
+
+	chunks := chunkText("a.txt", line+"\n", 100)
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+
+	text := strings.TrimSuffix(chunks[0].Text, "\n")
+	if !utf8.ValidString(text) {
+		t.Error("long line was cut inside a character")
+	}
+	if len(text) > maxChunkLineLength || len(text) < maxChunkLineLength-2 {
+		t.Errorf("long line was cut to %d bytes, want about %d", len(text), maxChunkLineLength)
+	}
+}
+
+func TestNumberChunk(t *testing.T) {
+
+	tests := []struct {
+		chunk index.Chunk
+		want  string
+	}{
+		{
+			index.Chunk{Path: "a.go", StartLine: 1, Text: "package a\n"},
+			"a.go\n     1\tpackage a",
+		},
+		{
+			index.Chunk{Path: "dir/b.md", StartLine: 41, Text: "# Title\n\ntext\n"},
+			"dir/b.md\n    41\t# Title\n    42\t\n    43\ttext",
+		},
+		{
+			index.Chunk{Path: "c.txt", StartLine: 7, Text: "no newline"},
+			"c.txt\n     7\tno newline",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := numberChunk(tt.chunk); got != tt.want {
+			t.Errorf("numberChunk(%+v) = %q, want %q", tt.chunk, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+)
+
+// stdinReader is the only reader of stdin line by line. A reader can buffer
+// more than the line it returns, so a new reader for each line would lose
+// the lines piped in after the first.
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// readAll reads r until EOF or until ctx is done, so a slow pipe on stdin
+// doesn't stop the command from being cancelled
+func readAll(ctx context.Context, r io.Reader) ([]byte, error) {
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(r)
+		done <- result{data, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.data, res.err
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// readLine reads a line from r, including the newline, or returns early
+// once ctx is done
+func readLine(ctx context.Context, r *bufio.Reader) (string, error) {
+
+	type result struct {
+		line string
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		line, err := r.ReadString('\n')
+		done <- result{line, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.line, res.err
+	case <-ctx.Done():
+		return "", context.Cause(ctx)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// jsonSchemaToolName is the name of the tool the model is forced to call
+// when a response has to match a JSON schema
+const jsonSchemaToolName = "json_response"
+
+// jsonSchema holds a compiled schema along with its raw form, which is sent
+// to the model as the input schema of a tool
+type jsonSchema struct {
+	compiled *jsonschema.Schema
+	raw      map[string]interface{}
+}
+
+// readJSONSchema loads and compiles a JSON schema from disk
+func readJSONSchema(filename string) (*jsonSchema, error) {
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file: %w", err)
+	}
+
+	return compileJSONSchema(filename, data)
+}
+
+// compileJSONSchema compiles a JSON schema. name identifies the schema in
+// errors and references. The schema has to describe an object, since it
+// becomes the input schema of a tool.
+func compileJSONSchema(name string, data []byte) (*jsonSchema, error) {
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errorf(kindUsage, "schema is not a JSON object: %v", err)
+	}
+
+	if raw["type"] != "object" {
+		return nil, errorf(kindUsage, `schema must have "type": "object"`)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(name, bytes.NewReader(data)); err != nil {
+		return nil, errorf(kindUsage, "unable to load schema: %v", err)
+	}
+
+	compiled, err := compiler.Compile(name)
+	if err != nil {
+		return nil, errorf(kindUsage, "invalid schema: %v", err)
+	}
+
+	return &jsonSchema{compiled: compiled, raw: raw}, nil
+}
+
+// toolConfig returns a tool config that forces the model to call a single
+// tool whose input schema is the JSON schema
+func (s *jsonSchema) toolConfig() *types.ToolConfiguration {
+	return &types.ToolConfiguration{
+		Tools: []types.Tool{
+			&types.ToolMemberToolSpec{
+				Value: types.ToolSpecification{
+					Name:        aws.String(jsonSchemaToolName),
+					Description: aws.String("Respond with JSON that matches the input schema of this tool."),
+					InputSchema: &types.ToolInputSchemaMemberJson{
+						Value: document.NewLazyDocument(s.raw),
+					},
+				},
+			},
+		},
+		ToolChoice: &types.ToolChoiceMemberTool{
+			Value: types.SpecificToolChoice{
+				Name: aws.String(jsonSchemaToolName),
+			},
+		},
+	}
+}
+
+// converseWithJSONSchema forces the model to answer with a single tool call
+// whose input matches the schema. If the input does not validate, the
+// validation errors are sent back to the model and the call is retried. The
+// validated JSON is returned along with the token usage of all attempts.
+func converseWithJSONSchema(ctx context.Context, svc *bedrockruntime.Client, retries callPolicy, input *bedrockruntime.ConverseInput, schema *jsonSchema, schemaRetries int) ([]byte, *types.TokenUsage, error) {
+
+	input.ToolConfig = schema.toolConfig()
+
+	var usage *types.TokenUsage
+
+	for attempt := 0; ; attempt++ {
+		output, err := retries.converse(ctx, svc, input)
+		if err != nil {
+			return nil, usage, fmt.Errorf("error from Bedrock, %w", err)
+		}
+
+		usage = addUsage(usage, output.Usage)
+
+		// a blocked response has the guardrail's message instead of a tool call
+		if output.StopReason == types.StopReasonGuardrailIntervened {
+			printGuardrail(os.Stderr, newGuardrailOutput(guardrailTrace(output.Trace), output.StopReason))
+			return nil, usage, stopReasonError(output.StopReason, 0)
+		}
+
+		response, ok := output.Output.(*types.ConverseOutputMemberMessage)
+		if !ok {
+			return nil, usage, errors.New("no message returned from Bedrock")
+		}
+
+		var toolUse *types.ToolUseBlock
+		for _, block := range response.Value.Content {
+			if v, ok := block.(*types.ContentBlockMemberToolUse); ok {
+				toolUse = &v.Value
+				break
+			}
+		}
+		if toolUse == nil {
+			return nil, usage, fmt.Errorf("model did not return a %s tool call", jsonSchemaToolName)
+		}
+
+		result, err := toolUse.Input.MarshalSmithyDocument()
+		if err != nil {
+			return nil, usage, fmt.Errorf("unable to marshal tool input: %w", err)
+		}
+
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(result))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, usage, fmt.Errorf("unable to parse tool input: %w", err)
+		}
+
+		err = schema.compiled.Validate(v)
+		if err == nil {
+			return result, usage, nil
+		}
+
+		details := err.Error()
+		var validationErr *jsonschema.ValidationError
+		if errors.As(err, &validationErr) {
+			details = fmt.Sprintf("%#v", validationErr)
+		}
+
+		if attempt >= schemaRetries {
+			return nil, usage, fmt.Errorf("response does not match schema after %d attempts: %s", attempt+1, details)
+		}
+
+		log.Printf("response does not match schema, retrying: %s", details)
+
+		// send the validation errors back as the tool result
+		input.Messages = append(input.Messages, response.Value, types.Message{
+			Role: types.ConversationRoleUser,
+			Content: []types.ContentBlock{
+				&types.ContentBlockMemberToolResult{
+					Value: types.ToolResultBlock{
+						ToolUseId: toolUse.ToolUseId,
+						Status:    types.ToolResultStatusError,
+						Content: []types.ToolResultContentBlock{
+							&types.ToolResultContentBlockMemberText{
+								Value: "The input does not match the schema. Call the tool again with input that fixes these errors:\n" + details,
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+}
@@ -0,0 +1,384 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/mcp"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/go-micah/chat-cli/settings"
+	"github.com/spf13/cobra"
+)
+
+// maxToolNameLength is the longest tool name Bedrock accepts
+const maxToolNameLength = 64
+
+// invalidToolNameChars matches what Bedrock doesn't allow in a tool name
+var invalidToolNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mcpSession holds the MCP servers started for a command, the tools they
+// offer and the resources read from them
+type mcpSession struct {
+	clients   []*mcp.Client
+	tools     []tool
+	documents string
+}
+
+// mcpTool is a tool offered by an MCP server. The model knows it by a name
+// that includes the server's, so tools from different servers can't clash.
+type mcpTool struct {
+	client  *mcp.Client
+	name    string
+	tool    mcp.Tool
+	confirm bool
+}
+
+// startMCP starts the servers named with --mcp and --mcp-resource. The
+// tools of the servers named with --mcp are offered to the model and the
+// resources named with --mcp-resource are read. It returns nil if no
+// servers are named.
+func startMCP(cmd *cobra.Command, m models.Model) (*mcpSession, error) {
+
+	names, err := cmd.PersistentFlags().GetStringArray("mcp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	resources, err := cmd.PersistentFlags().GetStringArray("mcp-resource")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	if len(names) == 0 && len(resources) == 0 {
+		return nil, nil
+	}
+
+	if len(names) > 0 && !m.SupportsToolUse {
+		return nil, errorf(kindUnsupportedModel, "model %s does not support tool use so it can't be used with --mcp", m.ModelID)
+	}
+
+	// resources are given as server:uri
+	type resource struct{ server, uri string }
+	var refs []resource
+	for _, r := range resources {
+		server, uri, ok := strings.Cut(r, ":")
+		if !ok || server == "" || uri == "" {
+			return nil, errorf(kindUsage, "--mcp-resource must be given as server:uri, not %q", r)
+		}
+		refs = append(refs, resource{server, uri})
+	}
+
+	// start every server once, whether it is named for its tools, its
+	// resources or both
+	start := slices.Clone(names)
+	for _, r := range refs {
+		start = append(start, r.server)
+	}
+
+	conf, err := settings.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &mcpSession{}
+	clients := map[string]*mcp.Client{}
+
+	for _, name := range start {
+		if clients[name] != nil {
+			continue
+		}
+
+		c, err := startMCPServer(cmd, conf.MCPServers, name)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+
+		clients[name] = c
+		s.clients = append(s.clients, c)
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		ask := conf.MCPServers[name].Confirm
+		tools, err := mcpTools(cmd.Context(), clients[name], ask == nil || *ask)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.tools = append(s.tools, tools...)
+	}
+
+	for _, r := range refs {
+		text, err := readMCPResource(cmd.Context(), clients[r.server], r.uri)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.documents += "<document>\n\n" + text + "\n\n</document>\n\n"
+	}
+
+	return s, nil
+}
+
+// startMCPServer starts a server defined in the config file. Its stderr is
+// only shown with --debug.
+func startMCPServer(cmd *cobra.Command, servers map[string]settings.MCPServer, name string) (*mcp.Client, error) {
+
+	conf, ok := servers[name]
+	if !ok {
+		return nil, errorf(kindUsage, "there is no MCP server named %s in the config file", name)
+	}
+
+	if conf.Command == "" {
+		return nil, fmt.Errorf("MCP server %s has no command", name)
+	}
+
+	debug, err := cmd.Root().PersistentFlags().GetBool("debug")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	var stderr io.Writer = io.Discard
+	if debug {
+		stderr = os.Stderr
+	}
+
+	return mcp.Start(cmd.Context(), name, conf.Command, conf.Args, conf.Env, stderr)
+}
+
+// mcpTools lists the tools of a server. If confirm is set, every call of
+// one of them has to be approved.
+func mcpTools(ctx context.Context, c *mcp.Client, confirm bool) ([]tool, error) {
+
+	list, err := c.ListTools(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tools of MCP server %s: %w", c.Name, err)
+	}
+
+	var tools []tool
+	for _, t := range list {
+		tools = append(tools, mcpTool{
+			client:  c,
+			name:    mcpToolName(c.Name, t.Name),
+			tool:    t,
+			confirm: confirm,
+		})
+	}
+
+	return tools, nil
+}
+
+// mcpToolName returns the name the model knows a tool by
+func mcpToolName(server string, name string) string {
+	n := invalidToolNameChars.ReplaceAllString(server+"_"+name, "_")
+	if len(n) > maxToolNameLength {
+		n = n[:maxToolNameLength]
+	}
+	return n
+}
+
+// readMCPResource returns the text of a resource
+func readMCPResource(ctx context.Context, c *mcp.Client, uri string) (string, error) {
+
+	contents, err := c.ReadResource(ctx, uri)
+	if err != nil {
+		return "", fmt.Errorf("unable to read resource %s from MCP server %s: %w", uri, c.Name, err)
+	}
+
+	var parts []string
+	for _, r := range contents {
+		if r.Blob != "" {
+			return "", fmt.Errorf("resource %s from MCP server %s is binary (%s) and can't be attached", uri, c.Name, cmp.Or(r.MimeType, "unknown type"))
+		}
+		parts = append(parts, r.Text)
+	}
+
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// toolList returns the tools of the servers, or nil without a session
+func (s *mcpSession) toolList() []tool {
+	if s == nil {
+		return nil
+	}
+	return s.tools
+}
+
+// attach puts the resources read from the servers in front of a prompt
+func (s *mcpSession) attach(prompt string) string {
+	if s == nil {
+		return prompt
+	}
+	return s.documents + prompt
+}
+
+// close stops every server
+func (s *mcpSession) close() {
+	if s == nil {
+		return
+	}
+	for _, c := range s.clients {
+		c.Close()
+	}
+}
+
+func (t mcpTool) spec() types.ToolSpecification {
+
+	// the schema has to be a plain value for the document encoder
+	var schema interface{} = map[string]interface{}{"type": "object"}
+	if len(t.tool.InputSchema) > 0 {
+		if err := json.Unmarshal(t.tool.InputSchema, &schema); err != nil {
+			schema = map[string]interface{}{"type": "object"}
+		}
+	}
+
+	return types.ToolSpecification{
+		Name:        aws.String(t.name),
+		Description: aws.String(cmp.Or(t.tool.Description, t.tool.Name)),
+		InputSchema: &types.ToolInputSchemaMemberJson{
+			Value: document.NewLazyDocument(schema),
+		},
+	}
+}
+
+// call sends the call to the server, asking first unless confirm is off
+func (t mcpTool) call(ctx context.Context, input []byte) (string, error) {
+
+	if t.confirm {
+		if !confirm(ctx, fmt.Sprintf("run tool %s from MCP server %s?", t.tool.Name, t.client.Name)) {
+			return "", errDeclined
+		}
+	}
+
+	result, err := t.client.CallTool(ctx, t.tool.Name, input)
+	if err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, c := range result.Content {
+		switch {
+		case c.Type == "text":
+			parts = append(parts, c.Text)
+		case c.Type == "resource" && c.Resource != nil && c.Resource.Text != "":
+			parts = append(parts, c.Resource.Text)
+		default:
+			parts = append(parts, fmt.Sprintf("[%s content not shown]", c.Type))
+		}
+	}
+	output := strings.Join(parts, "\n")
+
+	if result.IsError {
+		return "", errors.New(cmp.Or(output, "the tool failed"))
+	}
+
+	return output, nil
+}
+
+// mcpCmd represents the mcp command
+var mcpCmd = &cobra.Command{
+	Use:   "mcp",
+	Short: "Work with MCP servers",
+	Long: `MCP servers are defined in the config file and started with the --mcp flag
+of prompt and chat. Use the subcommands of mcp to see what they offer.`,
+}
+
+// mcpListCmd represents the mcp list command
+var mcpListCmd = &cobra.Command{
+	Use:   "list [server...]",
+	Short: "List the tools and resources of MCP servers",
+	Long: `Starts MCP servers from the config file and lists their tools and resources,
+like so:
+
+> chat-cli mcp list github
+
+Without a server name, every server in the config file is listed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		s, err := settings.Load()
+		if err != nil {
+			return err
+		}
+
+		names := args
+		if len(names) == 0 {
+			names = sortedKeys(s.MCPServers)
+		}
+
+		if len(names) == 0 {
+			return errorf(kindUsage, "there are no MCP servers in the config file")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+		for i, name := range names {
+			c, err := startMCPServer(cmd, s.MCPServers, name)
+			if err != nil {
+				return err
+			}
+
+			tools, err := c.ListTools(cmd.Context())
+			if err != nil {
+				c.Close()
+				return fmt.Errorf("unable to list tools of MCP server %s: %w", name, err)
+			}
+
+			resources, err := c.ListResources(cmd.Context())
+			if err != nil {
+				c.Close()
+				return fmt.Errorf("unable to list resources of MCP server %s: %w", name, err)
+			}
+
+			c.Close()
+
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s (%s %s)\n", name, c.Info.ServerInfo.Name, c.Info.ServerInfo.Version)
+
+			for _, t := range tools {
+				fmt.Fprintf(w, "  tool\t%s\t%s\n", mcpToolName(name, t.Name), firstLine(t.Description))
+			}
+			for _, r := range resources {
+				fmt.Fprintf(w, "  resource\t%s:%s\t%s\n", name, r.URI, firstLine(cmp.Or(r.Description, r.Name)))
+			}
+			if len(tools) == 0 && len(resources) == 0 {
+				fmt.Fprintln(w, "  no tools or resources")
+			}
+		}
+
+		return w.Flush()
+	},
+}
+
+// firstLine returns the first line of a description
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
+
+func init() {
+	rootCmd.AddCommand(mcpCmd)
+	mcpCmd.AddCommand(mcpListCmd)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-micah/chat-cli/mcp"
+)
+
+// startTestMCPServer builds and starts the MCP server the mcp package is
+// tested with
+func startTestMCPServer(t *testing.T, name string) *mcp.Client {
+	t.Helper()
+
+	server := filepath.Join(t.TempDir(), "server")
+	build := exec.Command("go", "build", "-o", server, "../mcp/testdata/server")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("unable to build test server: %v\n%s", err, out)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := mcp.Start(ctx, name, server, []string{"ok"}, nil, io.Discard)
+	if err != nil {
+		t.Fatalf("unable to start test server: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestMCPToolName(t *testing.T) {
+
+	tests := []struct {
+		server, name, want string
+	}{
+		{"files", "read", "files_read"},
+		{"my server", "fail.tool", "my_server_fail_tool"},
+		{"git-hub", "list/issues", "git-hub_list_issues"},
+		{"s", strings.Repeat("x", 100), "s_" + strings.Repeat("x", maxToolNameLength-2)},
+	}
+
+	for _, tt := range tests {
+		if got := mcpToolName(tt.server, tt.name); got != tt.want {
+			t.Errorf("mcpToolName(%q, %q) = %q, want %q", tt.server, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMCPTools(t *testing.T) {
+
+	c := startTestMCPServer(t, "test")
+	ctx := context.Background()
+
+	tools, err := mcpTools(ctx, c, false)
+	if err != nil {
+		t.Fatalf("mcpTools: %v", err)
+	}
+
+	var names []string
+	for _, tl := range tools {
+		names = append(names, *tl.spec().Name)
+	}
+	if strings.Join(names, ",") != "test_echo,test_fail_tool" {
+		t.Fatalf("tool names = %v, want [test_echo test_fail_tool]", names)
+	}
+
+	// the server is called with the tool's own name, not the prefixed one
+	out, err := tools[0].call(ctx, []byte(`{"text":"hello"}`))
+	if err != nil || out != "hello" {
+		t.Errorf("call echo = %q, %v, want hello", out, err)
+	}
+
+	_, err = tools[1].call(ctx, []byte(`{}`))
+	if err == nil || err.Error() != "it failed" {
+		t.Errorf("call fail.tool error = %v, want it failed", err)
+	}
+}
+
+func TestMCPResourceAttach(t *testing.T) {
+
+	c := startTestMCPServer(t, "test")
+	ctx := context.Background()
+
+	text, err := readMCPResource(ctx, c, "test://notes")
+	if err != nil {
+		t.Fatalf("readMCPResource: %v", err)
+	}
+
+	s := &mcpSession{documents: "<document>\n\n" + text + "\n\n</document>\n\n"}
+	want := "<document>\n\ncontents of test://notes\n\n</document>\n\nsummarize this"
+	if got := s.attach("summarize this"); got != want {
+		t.Errorf("attach = %q, want %q", got, want)
+	}
+
+	// without a session the prompt is unchanged
+	var none *mcpSession
+	if got := none.attach("summarize this"); got != "summarize this" {
+		t.Errorf("attach without a session = %q", got)
+	}
+
+	if _, err := readMCPResource(ctx, c, "test://missing"); err == nil {
+		t.Error("readMCPResource succeeded for a missing resource")
+	}
+}
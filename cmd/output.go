@@ -0,0 +1,238 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// output formats supported by the --output flag
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+)
+
+// promptOutput is the full response written by --output json
+type promptOutput struct {
+	ModelID                  string               `json:"model_id"`
+	Parameters               outputParameters     `json:"parameters"`
+	Content                  []outputContentBlock `json:"content"`
+	StopReason               string               `json:"stop_reason"`
+	AdditionalResponseFields interface{}          `json:"additional_response_fields,omitempty"`
+	Usage                    *outputUsage         `json:"usage,omitempty"`
+	LatencyMs                *int64               `json:"latency_ms,omitempty"`
+	Guardrail                *guardrailOutput     `json:"guardrail,omitempty"`
+}
+
+type outputParameters struct {
+	MaxTokens     *int32   `json:"max_tokens,omitempty"`
+	Temperature   *float32 `json:"temperature,omitempty"`
+	TopP          *float32 `json:"top_p,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+
+	AdditionalParams map[string]interface{} `json:"additional_params,omitempty"`
+}
+
+type outputContentBlock struct {
+	Type      string      `json:"type"`
+	Text      string      `json:"text,omitempty"`
+	ToolUseID string      `json:"tool_use_id,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Input     interface{} `json:"input,omitempty"`
+	Signature string      `json:"signature,omitempty"`
+	Redacted  []byte      `json:"redacted,omitempty"`
+}
+
+type outputUsage struct {
+	InputTokens  int32 `json:"input_tokens"`
+	OutputTokens int32 `json:"output_tokens"`
+	TotalTokens  int32 `json:"total_tokens"`
+}
+
+// outputEvent is a single stream event written by --output ndjson
+type outputEvent struct {
+	Type       string       `json:"type"`
+	Index      *int32       `json:"index,omitempty"`
+	Role       string       `json:"role,omitempty"`
+	Text       string       `json:"text,omitempty"`
+	ToolUseID  string       `json:"tool_use_id,omitempty"`
+	Name       string       `json:"name,omitempty"`
+	Input      string       `json:"input,omitempty"`
+	Reasoning  string       `json:"reasoning,omitempty"`
+	Signature  string       `json:"signature,omitempty"`
+	Redacted   []byte       `json:"redacted,omitempty"`
+	StopReason string       `json:"stop_reason,omitempty"`
+	Usage      *outputUsage `json:"usage,omitempty"`
+	LatencyMs  *int64       `json:"latency_ms,omitempty"`
+
+	Guardrail *guardrailOutput `json:"guardrail,omitempty"`
+}
+
+// errorOutput is written to stderr by --error-format json
+type errorOutput struct {
+	Error     string `json:"error"`
+	Kind      string `json:"kind"`
+	ExitCode  int    `json:"exit_code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// validateOutputFormat checks the value of the --output flag
+func validateOutputFormat(format string) error {
+	switch format {
+	case outputText, outputJSON, outputNDJSON:
+		return nil
+	default:
+		return errorf(kindUsage, "invalid output format: %s. please use text, json or ndjson", format)
+	}
+}
+
+func newOutputUsage(usage *types.TokenUsage) *outputUsage {
+	if usage == nil {
+		return nil
+	}
+
+	return &outputUsage{
+		InputTokens:  aws.ToInt32(usage.InputTokens),
+		OutputTokens: aws.ToInt32(usage.OutputTokens),
+		TotalTokens:  aws.ToInt32(usage.TotalTokens),
+	}
+}
+
+func newOutputParameters(conf types.InferenceConfiguration, params map[string]interface{}) outputParameters {
+	return outputParameters{
+		MaxTokens:        conf.MaxTokens,
+		Temperature:      conf.Temperature,
+		TopP:             conf.TopP,
+		StopSequences:    conf.StopSequences,
+		AdditionalParams: params,
+	}
+}
+
+// newOutputContent converts the content blocks of a message to their JSON form
+func newOutputContent(msg types.Message) []outputContentBlock {
+
+	content := []outputContentBlock{}
+
+	for _, block := range msg.Content {
+		switch v := block.(type) {
+		case *types.ContentBlockMemberText:
+			content = append(content, outputContentBlock{
+				Type: "text",
+				Text: v.Value,
+			})
+		case *types.ContentBlockMemberToolUse:
+			var input interface{}
+			if v.Value.Input != nil {
+				v.Value.Input.UnmarshalSmithyDocument(&input)
+			}
+			content = append(content, outputContentBlock{
+				Type:      "tool_use",
+				ToolUseID: aws.ToString(v.Value.ToolUseId),
+				Name:      aws.ToString(v.Value.Name),
+				Input:     input,
+			})
+		case *types.ContentBlockMemberReasoningContent:
+			switch r := v.Value.(type) {
+			case *types.ReasoningContentBlockMemberReasoningText:
+				content = append(content, outputContentBlock{
+					Type:      "reasoning",
+					Text:      aws.ToString(r.Value.Text),
+					Signature: aws.ToString(r.Value.Signature),
+				})
+			case *types.ReasoningContentBlockMemberRedactedContent:
+				content = append(content, outputContentBlock{
+					Type:     "reasoning",
+					Redacted: r.Value,
+				})
+			}
+		}
+	}
+
+	return content
+}
+
+// newOutputEvent converts a stream event to its JSON form
+func newOutputEvent(event types.ConverseStreamOutput) outputEvent {
+
+	switch v := event.(type) {
+	case *types.ConverseStreamOutputMemberMessageStart:
+		return outputEvent{
+			Type: "message_start",
+			Role: string(v.Value.Role),
+		}
+
+	case *types.ConverseStreamOutputMemberContentBlockStart:
+		e := outputEvent{
+			Type:  "content_block_start",
+			Index: v.Value.ContentBlockIndex,
+		}
+		if start, ok := v.Value.Start.(*types.ContentBlockStartMemberToolUse); ok {
+			e.ToolUseID = aws.ToString(start.Value.ToolUseId)
+			e.Name = aws.ToString(start.Value.Name)
+		}
+		return e
+
+	case *types.ConverseStreamOutputMemberContentBlockDelta:
+		e := outputEvent{
+			Type:  "content_block_delta",
+			Index: v.Value.ContentBlockIndex,
+		}
+		switch delta := v.Value.Delta.(type) {
+		case *types.ContentBlockDeltaMemberText:
+			e.Text = delta.Value
+		case *types.ContentBlockDeltaMemberToolUse:
+			e.Input = aws.ToString(delta.Value.Input)
+		case *types.ContentBlockDeltaMemberReasoningContent:
+			switch r := delta.Value.(type) {
+			case *types.ReasoningContentBlockDeltaMemberText:
+				e.Reasoning = r.Value
+			case *types.ReasoningContentBlockDeltaMemberSignature:
+				e.Signature = r.Value
+			case *types.ReasoningContentBlockDeltaMemberRedactedContent:
+				e.Redacted = r.Value
+			}
+		}
+		return e
+
+	case *types.ConverseStreamOutputMemberContentBlockStop:
+		return outputEvent{
+			Type:  "content_block_stop",
+			Index: v.Value.ContentBlockIndex,
+		}
+
+	case *types.ConverseStreamOutputMemberMessageStop:
+		return outputEvent{
+			Type:       "message_stop",
+			StopReason: string(v.Value.StopReason),
+		}
+
+	case *types.ConverseStreamOutputMemberMetadata:
+		e := outputEvent{
+			Type:  "metadata",
+			Usage: newOutputUsage(v.Value.Usage),
+		}
+		if v.Value.Metrics != nil {
+			e.LatencyMs = v.Value.Metrics.LatencyMs
+		}
+		e.Guardrail = newGuardrailOutput(guardrailStreamTrace(v.Value.Trace), "")
+		return e
+
+	case *types.UnknownUnionMember:
+		return outputEvent{
+			Type: v.Tag,
+		}
+	}
+
+	return outputEvent{Type: "unknown"}
+}
+
+// writeJSON writes v to w as a single line of JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
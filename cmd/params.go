@@ -0,0 +1,127 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/go-micah/chat-cli/models"
+)
+
+// buildModelParams builds the model-specific request fields from a JSON
+// params file and key=value pairs, which take precedence. Keys may use dots
+// to set nested fields, e.g. thinking.budget_tokens=1024. Values are parsed
+// as JSON when possible and used as strings otherwise.
+func buildModelParams(m models.Model, paramsFile string, params []string) (map[string]interface{}, error) {
+
+	fields := map[string]interface{}{}
+
+	if paramsFile != "" {
+		data, err := os.ReadFile(paramsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read params file: %w", err)
+		}
+
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, errorf(kindUsage, "params file is not a JSON object: %w", err)
+		}
+
+		// null unmarshals to a nil map, which can't be added to
+		if fields == nil {
+			return nil, errorf(kindUsage, "params file is not a JSON object")
+		}
+	}
+
+	for _, param := range params {
+		key, raw, ok := strings.Cut(param, "=")
+		if !ok || key == "" {
+			return nil, errorf(kindUsage, "invalid param %q. please use key=value", param)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(raw), &value); err != nil {
+			value = raw
+		}
+
+		if err := setField(fields, strings.Split(key, "."), value); err != nil {
+			return nil, errorf(kindUsage, "invalid param %q: %w", param, err)
+		}
+	}
+
+	for name := range fields {
+		if err := m.ValidateParam(name); err != nil {
+			return nil, withKind(kindUsage, err)
+		}
+	}
+
+	return fields, nil
+}
+
+// setField sets a nested field, creating objects along the path as needed
+func setField(fields map[string]interface{}, path []string, value interface{}) error {
+
+	if len(path) == 1 {
+		fields[path[0]] = value
+		return nil
+	}
+
+	child, ok := fields[path[0]]
+	if !ok {
+		child = map[string]interface{}{}
+		fields[path[0]] = child
+	}
+
+	obj, ok := child.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s is not an object", path[0])
+	}
+
+	return setField(obj, path[1:], value)
+}
+
+// modelParamsDocument converts model-specific request fields to the
+// document sent to Bedrock. It returns nil if there are none.
+func modelParamsDocument(fields map[string]interface{}) document.Interface {
+	if len(fields) == 0 {
+		return nil
+	}
+	return document.NewLazyDocument(fields)
+}
+
+// responseFieldsJSON converts the additional response fields returned by
+// Bedrock to a value that can be written as JSON
+func responseFieldsJSON(fields document.Interface) (interface{}, error) {
+
+	if fields == nil {
+		return nil, nil
+	}
+
+	var v interface{}
+	if err := fields.UnmarshalSmithyDocument(&v); err != nil {
+		return nil, fmt.Errorf("unable to read additional response fields: %w", err)
+	}
+
+	return v, nil
+}
+
+// printResponseFields writes the additional response fields to stderr
+func printResponseFields(fields document.Interface) error {
+
+	v, err := responseFieldsJSON(fields)
+	if err != nil || v == nil {
+		return err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "[additional response fields: %s]\n", b)
+	return nil
+}
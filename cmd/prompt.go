@@ -6,14 +6,11 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
 	"github.com/go-micah/chat-cli/models"
@@ -29,7 +26,7 @@ var promptCmd = &cobra.Command{
 
 > chat-cli prompt "What is your name?"`,
 	Args: cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 
 		prompt := args[0]
 
@@ -39,84 +36,236 @@ var promptCmd = &cobra.Command{
 		if isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd()) {
 			// do nothing
 		} else {
-			stdin, err := io.ReadAll(os.Stdin)
-
+			stdin, err := readAll(cmd.Context(), os.Stdin)
 			if err != nil {
-				panic(err)
+				return fmt.Errorf("unable to read stdin: %w", err)
 			}
 			document = string(stdin)
 		}
 
+		// the request as given, without the document
+		request := prompt
+
 		if document != "" {
-			document = "<document>\n\n" + document + "\n\n</document>\n\n"
-			prompt = document + prompt
+			prompt = "<document>\n\n" + document + "\n\n</document>\n\n" + prompt
 		}
 
 		// get model id
 		modelId, err := cmd.PersistentFlags().GetString("model-id")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		// validate model is supported
 		m, err := models.GetModel(modelId)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			return err
+		}
+
+		if m.ModelType != "text" {
+			return errorf(kindUnsupportedModel, "model %s does not support text generation. please use a different model", m.ModelID)
 		}
 
 		// get options
 		temperature, err := cmd.PersistentFlags().GetFloat32("temperature")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		topP, err := cmd.PersistentFlags().GetFloat32("topP")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		maxTokens, err := cmd.PersistentFlags().GetInt32("max-tokens")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		autoContinue, err := cmd.PersistentFlags().GetInt("auto-continue")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// get prefill and stop sequences to steer the output
+		prefill, err := cmd.PersistentFlags().GetString("prefill")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		stop, err := cmd.PersistentFlags().GetStringArray("stop")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if err := validateSteering(m, prefill, stop); err != nil {
+			return err
+		}
+
+		// get model-specific request fields
+		params, err := cmd.PersistentFlags().GetStringArray("param")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		paramsFile, err := cmd.PersistentFlags().GetString("params-file")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		modelParams, err := buildModelParams(m, paramsFile, params)
+		if err != nil {
+			return err
+		}
+
+		responseFields, err := cmd.PersistentFlags().GetStringArray("response-field")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// enable extended thinking
+		thinkingBudget, err := cmd.PersistentFlags().GetInt32("thinking-budget")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if thinkingBudget > 0 {
+			err = enableThinking(m, thinkingBudget, thinkingOptions{
+				maxTokens:    maxTokens,
+				temperature:  temperature,
+				topP:         topP,
+				prefill:      prefill,
+				autoContinue: autoContinue,
+			}, modelParams)
+			if err != nil {
+				return err
+			}
 		}
 
 		// get feature floag for image attachment
 		image, err := cmd.PersistentFlags().GetString("image")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		// check if model supports image/vision capabilities
-		// currently only claude3 models support vision capabilities
-		if (image != "") && (m.ModelFamily != "claude3") {
-			log.Fatalf("model %s does not support vision. please use a different model", m.ModelID)
+		if image != "" && !m.SupportsVision {
+			return errorf(kindUnsupportedModel, "model %s does not support vision. please use a different model", m.ModelID)
 		}
 
-		// set up connection to AWS
-		region, err := cmd.Parent().PersistentFlags().GetString("region")
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
-		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+		// get output format
+		outputFormat, err := cmd.PersistentFlags().GetString("output")
 		if err != nil {
-			log.Fatalf("unable to load AWS config: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
-		svc := bedrockruntime.NewFromConfig(cfg)
+		if err := validateOutputFormat(outputFormat); err != nil {
+			return err
+		}
+
+		// get json schema the response has to match
+		schemaFile, err := cmd.PersistentFlags().GetString("json-schema")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		schemaRetries, err := cmd.PersistentFlags().GetInt("json-schema-retries")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		var schema *jsonSchema
+		if schemaFile != "" {
+			if !m.SupportsToolUse {
+				return errorf(kindUnsupportedModel, "model %s does not support tool use so it can't be used with --json-schema", m.ModelID)
+			}
+
+			if outputFormat != outputText {
+				return errorf(kindUsage, "--json-schema can't be combined with --output %s", outputFormat)
+			}
+
+			if prefill != "" {
+				return errorf(kindUsage, "--json-schema can't be combined with --prefill")
+			}
+
+			if thinkingBudget > 0 {
+				return errorf(kindUsage, "--json-schema can't be combined with --thinking-budget")
+			}
+
+			schema, err = readJSONSchema(schemaFile)
+			if err != nil {
+				return withKind(kindUsage, fmt.Errorf("unable to read json schema: %w", err))
+			}
+		}
+
+		// start the MCP servers named with --mcp and --mcp-resource
+		servers, err := startMCP(cmd, m)
+		if err != nil {
+			return err
+		}
+		defer servers.close()
+
+		// get the tools the model can call
+		tools, err := getToolSet(cmd, m, servers.toolList())
+		if err != nil {
+			return err
+		}
+
+		if tools != nil {
+			if schema != nil {
+				return errorf(kindUsage, "--tools and --mcp can't be combined with --json-schema")
+			}
+
+			if prefill != "" {
+				return errorf(kindUsage, "--tools and --mcp can't be combined with --prefill")
+			}
+
+			if autoContinue > 0 {
+				return errorf(kindUsage, "--tools and --mcp can't be combined with --auto-continue")
+			}
+		}
+
+		// apply the guardrail from the flags or the config file
+		guard, err := getGuardrail(cmd)
+		if err != nil {
+			return err
+		}
 
 		// check if --no-stream is set
 		noStream, err := cmd.PersistentFlags().GetBool("no-stream")
 		if err != nil {
-			log.Fatalf("unable to get flag: %v", err)
+			return fmt.Errorf("unable to get flag: %w", err)
 		}
 
 		// check if model supports streaming and --no-stream is not set
-		if (!noStream) && (!m.SupportsStreaming) {
-			log.Fatalf("model %s does not support streaming. please use the --no-stream flag", m.ModelID)
+		if (!noStream) && (!m.SupportsStreaming) && (schema == nil) {
+			return errorf(kindUnsupportedModel, "model %s does not support streaming. please use the --no-stream flag", m.ModelID)
+		}
+
+		// ndjson emits stream events so it needs a streaming response
+		if (outputFormat == outputNDJSON) && noStream {
+			return errorf(kindUsage, "--output ndjson can't be used with the --no-stream flag")
+		}
+
+		// split a document too big for the context window. the first
+		// request of the plan stands in for the prompt until it has run.
+		plan, err := getChunkPlan(cmd, m, document, request, maxTokens)
+		if err != nil {
+			return err
 		}
 
-		// craft prompt
+		if plan != nil {
+			prompt = plan.firstPrompt()
+		}
+
+		// craft prompt, with any resources from MCP servers in front
+		prompt = servers.attach(prompt)
+
 		userMsg := types.Message{
 			Role: types.ConversationRoleUser,
 			Content: []types.ContentBlock{
@@ -130,7 +279,7 @@ var promptCmd = &cobra.Command{
 		if image != "" {
 			imageBytes, imageType, err := readImage(image)
 			if err != nil {
-				log.Fatalf("unable to read image: %v", err)
+				return fmt.Errorf("unable to read image: %w", err)
 			}
 
 			userMsg.Content = append(userMsg.Content, &types.ContentBlockMemberImage{
@@ -145,107 +294,350 @@ var promptCmd = &cobra.Command{
 		}
 
 		conf := types.InferenceConfiguration{
-			MaxTokens:   &maxTokens,
-			TopP:        &topP,
-			Temperature: &temperature,
+			MaxTokens:     &maxTokens,
+			TopP:          &topP,
+			Temperature:   &temperature,
+			StopSequences: stop,
 		}
 
-		if noStream {
-			// set up ConverseInput with model and prompt
-			converseInput := &bedrockruntime.ConverseInput{
-				ModelId:         aws.String(m.ModelID),
-				InferenceConfig: &conf,
+		msgs := []types.Message{userMsg}
+		if prefill != "" {
+			msgs = append(msgs, prefillMessage(prefill))
+		}
+
+		// print the request instead of sending it
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if dryRun {
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
 			}
-			converseInput.Messages = append(converseInput.Messages, userMsg)
 
-			// invoke and wait for full response
-			output, err := svc.Converse(context.TODO(), converseInput)
+			var out dryRunOutput
+			if schema != nil || noStream {
+				input := &bedrockruntime.ConverseInput{
+					ModelId:                           aws.String(m.ModelID),
+					Messages:                          msgs,
+					InferenceConfig:                   &conf,
+					AdditionalModelRequestFields:      modelParamsDocument(modelParams),
+					AdditionalModelResponseFieldPaths: responseFields,
+					ToolConfig:                        tools.toolConfig(),
+					GuardrailConfig:                   guard.config(),
+				}
+				if schema != nil {
+					input.ToolConfig = schema.toolConfig()
+				}
+
+				out, err = newConverseDryRun("Converse", region, m, input)
+			} else {
+				out, err = newConverseStreamDryRun(region, m, &bedrockruntime.ConverseStreamInput{
+					ModelId:                           aws.String(m.ModelID),
+					Messages:                          msgs,
+					InferenceConfig:                   &conf,
+					AdditionalModelRequestFields:      modelParamsDocument(modelParams),
+					AdditionalModelResponseFieldPaths: responseFields,
+					ToolConfig:                        tools.toolConfig(),
+					GuardrailConfig:                   guard.streamConfig(),
+				})
+			}
 			if err != nil {
-				log.Fatalf("error from Bedrock, %v", err)
+				return err
 			}
 
-			reponse, _ := output.Output.(*types.ConverseOutputMemberMessage)
-			responseContentBlock := reponse.Value.Content[0]
-			text, _ := responseContentBlock.(*types.ContentBlockMemberText)
+			return printDryRun(os.Stdout, out)
+		}
 
-			fmt.Println(text.Value)
+		// refuse calls that would go over budget
+		force, err := cmd.PersistentFlags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
 
-		} else {
-			converseStreamInput := &bedrockruntime.ConverseStreamInput{
-				ModelId:         aws.String(m.ModelID),
-				InferenceConfig: &conf,
+		budget, err := newBudgetGuard(force)
+		if err != nil {
+			return err
+		}
+
+		estimate := m.Cost(estimateMessageTokens([]types.Message{userMsg}), maxTokens)
+		if plan != nil {
+			estimate = plan.estimate(m, maxTokens)
+		}
+
+		if err := budget.confirm(cmd.Context(), estimate); err != nil {
+			return err
+		}
+
+		// set up connection to AWS
+		svc, err := newBedrockClient(cmd.Context(), cmd)
+		if err != nil {
+			return err
+		}
+
+		retries, err := getCallPolicy(cmd)
+		if err != nil {
+			return err
+		}
+
+		// work through the chunks, leaving the final call to be made like
+		// any other prompt
+		if plan != nil {
+			final, err := plan.run(cmd.Context(), func(ctx context.Context, prompt string) (string, error) {
+				output, err := retries.converse(ctx, svc, &bedrockruntime.ConverseInput{
+					ModelId: aws.String(m.ModelID),
+					Messages: []types.Message{
+						{
+							Role: types.ConversationRoleUser,
+							Content: []types.ContentBlock{
+								&types.ContentBlockMemberText{
+									Value: prompt,
+								},
+							},
+						},
+					},
+					InferenceConfig:              &conf,
+					AdditionalModelRequestFields: modelParamsDocument(modelParams),
+					GuardrailConfig:              guard.config(),
+				})
+				if err != nil {
+					return "", fmt.Errorf("error from Bedrock, %w", err)
+				}
+
+				// the estimate of the whole plan was reserved up front,
+				// until the final call is made
+				budget.add(0, recordUsage("prompt", m, output.Usage, showUsage))
+
+				if output.StopReason == types.StopReasonGuardrailIntervened || output.StopReason == types.StopReasonContentFiltered {
+					printGuardrail(os.Stderr, newGuardrailOutput(guardrailTrace(output.Trace), output.StopReason))
+				}
+
+				// a summary cut off at max tokens would be passed on as if
+				// it were complete
+				if err := stopReasonError(output.StopReason, maxTokens); err != nil {
+					return "", err
+				}
+
+				var text string
+				if reponse, ok := output.Output.(*types.ConverseOutputMemberMessage); ok {
+					text = messageText(reponse.Value)
+				}
+
+				return text, nil
+			})
+			if err != nil {
+				return err
 			}
-			converseStreamInput.Messages = append(converseStreamInput.Messages, userMsg)
 
-			// invoke with streaming response
-			output, err := svc.ConverseStream(context.Background(), converseStreamInput)
+			userMsg.Content[0] = &types.ContentBlockMemberText{
+				Value: servers.attach(final),
+			}
+			msgs[0] = userMsg
+		}
+
+		if schema != nil {
+			// responses that must match a schema are never streamed
+			converseInput := &bedrockruntime.ConverseInput{
+				ModelId:                           aws.String(m.ModelID),
+				InferenceConfig:                   &conf,
+				AdditionalModelRequestFields:      modelParamsDocument(modelParams),
+				AdditionalModelResponseFieldPaths: responseFields,
+				GuardrailConfig:                   guard.config(),
+			}
+			converseInput.Messages = append(converseInput.Messages, userMsg)
+
+			result, usage, err := converseWithJSONSchema(cmd.Context(), svc, retries, converseInput, schema, schemaRetries)
+			recordUsage("prompt", m, usage, showUsage)
 			if err != nil {
-				log.Fatalf("error from Bedrock, %v", err)
+				return err
 			}
 
-			_, err = processStreamingOutput(output, func(ctx context.Context, part string) error {
-				fmt.Print(part)
-				return nil
-			})
+			fmt.Println(string(result))
+
+		} else if noStream {
+			// set up ConverseInput with model and prompt
+			converseInput := &bedrockruntime.ConverseInput{
+				ModelId:                           aws.String(m.ModelID),
+				InferenceConfig:                   &conf,
+				AdditionalModelRequestFields:      modelParamsDocument(modelParams),
+				AdditionalModelResponseFieldPaths: responseFields,
+				ToolConfig:                        tools.toolConfig(),
+				GuardrailConfig:                   guard.config(),
+			}
+
+			var latency int64
+
+			// invoke and wait for full response
+			turn, err := converseWithContinue(msgs, autoContinue, tools.send(cmd.Context(), budget.guardCalls(cmd.Context(), m, maxTokens, estimate, func(msgs []types.Message) (converseTurn, error) {
+				converseInput.Messages = msgs
+
+				output, err := retries.converse(cmd.Context(), svc, converseInput)
+				if err != nil {
+					return converseTurn{}, fmt.Errorf("error from Bedrock, %w", err)
+				}
+
+				if output.Metrics != nil {
+					latency += aws.ToInt64(output.Metrics.LatencyMs)
+				}
+
+				turn := converseTurn{
+					StopReason:                    output.StopReason,
+					AdditionalModelResponseFields: output.AdditionalModelResponseFields,
+					Usage:                         output.Usage,
+					Guardrail:                     newGuardrailOutput(guardrailTrace(output.Trace), output.StopReason),
+				}
+				if reponse, ok := output.Output.(*types.ConverseOutputMemberMessage); ok {
+					turn.Message = reponse.Value
+				}
+
+				return turn, nil
+			}), nil))
+			recordUsage("prompt", m, turn.Usage, showUsage)
 			if err != nil {
-				log.Fatal("streaming output processing error: ", err)
+				return err
 			}
 
-			fmt.Println()
-		}
-	},
-}
+			if outputFormat == outputJSON {
+				out := promptOutput{
+					ModelID:    m.ModelID,
+					Parameters: newOutputParameters(conf, modelParams),
+					Content:    newOutputContent(turn.Message),
+					StopReason: string(turn.StopReason),
+					Usage:      newOutputUsage(turn.Usage),
+					LatencyMs:  &latency,
+					Guardrail:  turn.Guardrail,
+				}
+
+				out.AdditionalResponseFields, err = responseFieldsJSON(turn.AdditionalModelResponseFields)
+				if err != nil {
+					return err
+				}
+
+				if err := writeJSON(os.Stdout, out); err != nil {
+					return fmt.Errorf("unable to write output: %w", err)
+				}
+				return stopReasonError(turn.StopReason, maxTokens)
+			}
 
-type StreamingOutputHandler func(ctx context.Context, part string) error
+			if err := printReasoning(turn.Message); err != nil {
+				return err
+			}
 
-func processStreamingOutput(output *bedrockruntime.ConverseStreamOutput, handler StreamingOutputHandler) (types.Message, error) {
+			fmt.Println(messageText(turn.Message))
 
-	var combinedResult string
+			if err := printResponseFields(turn.AdditionalModelResponseFields); err != nil {
+				return err
+			}
 
-	msg := types.Message{}
+			printGuardrail(os.Stderr, turn.Guardrail)
 
-	for event := range output.GetStream().Events() {
-		switch v := event.(type) {
-		case *types.ConverseStreamOutputMemberMessageStart:
+			return stopReasonError(turn.StopReason, maxTokens)
 
-			msg.Role = v.Value.Role
+		} else {
+			converseStreamInput := &bedrockruntime.ConverseStreamInput{
+				ModelId:                           aws.String(m.ModelID),
+				InferenceConfig:                   &conf,
+				AdditionalModelRequestFields:      modelParamsDocument(modelParams),
+				AdditionalModelResponseFieldPaths: responseFields,
+				ToolConfig:                        tools.toolConfig(),
+				GuardrailConfig:                   guard.streamConfig(),
+			}
 
-		case *types.ConverseStreamOutputMemberContentBlockDelta:
+			// print text as it arrives unless we want machine-readable output
+			var handler StreamHandler
+			switch outputFormat {
+			case outputNDJSON:
+				handler = ndjsonStreamHandler{w: os.Stdout}
+			case outputJSON:
+				handler = nopStreamHandler{}
+			default:
+				handler = newReasoningStreamHandler(&continueStreamHandler{w: os.Stdout})
+			}
 
-			textResponse := v.Value.Delta.(*types.ContentBlockDeltaMemberText)
-			handler(context.Background(), textResponse.Value)
-			combinedResult = combinedResult + textResponse.Value
+			// the model only streams what comes after the prefill
+			if outputFormat == outputText {
+				fmt.Print(prefill)
+			}
 
-		case *types.UnknownUnionMember:
-			fmt.Println("unknown tag:", v.Tag)
-		}
-	}
+			var latency int64
+
+			turn, err := converseWithContinue(msgs, autoContinue, tools.send(cmd.Context(), budget.guardCalls(cmd.Context(), m, maxTokens, estimate, func(msgs []types.Message) (converseTurn, error) {
+				converseStreamInput.Messages = msgs
+
+				// invoke with streaming response
+				result, err := retries.converseStream(cmd.Context(), svc, converseStreamInput, handler)
+				if err != nil {
+					return converseTurn{}, fmt.Errorf("error from Bedrock, %w", err)
+				}
+
+				if result.Metrics != nil {
+					latency += aws.ToInt64(result.Metrics.LatencyMs)
+				}
+
+				return converseTurn{
+					Message:                       result.Message,
+					StopReason:                    result.StopReason,
+					AdditionalModelResponseFields: result.AdditionalModelResponseFields,
+					Usage:                         result.Usage,
+					Guardrail:                     newGuardrailOutput(guardrailStreamTrace(result.Trace), result.StopReason),
+				}, nil
+			}), nil))
+
+			// keep usage on its own line after streamed text
+			if outputFormat == outputText {
+				fmt.Println()
+			}
+
+			recordUsage("prompt", m, turn.Usage, showUsage)
+			if err != nil {
+				return err
+			}
 
-	msg.Content = append(msg.Content,
-		&types.ContentBlockMemberText{
-			Value: combinedResult,
-		},
-	)
+			if outputFormat == outputJSON {
+				out := promptOutput{
+					ModelID:    m.ModelID,
+					Parameters: newOutputParameters(conf, modelParams),
+					Content:    newOutputContent(turn.Message),
+					StopReason: string(turn.StopReason),
+					Usage:      newOutputUsage(turn.Usage),
+					LatencyMs:  &latency,
+					Guardrail:  turn.Guardrail,
+				}
+
+				out.AdditionalResponseFields, err = responseFieldsJSON(turn.AdditionalModelResponseFields)
+				if err != nil {
+					return err
+				}
+
+				if err := writeJSON(os.Stdout, out); err != nil {
+					return fmt.Errorf("unable to write output: %w", err)
+				}
+			} else {
+				if err := printResponseFields(turn.AdditionalModelResponseFields); err != nil {
+					return err
+				}
+
+				// ndjson output has the guardrail in its metadata event
+				if outputFormat == outputText {
+					printGuardrail(os.Stderr, turn.Guardrail)
+				}
+			}
+
+			return stopReasonError(turn.StopReason, maxTokens)
+		}
 
-	return msg, nil
+		return nil
+	},
 }
 
 func readImage(filename string) ([]byte, string, error) {
 
-	// Define a base directory for allowed images
-	baseDir, err := os.Getwd()
+	// Make sure the image is inside the working directory
+	fullPath, err := sandboxPath(filename)
 	if err != nil {
-		return nil, "", fmt.Errorf("unable to get working directory: %w", err)
-	}
-
-	// Clean the filename and create the full path
-	cleanFilename := filepath.Clean(filename)
-	fullPath := filepath.Join(baseDir, cleanFilename)
-
-	// Ensure the full path is within the base directory
-	relPath, err := filepath.Rel(baseDir, fullPath)
-	if err != nil || strings.HasPrefix(relPath, "..") || strings.HasPrefix(relPath, string(filepath.Separator)) {
-		return nil, "", fmt.Errorf("access denied: %s is outside of the allowed directory", filename)
+		return nil, "", err
 	}
 
 	// Check if the file exists
@@ -291,8 +683,28 @@ func init() {
 
 	promptCmd.PersistentFlags().StringP("image", "i", "", "path to image")
 	promptCmd.PersistentFlags().Bool("no-stream", false, "return the full response once it has completed")
+	promptCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	promptCmd.PersistentFlags().Bool("dry-run", false, "print the request that would be sent to Bedrock without sending it")
+	promptCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr")
+	promptCmd.PersistentFlags().StringP("output", "o", outputText, "output format: text, json or ndjson")
+	promptCmd.PersistentFlags().String("json-schema", "", "path to a JSON schema the response must match")
+	promptCmd.PersistentFlags().Int("json-schema-retries", 2, "number of times to retry when the response does not match the schema")
+	promptCmd.PersistentFlags().String("chunking", "", "split a document on stdin that is too big for the model: map-reduce or refine")
+	promptCmd.PersistentFlags().Int("chunk-tokens", 0, "size of each chunk in tokens (default fits the model's context window)")
+	promptCmd.PersistentFlags().Int("chunk-concurrency", 4, "number of chunks to send at once with map-reduce")
+	promptCmd.PersistentFlags().String("tools", "", "path to a YAML file of local tools the model can call")
+	promptCmd.PersistentFlags().StringArray("mcp", nil, "start this MCP server from the config file and let the model call its tools (can be repeated)")
+	promptCmd.PersistentFlags().StringArray("mcp-resource", nil, "attach a resource from an MCP server, given as server:uri (can be repeated)")
+	promptCmd.PersistentFlags().Int("max-tool-iterations", 10, "stop if the model is still calling tools after this many rounds")
 
 	promptCmd.PersistentFlags().Float32("temperature", 1.0, "temperature setting")
 	promptCmd.PersistentFlags().Float32("topP", 0.999, "topP setting")
 	promptCmd.PersistentFlags().Int32("max-tokens", 500, "max tokens")
+	promptCmd.PersistentFlags().String("prefill", "", "start the assistant's response with this text")
+	promptCmd.PersistentFlags().StringArray("stop", nil, "stop generating when this sequence is produced (can be repeated)")
+	promptCmd.PersistentFlags().StringArray("param", nil, "set a model-specific request field as key=value (can be repeated)")
+	promptCmd.PersistentFlags().String("params-file", "", "path to a JSON file of model-specific request fields")
+	promptCmd.PersistentFlags().StringArray("response-field", nil, "JSON pointer of a model-specific response field to return (can be repeated)")
+	promptCmd.PersistentFlags().Int32("thinking-budget", 0, "enable extended thinking with this many tokens")
+	promptCmd.PersistentFlags().Int("auto-continue", 0, "continue a response cut off by max tokens up to this many times")
 }
@@ -0,0 +1,360 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/settings"
+	"github.com/spf13/cobra"
+)
+
+// callPolicy retries calls to Bedrock that fail with throttling or
+// transient errors, with exponential backoff and full jitter, and gives up
+// on calls that take too long
+type callPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+
+	timeout           time.Duration
+	firstTokenTimeout time.Duration
+}
+
+// timeoutError is the cause of a call being cancelled for taking too long.
+// It matches context.DeadlineExceeded so callers can tell it apart from a
+// user cancel.
+type timeoutError struct {
+	msg string
+}
+
+func (e timeoutError) Error() string { return e.msg }
+func (e timeoutError) Unwrap() error { return context.DeadlineExceeded }
+
+// noRetryError marks an error that must not be retried even if it would
+// otherwise be retryable
+type noRetryError struct {
+	err error
+}
+
+func (e noRetryError) Error() string { return e.err.Error() }
+func (e noRetryError) Unwrap() error { return e.err }
+
+// getCallPolicy reads the retry policy from the config file, overridden
+// by any retry flags set on the command line, along with the timeouts
+func getCallPolicy(cmd *cobra.Command) (callPolicy, error) {
+
+	flags := cmd.Root().PersistentFlags()
+
+	p := callPolicy{}
+	var err error
+
+	p.maxRetries, err = flags.GetInt("max-retries")
+	if err != nil {
+		return p, err
+	}
+
+	p.baseDelay, err = flags.GetDuration("retry-base-delay")
+	if err != nil {
+		return p, err
+	}
+
+	p.maxDelay, err = flags.GetDuration("retry-max-delay")
+	if err != nil {
+		return p, err
+	}
+
+	p.timeout, err = flags.GetDuration("timeout")
+	if err != nil {
+		return p, err
+	}
+
+	p.firstTokenTimeout, err = flags.GetDuration("first-token-timeout")
+	if err != nil {
+		return p, err
+	}
+
+	s, err := settings.Load()
+	if err != nil {
+		return p, err
+	}
+
+	if s.Retry.MaxRetries != nil && !flags.Changed("max-retries") {
+		p.maxRetries = *s.Retry.MaxRetries
+	}
+	if s.Retry.BaseDelay > 0 && !flags.Changed("retry-base-delay") {
+		p.baseDelay = time.Duration(s.Retry.BaseDelay)
+	}
+	if s.Retry.MaxDelay > 0 && !flags.Changed("retry-max-delay") {
+		p.maxDelay = time.Duration(s.Retry.MaxDelay)
+	}
+
+	if p.maxRetries < 0 {
+		return p, errorf(kindUsage, "--max-retries can't be negative")
+	}
+	if p.baseDelay < 0 || p.maxDelay < 0 {
+		return p, errorf(kindUsage, "--retry-base-delay and --retry-max-delay can't be negative")
+	}
+	if p.maxDelay < p.baseDelay {
+		return p, errorf(kindUsage, "--retry-max-delay must be at least --retry-base-delay")
+	}
+
+	return p, nil
+}
+
+// withTimeout returns a context that is cancelled once the call has taken
+// longer than the timeout, retries included
+func (p callPolicy) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, p.timeout, timeoutError{
+		msg: fmt.Sprintf("request timed out after %s", p.timeout),
+	})
+}
+
+// do calls op until it succeeds, fails with an error that can't be retried
+// or runs out of retries. If ctx is done, the reason it was cancelled is
+// returned instead of whatever error the SDK wrapped it in.
+func (p callPolicy) do(ctx context.Context, op func() error) error {
+
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err != nil && ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if err == nil || attempt >= p.maxRetries || !isRetryable(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt, err)
+		log.Printf("%v. retrying in %s (%d of %d)", err, delay.Round(time.Millisecond), attempt+1, p.maxRetries)
+		tracer.DebugContext(ctx, "retrying", "attempt", attempt+1, "max_retries", p.maxRetries, "delay", delay, "error", err.Error())
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// backoff returns how long to wait before the next attempt. Throttling
+// errors wait at least the base delay, since retrying sooner is likely to
+// be throttled again.
+func (p callPolicy) backoff(attempt int, err error) time.Duration {
+
+	ceiling := p.baseDelay << attempt
+	if ceiling > p.maxDelay || ceiling <= 0 {
+		ceiling = p.maxDelay
+	}
+
+	delay := time.Duration(rand.Int64N(int64(ceiling) + 1))
+
+	var throttling *types.ThrottlingException
+	if errors.As(err, &throttling) && delay < p.baseDelay {
+		delay = p.baseDelay
+	}
+
+	return delay
+}
+
+// isRetryable reports whether an error is worth retrying
+func isRetryable(err error) bool {
+
+	var noRetry noRetryError
+	if errors.As(err, &noRetry) {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var (
+		throttling     *types.ThrottlingException
+		unavailable    *types.ServiceUnavailableException
+		internal       *types.InternalServerException
+		notReady       *types.ModelNotReadyException
+		modelTimeout   *types.ModelTimeoutException
+		modelStreamErr *types.ModelStreamErrorException
+	)
+
+	switch {
+	case errors.As(err, &throttling),
+		errors.As(err, &unavailable),
+		errors.As(err, &internal),
+		errors.As(err, &notReady),
+		errors.As(err, &modelTimeout),
+		errors.As(err, &modelStreamErr):
+		return true
+	}
+
+	// connection resets, timeouts and 5xx responses
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// converse calls Converse with retries
+func (p callPolicy) converse(ctx context.Context, svc *bedrockruntime.Client, input *bedrockruntime.ConverseInput) (*bedrockruntime.ConverseOutput, error) {
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var output *bedrockruntime.ConverseOutput
+
+	err := p.do(ctx, func() error {
+		var err error
+		output, err = svc.Converse(ctx, input)
+		return err
+	})
+
+	return output, err
+}
+
+// converseStream calls ConverseStream and processes the stream with
+// retries. Once any event has been passed on to the handler, the call is
+// no longer retried so output is never written twice. An attempt that
+// sends no content within the first token timeout is cancelled.
+func (p callPolicy) converseStream(ctx context.Context, svc *bedrockruntime.Client, input *bedrockruntime.ConverseStreamInput, handler StreamHandler) (streamingResult, error) {
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var result streamingResult
+	h := &retryStreamHandler{StreamHandler: handler}
+
+	err := p.do(ctx, func() error {
+		attemptCtx, cancelAttempt := context.WithCancelCause(ctx)
+		defer cancelAttempt(nil)
+
+		if p.firstTokenTimeout > 0 && !h.emitted {
+			h.firstToken = time.AfterFunc(p.firstTokenTimeout, func() {
+				cancelAttempt(timeoutError{
+					msg: fmt.Sprintf("no response within %s", p.firstTokenTimeout),
+				})
+			})
+			defer h.firstToken.Stop()
+		}
+
+		output, err := svc.ConverseStream(attemptCtx, input)
+		if err == nil {
+			result, err = processStreamingOutput(attemptCtx, output, h)
+		}
+
+		if err != nil && attemptCtx.Err() != nil {
+			err = context.Cause(attemptCtx)
+		}
+		if err != nil && h.emitted {
+			return noRetryError{err}
+		}
+		return err
+	})
+
+	if err == nil {
+		attrs := []any{"stop_reason", result.StopReason}
+		if result.Metrics != nil {
+			attrs = append(attrs, "latency_ms", aws.ToInt64(result.Metrics.LatencyMs))
+		}
+		attrs = append(attrs, usageAttrs(result.Usage)...)
+		if g := newGuardrailOutput(guardrailStreamTrace(result.Trace), result.StopReason); g != nil {
+			attrs = append(attrs, "guardrail", g)
+		}
+		tracer.DebugContext(ctx, "stream done", attrs...)
+	} else {
+		tracer.DebugContext(ctx, "stream failed", "error", err.Error())
+	}
+
+	return result, err
+}
+
+// invokeModel calls InvokeModel with retries
+func (p callPolicy) invokeModel(ctx context.Context, svc *bedrockruntime.Client, input *bedrockruntime.InvokeModelInput) (*bedrockruntime.InvokeModelOutput, error) {
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var output *bedrockruntime.InvokeModelOutput
+
+	err := p.do(ctx, func() error {
+		var err error
+		output, err = svc.InvokeModel(ctx, input)
+		return err
+	})
+
+	return output, err
+}
+
+// retryStreamHandler records whether any event has been passed on to the
+// wrapped handler. The message start event is held back until the first
+// content arrives, so a stream that fails straight away can be retried.
+// The first token timer is stopped once content arrives.
+type retryStreamHandler struct {
+	StreamHandler
+	start      *types.MessageStartEvent
+	emitted    bool
+	firstToken *time.Timer
+}
+
+func (h *retryStreamHandler) flush(ctx context.Context) error {
+	h.emitted = true
+	if h.firstToken != nil {
+		h.firstToken.Stop()
+		h.firstToken = nil
+	}
+	if h.start != nil {
+		start := *h.start
+		h.start = nil
+		return h.StreamHandler.OnMessageStart(ctx, start)
+	}
+	return nil
+}
+
+func (h *retryStreamHandler) OnMessageStart(ctx context.Context, event types.MessageStartEvent) error {
+	h.start = &event
+	return nil
+}
+
+func (h *retryStreamHandler) OnContentBlockStart(ctx context.Context, event types.ContentBlockStartEvent) error {
+	if err := h.flush(ctx); err != nil {
+		return err
+	}
+	return h.StreamHandler.OnContentBlockStart(ctx, event)
+}
+
+func (h *retryStreamHandler) OnContentBlockDelta(ctx context.Context, event types.ContentBlockDeltaEvent) error {
+	if err := h.flush(ctx); err != nil {
+		return err
+	}
+	return h.StreamHandler.OnContentBlockDelta(ctx, event)
+}
+
+func (h *retryStreamHandler) OnContentBlockStop(ctx context.Context, event types.ContentBlockStopEvent) error {
+	if err := h.flush(ctx); err != nil {
+		return err
+	}
+	return h.StreamHandler.OnContentBlockStop(ctx, event)
+}
+
+func (h *retryStreamHandler) OnMessageStop(ctx context.Context, event types.MessageStopEvent) error {
+	if err := h.flush(ctx); err != nil {
+		return err
+	}
+	return h.StreamHandler.OnMessageStop(ctx, event)
+}
+
+func (h *retryStreamHandler) OnMetadata(ctx context.Context, event types.ConverseStreamMetadataEvent) error {
+	if err := h.flush(ctx); err != nil {
+		return err
+	}
+	return h.StreamHandler.OnMetadata(ctx, event)
+}
@@ -0,0 +1,325 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/spf13/cobra"
+)
+
+// reviewSystemPrompt tells the model what to look for in a diff and how to
+// number its findings
+const reviewSystemPrompt = `You are reviewing a change to a git repository. Each line of the diff has its line number in the new version of the file in front of it. Removed lines have no number.
+
+Look for bugs, security problems, race conditions, missing error handling and changes that break callers. Only report problems in the change or caused by it, not in the unchanged context. Don't report formatting a tool would fix, and don't praise the change.
+
+For each finding give the file as shown after b/ in the diff and the number of the line it is about. For a problem with a removed line, use the number of the line next to it. If there are no problems, return no findings.`
+
+// reviewSchema is the shape of the findings the model returns
+const reviewSchema = `{
+  "type": "object",
+  "properties": {
+    "summary": {
+      "type": "string",
+      "description": "one or two sentences on the change and its overall quality"
+    },
+    "findings": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "file": {"type": "string"},
+          "line": {"type": "integer", "minimum": 1},
+          "severity": {"type": "string", "enum": ["error", "warning", "suggestion"]},
+          "message": {"type": "string"}
+        },
+        "required": ["file", "line", "severity", "message"]
+      }
+    }
+  },
+  "required": ["summary", "findings"]
+}`
+
+// reviewOutput is the review written by --output json
+type reviewOutput struct {
+	Summary  string          `json:"summary"`
+	Findings []reviewFinding `json:"findings"`
+}
+
+type reviewFinding struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// reviewCmd represents the review command
+var reviewCmd = &cobra.Command{
+	Use:   "review [range]",
+	Short: "Review a diff of the git repository",
+	Long: `Sends a diff of the git repository in the current directory to a LLM on
+Amazon Bedrock and prints its findings grouped by file and line, like so:
+
+> chat-cli review main...HEAD
+
+Without a range, the changes in the working tree since the last commit are
+reviewed. The range is anything git diff accepts, such as HEAD~3 or
+main...feature.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if err := checkGitRepo(cmd.Context()); err != nil {
+			return err
+		}
+
+		rev := "HEAD"
+		if len(args) > 0 {
+			rev = args[0]
+		}
+
+		if strings.HasPrefix(rev, "-") {
+			return errorf(kindUsage, "invalid range %q", rev)
+		}
+
+		contextLines, err := cmd.PersistentFlags().GetInt("context")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if contextLines < 0 {
+			return errorf(kindUsage, "--context can't be negative")
+		}
+
+		output, err := cmd.PersistentFlags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if output != outputText && output != outputJSON {
+			return errorf(kindUsage, "invalid output format: %s. please use text or json", output)
+		}
+
+		diff, err := git(cmd.Context(), "diff", "--no-color", "--no-ext-diff", "-U"+strconv.Itoa(contextLines), rev, "--")
+		if err != nil {
+			return withKind(kindUsage, err)
+		}
+
+		if strings.TrimSpace(diff) == "" {
+			return errorf(kindUsage, "no changes to review")
+		}
+
+		modelId, err := cmd.PersistentFlags().GetString("model-id")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// validate model is supported
+		m, err := models.GetModel(modelId)
+		if err != nil {
+			return err
+		}
+
+		if !m.SupportsToolUse {
+			return errorf(kindUnsupportedModel, "model %s does not support tool use, which review needs for its findings. please use a different model", m.ModelID)
+		}
+
+		maxTokens, err := cmd.PersistentFlags().GetInt32("max-tokens")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// apply the guardrail from the flags or the config file
+		guard, err := getGuardrail(cmd)
+		if err != nil {
+			return err
+		}
+
+		schema, err := compileJSONSchema("review.json", []byte(reviewSchema))
+		if err != nil {
+			return err
+		}
+
+		converseInput := &bedrockruntime.ConverseInput{
+			ModelId: aws.String(m.ModelID),
+			System: []types.SystemContentBlock{
+				&types.SystemContentBlockMemberText{
+					Value: reviewSystemPrompt,
+				},
+			},
+			Messages: []types.Message{
+				{
+					Role: types.ConversationRoleUser,
+					Content: []types.ContentBlock{
+						&types.ContentBlockMemberText{
+							Value: "<diff>\n\n" + numberDiff(truncateDiff(diff)) + "\n</diff>",
+						},
+					},
+				},
+			},
+			InferenceConfig: &types.InferenceConfiguration{
+				MaxTokens: &maxTokens,
+			},
+			ToolConfig:      schema.toolConfig(),
+			GuardrailConfig: guard.config(),
+		}
+
+		// print the request instead of sending it
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if dryRun {
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
+			}
+
+			out, err := newConverseDryRun("Converse", region, m, converseInput)
+			if err != nil {
+				return err
+			}
+
+			return printDryRun(os.Stdout, out)
+		}
+
+		force, err := cmd.PersistentFlags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		budget, err := newBudgetGuard(force)
+		if err != nil {
+			return err
+		}
+
+		if err := budget.confirm(cmd.Context(), m.Cost(estimateInputTokens(converseInput), maxTokens)); err != nil {
+			return err
+		}
+
+		// set up connection to AWS
+		svc, err := newBedrockClient(cmd.Context(), cmd)
+		if err != nil {
+			return err
+		}
+
+		retries, err := getCallPolicy(cmd)
+		if err != nil {
+			return err
+		}
+
+		result, usage, err := converseWithJSONSchema(cmd.Context(), svc, retries, converseInput, schema, 2)
+		recordUsage("review", m, usage, showUsage)
+		if err != nil {
+			return err
+		}
+
+		var review reviewOutput
+		if err := json.Unmarshal(result, &review); err != nil {
+			return fmt.Errorf("unable to parse review: %w", err)
+		}
+
+		slices.SortStableFunc(review.Findings, func(a, b reviewFinding) int {
+			if a.File != b.File {
+				return strings.Compare(a.File, b.File)
+			}
+			return a.Line - b.Line
+		})
+
+		if output == outputJSON {
+			if review.Findings == nil {
+				review.Findings = []reviewFinding{}
+			}
+			return writeJSON(os.Stdout, review)
+		}
+
+		printReview(os.Stdout, review)
+
+		return nil
+	},
+}
+
+// numberDiff puts the line number in the new version of the file in front
+// of every added and unchanged line of a unified diff, so findings can
+// point at a line
+func numberDiff(diff string) string {
+
+	var out strings.Builder
+	inHunk := false
+	line := 0
+
+	for _, l := range splitLines(diff) {
+		switch {
+		case strings.HasPrefix(l, "diff --git "):
+			inHunk = false
+		case strings.HasPrefix(l, "@@ "):
+			// @@ -a,b +c,d @@
+			inHunk = true
+			line = 0
+			if fields := strings.Fields(l); len(fields) > 2 {
+				start, _, _ := strings.Cut(strings.TrimPrefix(fields[2], "+"), ",")
+				line, _ = strconv.Atoi(start)
+			}
+		case inHunk && (strings.HasPrefix(l, "+") || strings.HasPrefix(l, " ")):
+			fmt.Fprintf(&out, "%6d\t%s\n", line, l)
+			line++
+			continue
+		case inHunk:
+			fmt.Fprintf(&out, "%6s\t%s\n", "", l)
+			continue
+		}
+
+		out.WriteString(l + "\n")
+	}
+
+	return out.String()
+}
+
+// printReview writes the findings of a review grouped by file, then the
+// summary
+func printReview(w io.Writer, review reviewOutput) {
+
+	for i, f := range review.Findings {
+		if i == 0 || f.File != review.Findings[i-1].File {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintln(w, f.File)
+		}
+		fmt.Fprintf(w, "  %d: %s: %s\n", f.Line, f.Severity, f.Message)
+	}
+
+	if len(review.Findings) == 0 {
+		fmt.Fprintln(w, "no findings")
+	}
+
+	fmt.Fprintf(w, "\n%s\n", review.Summary)
+}
+
+func init() {
+	rootCmd.AddCommand(reviewCmd)
+	reviewCmd.PersistentFlags().StringP("model-id", "m", "us.anthropic.claude-sonnet-4-20250514-v1:0", "set the model id")
+	reviewCmd.PersistentFlags().Int32("max-tokens", 4096, "max tokens of the review")
+	reviewCmd.PersistentFlags().Int("context", 10, "lines of unchanged code to send around each change")
+	reviewCmd.PersistentFlags().StringP("output", "o", outputText, "output format: text or json")
+	reviewCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	reviewCmd.PersistentFlags().Bool("dry-run", false, "print the request that would be sent to Bedrock without sending it")
+	reviewCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr")
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import "testing"
+
+func TestNumberDiff(t *testing.T) {
+
+	tests := []struct {
+		name string
+		diff string
+		want string
+	}{
+		{"empty", "", ""},
+		{
+			"one hunk",
+			"@@ -10,3 +12,4 @@ func a() {\n context\n-removed\n+added\n+added\n context\n",
+			"@@ -10,3 +12,4 @@ func a() {\n" +
+				"    12\t context\n" +
+				"      \t-removed\n" +
+				"    13\t+added\n" +
+				"    14\t+added\n" +
+				"    15\t context\n",
+		},
+		{
+			"start without a count",
+			"@@ -1 +1 @@\n-old\n+new\n",
+			"@@ -1 +1 @@\n      \t-old\n     1\t+new\n",
+		},
+		{
+			"new file",
+			"@@ -0,0 +1,2 @@\n+a\n+b\n\\ No newline at end of file\n",
+			"@@ -0,0 +1,2 @@\n     1\t+a\n     2\t+b\n      \t\\ No newline at end of file\n",
+		},
+		{
+			"several hunks",
+			"@@ -1,1 +1,1 @@\n a\n@@ -50,1 +60,1 @@\n b\n",
+			"@@ -1,1 +1,1 @@\n     1\t a\n@@ -50,1 +60,1 @@\n    60\t b\n",
+		},
+		{
+			"file headers outside hunks",
+			"diff --git a/x b/x\nindex 1..2 100644\n--- a/x\n+++ b/x\n@@ -3 +3 @@\n+x\n" +
+				"diff --git a/y b/y\n--- a/y\n+++ b/y\n@@ -7 +8 @@\n y\n",
+			"diff --git a/x b/x\nindex 1..2 100644\n--- a/x\n+++ b/x\n@@ -3 +3 @@\n     3\t+x\n" +
+				"diff --git a/y b/y\n--- a/y\n+++ b/y\n@@ -7 +8 @@\n     8\t y\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := numberDiff(tt.diff); got != tt.want {
+				t.Errorf("numberDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
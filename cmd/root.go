@@ -4,28 +4,114 @@ Copyright © 2024 Micah Walter
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// started is set once flags and arguments have been validated and the
+// command starts running. Errors returned before then are usage errors.
+var started bool
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "chat-cli",
 	Short: "Chat with LLMs from Amazon Bedrock!",
 	Long:  `This is a command line tool that allows you to chat with LLMs from Amazon Bedrock!`,
 
+	// errors are printed by Execute in the format set by --error-format
+	SilenceErrors: true,
+	SilenceUsage:  true,
+
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		started = true
+
+		errorFormat, err := cmd.Root().PersistentFlags().GetString("error-format")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if errorFormat != outputText && errorFormat != outputJSON {
+			return errorf(kindUsage, "invalid value for --error-format: %s. please use text or json", errorFormat)
+		}
+
+		return setupTracing(cmd)
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	err := rootCmd.Execute()
-	if err != nil {
-		os.Exit(1)
+
+	// cancel the command on ctrl-c or SIGTERM. a second signal exits
+	// straight away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	if err == nil {
+		return
+	}
+
+	if !started {
+		err = withKind(kindUsage, err)
 	}
+
+	os.Exit(printError(cmd, err))
+}
+
+// printError writes an error to stderr in the format set by --error-format
+// and returns the exit code for it
+func printError(cmd *cobra.Command, err error) int {
+
+	kind := errorKindOf(err)
+	code := exitCodes[kind]
+
+	errorFormat, _ := rootCmd.PersistentFlags().GetString("error-format")
+
+	if errorFormat == outputJSON {
+		writeJSON(os.Stderr, errorOutput{
+			Error:     err.Error(),
+			Kind:      string(kind),
+			ExitCode:  code,
+			RequestID: requestIDOf(err),
+		})
+		return code
+	}
+
+	log.Print(err)
+	if kind == kindUsage && cmd != nil {
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", cmd.CommandPath())
+	}
+
+	return code
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringP("region", "r", "us-east-1", "set the AWS region")
+	rootCmd.PersistentFlags().String("error-format", outputText, "format of errors written to stderr: text or json")
+	rootCmd.PersistentFlags().Bool("debug", false, "log every call to Bedrock to stderr")
+	rootCmd.PersistentFlags().String("trace-file", "", "append a JSON log of every call to Bedrock to this file")
+
+	rootCmd.PersistentFlags().Int("max-retries", 3, "retry throttled and transient Bedrock errors this many times")
+	rootCmd.PersistentFlags().Duration("retry-base-delay", time.Second, "base delay between retries")
+	rootCmd.PersistentFlags().Duration("retry-max-delay", 20*time.Second, "maximum delay between retries")
+
+	rootCmd.PersistentFlags().Duration("timeout", 0, "give up on a request to Bedrock after this long, retries included (0 for no limit)")
+	rootCmd.PersistentFlags().Duration("first-token-timeout", 0, "give up on a streaming response if nothing arrives within this long (0 for no limit)")
+
+	rootCmd.PersistentFlags().String("guardrail-id", "", "apply the Bedrock guardrail with this id or ARN to text requests")
+	rootCmd.PersistentFlags().String("guardrail-version", "", "version of the guardrail, e.g. 1 or DRAFT")
+	rootCmd.PersistentFlags().String("guardrail-stream-mode", "", "how the guardrail checks streamed responses: sync or async (default sync)")
 }
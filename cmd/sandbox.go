@@ -0,0 +1,62 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxPath resolves a path inside the working directory. Paths that
+// lead outside of it, including through a symlink, are refused.
+func sandboxPath(filename string) (string, error) {
+
+	// Define a base directory for allowed files
+	baseDir, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("unable to get working directory: %w", err)
+	}
+
+	// Clean the filename and create the full path
+	cleanFilename := filepath.Clean(filename)
+	fullPath := filepath.Join(baseDir, cleanFilename)
+
+	// Ensure the full path is within the base directory
+	if !insideDir(baseDir, fullPath) {
+		return "", fmt.Errorf("access denied: %s is outside of the allowed directory", filename)
+	}
+
+	// Ensure it is still within the base directory once symlinks are
+	// followed. Only the part of the path that exists can be followed.
+	realBase, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("unable to get working directory: %w", err)
+	}
+
+	existing, rest := fullPath, ""
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !insideDir(realBase, filepath.Join(real, rest)) {
+				return "", fmt.Errorf("access denied: %s is outside of the allowed directory", filename)
+			}
+			break
+		}
+		if existing == baseDir {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+
+	return fullPath, nil
+}
+
+// insideDir reports whether path is dir or somewhere below it
+func insideDir(dir string, path string) bool {
+	relPath, err := filepath.Rel(dir, path)
+	return err == nil && !strings.HasPrefix(relPath, "..") && !strings.HasPrefix(relPath, string(filepath.Separator))
+}
@@ -0,0 +1,471 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+// shSystemPrompt asks for a single command for the user's system. It is
+// given the operating system, the shell and the working directory.
+const shSystemPrompt = `You turn requests into a single shell command for %s, run by %s in the directory %s.
+
+Give one command that does what was asked. Chain or pipe commands if you need more than one, but don't write a script. Use only tools that come with the operating system unless the request names another. Prefer commands that can be run again safely, and never add sudo unless the request needs it.
+
+Explain briefly what the command does and what each part of it is for.`
+
+// shExplainSystemPrompt asks for a command to be explained
+const shExplainSystemPrompt = `Explain what a shell command does, for %s run by %s. Start with one sentence on what it does as a whole, then go through each part of it: programs, flags, arguments, pipes and redirections. Point out anything that deletes or overwrites data, needs elevated permissions or can't be undone. Reply in plain text without markdown headings.`
+
+// shSchema is the shape of the command the model returns
+const shSchema = `{
+  "type": "object",
+  "properties": {
+    "command": {
+      "type": "string",
+      "description": "the command, on a single line unless a line break is needed"
+    },
+    "explanation": {
+      "type": "string",
+      "description": "what the command does and what each part of it is for"
+    }
+  },
+  "required": ["command", "explanation"]
+}`
+
+// shConfirmation has to be typed to run a command that looks destructive
+const shConfirmation = "run anyway"
+
+// destructivePattern is a kind of command that always needs typed
+// confirmation before it runs
+type destructivePattern struct {
+	re     *regexp.Regexp
+	reason string
+}
+
+// destructivePatterns are checked against every command before it runs,
+// whatever the model said about it
+var destructivePatterns = []destructivePattern{
+	{regexp.MustCompile(`\brm\s+(.*\s)?(-[a-zA-Z]*[rRf]|--recursive|--force)`), "deletes files recursively or without asking"},
+	{regexp.MustCompile(`\bfind\b.*\s(-delete|-exec\s+rm)\b`), "deletes the files it finds"},
+	{regexp.MustCompile(`\b(shred|wipefs|mkfs(\.\w+)?|fdisk|parted)\b`), "erases or formats disks"},
+	{regexp.MustCompile(`\bdd\b.*\bof=`), "writes raw data to a file or device"},
+	{regexp.MustCompile(`>\s*/dev/(sd|hd|nvme|disk|mmcblk)`), "writes over a disk"},
+	{regexp.MustCompile(`\b(shutdown|reboot|halt|poweroff)\b`), "shuts down or restarts the machine"},
+	{regexp.MustCompile(`:\(\)\s*\{`), "defines a fork bomb"},
+	{regexp.MustCompile(`\b(chmod|chown|chgrp)\s+(.*\s)?(-[a-zA-Z]*R|--recursive)`), "changes permissions recursively"},
+	{regexp.MustCompile(`\bgit\s+push\b.*\s(--force|-f\b|--force-with-lease)`), "overwrites remote history"},
+	{regexp.MustCompile(`\bgit\s+(reset\s+--hard|clean\s+(.*\s)?-[a-zA-Z]*f|checkout\s+(.*\s)?--\s+\.)`), "throws away local changes"},
+	{regexp.MustCompile(`\b(sudo|doas|su)(\s|$)`), "runs with elevated permissions"},
+	{regexp.MustCompile(`\b(kill\s+(.*\s)?-(9|KILL)|killall|pkill)\b`), "kills processes"},
+	{regexp.MustCompile(`\b(curl|wget)\b.*\|\s*(sudo\s+)?(ba|z|k|da)?sh\b`), "runs a script downloaded from the internet"},
+	{regexp.MustCompile(`\btruncate\s+(-s|--size)`), "truncates files"},
+	{regexp.MustCompile(`(^|[^>])>\|?\s*[^\s>&|]`), "overwrites a file"},
+	{regexp.MustCompile(`(?i)\b(drop|truncate)\s+(table|database|schema)\b`), "deletes database data"},
+	{regexp.MustCompile(`(?i)\b(del|erase|rd|rmdir)\b.*\s/[sq]\b`), "deletes files recursively or without asking"},
+	{regexp.MustCompile(`(?i)\bRemove-Item\b.*-(Recurse|Force)\b`), "deletes files recursively or without asking"},
+	{regexp.MustCompile(`(?i)\bformat\s+[a-z]:`), "formats a drive"},
+}
+
+// shCommand is the command returned by the model
+type shCommand struct {
+	Command     string `json:"command"`
+	Explanation string `json:"explanation"`
+}
+
+// shCmd represents the sh command
+var shCmd = &cobra.Command{
+	Use:   "sh [request]",
+	Short: "Turn a request into a shell command",
+	Long: `Sends a request to a LLM on Amazon Bedrock and returns a single shell
+command for your system that does it, with an explanation, like so:
+
+> chat-cli sh "find files larger than 1GB modified this week"
+
+You can then run, edit or copy the command. Commands that look destructive
+always have to be confirmed by typing "run anyway". Use --explain to go the
+other way and explain a command:
+
+> chat-cli sh --explain "tar -xzvf archive.tar.gz -C /tmp"`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		explain, err := cmd.PersistentFlags().GetString("explain")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		if (explain == "") == (len(args) == 0) {
+			return errorf(kindUsage, "please give either a request or a command to --explain")
+		}
+
+		modelId, err := cmd.PersistentFlags().GetString("model-id")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// validate model is supported
+		m, err := models.GetModel(modelId)
+		if err != nil {
+			return err
+		}
+
+		maxTokens, err := cmd.PersistentFlags().GetInt32("max-tokens")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		showUsage, err := cmd.PersistentFlags().GetBool("show-usage")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		// apply the guardrail from the flags or the config file
+		guard, err := getGuardrail(cmd)
+		if err != nil {
+			return err
+		}
+
+		dryRun, err := cmd.PersistentFlags().GetBool("dry-run")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		force, err := cmd.PersistentFlags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		shell, _ := userShell()
+
+		if explain != "" {
+			if m.ModelType != "text" || !m.SupportsStreaming {
+				return errorf(kindUnsupportedModel, "model %s does not support streaming text generation. please use a different model", m.ModelID)
+			}
+
+			converseStreamInput := &bedrockruntime.ConverseStreamInput{
+				ModelId: aws.String(m.ModelID),
+				System: []types.SystemContentBlock{
+					&types.SystemContentBlockMemberText{
+						Value: fmt.Sprintf(shExplainSystemPrompt, runtime.GOOS, filepath.Base(shell)),
+					},
+				},
+				Messages: []types.Message{
+					{
+						Role: types.ConversationRoleUser,
+						Content: []types.ContentBlock{
+							&types.ContentBlockMemberText{
+								Value: "<command>\n" + explain + "\n</command>",
+							},
+						},
+					},
+				},
+				InferenceConfig: &types.InferenceConfiguration{
+					MaxTokens: &maxTokens,
+				},
+				GuardrailConfig: guard.streamConfig(),
+			}
+
+			// print the request instead of sending it
+			if dryRun {
+				region, err := getRegion(cmd)
+				if err != nil {
+					return err
+				}
+
+				out, err := newConverseStreamDryRun(region, m, converseStreamInput)
+				if err != nil {
+					return err
+				}
+
+				return printDryRun(os.Stdout, out)
+			}
+
+			budget, err := newBudgetGuard(force)
+			if err != nil {
+				return err
+			}
+
+			estimate := m.Cost(estimateInputTokens(converseInputOf(converseStreamInput)), maxTokens)
+			if err := budget.confirm(cmd.Context(), estimate); err != nil {
+				return err
+			}
+
+			// set up connection to AWS
+			svc, err := newBedrockClient(cmd.Context(), cmd)
+			if err != nil {
+				return err
+			}
+
+			retries, err := getCallPolicy(cmd)
+			if err != nil {
+				return err
+			}
+
+			if reason := destructiveReason(explain); reason != "" {
+				fmt.Fprintf(os.Stderr, "[warning: this command %s]\n", reason)
+			}
+
+			result, err := retries.converseStream(cmd.Context(), svc, converseStreamInput, newReasoningStreamHandler(textStreamHandler{w: os.Stdout}))
+			fmt.Println()
+			recordUsage("sh", m, result.Usage, showUsage)
+			if err != nil {
+				return fmt.Errorf("error from Bedrock, %w", err)
+			}
+
+			printGuardrail(os.Stderr, newGuardrailOutput(guardrailStreamTrace(result.Trace), result.StopReason))
+
+			return stopReasonError(result.StopReason, maxTokens)
+		}
+
+		if !m.SupportsToolUse {
+			return errorf(kindUnsupportedModel, "model %s does not support tool use, which sh needs to return a command. please use a different model", m.ModelID)
+		}
+
+		wd, err := os.Getwd()
+		if err != nil {
+			return fmt.Errorf("unable to get working directory: %w", err)
+		}
+
+		schema, err := compileJSONSchema("sh.json", []byte(shSchema))
+		if err != nil {
+			return err
+		}
+
+		converseInput := &bedrockruntime.ConverseInput{
+			ModelId: aws.String(m.ModelID),
+			System: []types.SystemContentBlock{
+				&types.SystemContentBlockMemberText{
+					Value: fmt.Sprintf(shSystemPrompt, runtime.GOOS, filepath.Base(shell), wd),
+				},
+			},
+			Messages: []types.Message{
+				{
+					Role: types.ConversationRoleUser,
+					Content: []types.ContentBlock{
+						&types.ContentBlockMemberText{
+							Value: args[0],
+						},
+					},
+				},
+			},
+			InferenceConfig: &types.InferenceConfiguration{
+				MaxTokens: &maxTokens,
+			},
+			ToolConfig:      schema.toolConfig(),
+			GuardrailConfig: guard.config(),
+		}
+
+		// print the request instead of sending it
+		if dryRun {
+			region, err := getRegion(cmd)
+			if err != nil {
+				return err
+			}
+
+			out, err := newConverseDryRun("Converse", region, m, converseInput)
+			if err != nil {
+				return err
+			}
+
+			return printDryRun(os.Stdout, out)
+		}
+
+		budget, err := newBudgetGuard(force)
+		if err != nil {
+			return err
+		}
+
+		if err := budget.confirm(cmd.Context(), m.Cost(estimateInputTokens(converseInput), maxTokens)); err != nil {
+			return err
+		}
+
+		// set up connection to AWS
+		svc, err := newBedrockClient(cmd.Context(), cmd)
+		if err != nil {
+			return err
+		}
+
+		retries, err := getCallPolicy(cmd)
+		if err != nil {
+			return err
+		}
+
+		result, usage, err := converseWithJSONSchema(cmd.Context(), svc, retries, converseInput, schema, 2)
+		recordUsage("sh", m, usage, showUsage)
+		if err != nil {
+			return err
+		}
+
+		var sh shCommand
+		if err := json.Unmarshal(result, &sh); err != nil {
+			return fmt.Errorf("unable to parse command: %w", err)
+		}
+
+		sh.Command = strings.TrimSpace(sh.Command)
+		if sh.Command == "" {
+			return errors.New("model did not return a command")
+		}
+
+		// the command goes to stdout on its own, so it can be captured
+		fmt.Fprintf(os.Stderr, "%s\n\n", strings.TrimSpace(sh.Explanation))
+		fmt.Println(sh.Command)
+
+		// only offer to run it when someone is there to answer
+		if !isatty.IsTerminal(os.Stdout.Fd()) && !isatty.IsCygwinTerminal(os.Stdout.Fd()) {
+			return nil
+		}
+
+		return offerShellCommand(cmd.Context(), sh.Command)
+	},
+}
+
+// offerShellCommand asks whether to run, edit or copy a command until one
+// is done or the user quits
+func offerShellCommand(ctx context.Context, command string) error {
+
+	for {
+		if reason := destructiveReason(command); reason != "" {
+			fmt.Fprintf(os.Stderr, "[warning: this command %s]\n", reason)
+		}
+
+		answer, ok := askTerminal(ctx, "\n[r]un, [e]dit, [c]opy or [q]uit? ")
+		if !ok {
+			return nil
+		}
+
+		switch strings.ToLower(answer) {
+		case "r", "run":
+			if reason := destructiveReason(command); reason != "" {
+				typed, _ := askTerminal(ctx, fmt.Sprintf("this command %s. type %q to run it: ", reason, shConfirmation))
+				if typed != shConfirmation {
+					fmt.Fprintln(os.Stderr, "not run")
+					continue
+				}
+			}
+			return runShellCommand(ctx, command)
+
+		case "e", "edit":
+			edited, ok := askTerminal(ctx, "command (empty to keep it): ")
+			if ok && edited != "" {
+				command = edited
+			}
+			fmt.Println(command)
+
+		case "c", "copy":
+			if err := copyToClipboard(ctx, command); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "copied to the clipboard")
+			return nil
+
+		case "q", "quit", "":
+			return nil
+		}
+	}
+}
+
+// discardedOutput matches redirections to /dev/null, which don't overwrite
+// anything
+var discardedOutput = regexp.MustCompile(`&?\d*>>?\s*/dev/null\b`)
+
+// destructiveReason returns why a command needs typed confirmation, or an
+// empty string if it doesn't
+func destructiveReason(command string) string {
+	command = discardedOutput.ReplaceAllString(command, "")
+	for _, p := range destructivePatterns {
+		if p.re.MatchString(command) {
+			return p.reason
+		}
+	}
+	return ""
+}
+
+// userShell returns the user's shell and the arguments that make it run
+// a command
+func userShell() (string, []string) {
+
+	if runtime.GOOS == "windows" {
+		return cmp.Or(os.Getenv("COMSPEC"), "cmd.exe"), []string{"/C"}
+	}
+
+	return cmp.Or(os.Getenv("SHELL"), "/bin/sh"), []string{"-c"}
+}
+
+// runShellCommand runs a command with the user's shell, attached to the
+// terminal
+func runShellCommand(ctx context.Context, command string) error {
+
+	shell, args := userShell()
+
+	c := exec.CommandContext(ctx, shell, append(args, command)...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	err := c.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("command exited with status %d", exitErr.ExitCode())
+	}
+
+	return err
+}
+
+// clipboardCommands copy stdin to the clipboard, in the order they are
+// tried
+var clipboardCommands = [][]string{
+	{"pbcopy"},
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+	{"clip.exe"},
+}
+
+// copyToClipboard copies text with the first clipboard program found
+func copyToClipboard(ctx context.Context, text string) error {
+
+	for _, args := range clipboardCommands {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+
+		c := exec.CommandContext(ctx, args[0], args[1:]...)
+		c.Stdin = strings.NewReader(text)
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("unable to copy to the clipboard: %w", err)
+		}
+		return nil
+	}
+
+	return errors.New("unable to copy to the clipboard: no clipboard program found")
+}
+
+func init() {
+	rootCmd.AddCommand(shCmd)
+	shCmd.PersistentFlags().StringP("model-id", "m", "anthropic.claude-3-haiku-20240307-v1:0", "set the model id")
+	shCmd.PersistentFlags().Int32("max-tokens", 1000, "max tokens of the response")
+	shCmd.PersistentFlags().String("explain", "", "explain this command instead of writing one")
+	shCmd.PersistentFlags().Bool("force", false, "ignore budget limits")
+	shCmd.PersistentFlags().Bool("dry-run", false, "print the request that would be sent to Bedrock without sending it")
+	shCmd.PersistentFlags().Bool("show-usage", false, "print token usage and estimated cost to stderr")
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import "testing"
+
+func TestDestructiveReason(t *testing.T) {
+
+	mustMatch := []string{
+		"rm -rf build",
+		"rm -f notes.txt",
+		"rm --recursive dir",
+		"find . -name '*.tmp' -delete",
+		"find . -exec rm {} \\;",
+		"mkfs.ext4 /dev/sdb1",
+		"dd if=image.iso of=/dev/sdb",
+		"cat image > /dev/sda",
+		"sudo apt-get install jq",
+		"doas reboot",
+		"su",
+		"su -",
+		"echo hi | sudo",
+		"shutdown -h now",
+		":(){ :|:& };:",
+		"chmod -R 777 .",
+		"git push --force origin main",
+		"git push -f",
+		"git reset --hard HEAD~1",
+		"git clean -fd",
+		"kill -9 1234",
+		"pkill node",
+		"curl -fsSL https://example.com/install.sh | sh",
+		"wget -qO- https://example.com/x | sudo bash",
+		"truncate -s 0 app.log",
+		"truncate --size 0 app.log",
+		"psql -c 'DROP TABLE users'",
+		"del /s /q C:\\temp",
+		"Remove-Item -Recurse C:\\temp",
+		"format c:",
+		"echo hello > notes.txt",
+		"echo hello >notes.txt",
+		"sort names.txt > names.txt",
+		"ls 2> errors.log",
+		"ls &> out.log",
+		"echo x >| notes.txt",
+		"echo x > /dev/null > notes.txt",
+	}
+
+	mustNotMatch := []string{
+		"ls -la",
+		"rm notes.txt",
+		"find . -name '*.go'",
+		"git push origin main",
+		"git status",
+		"grep -r sudoers /etc",
+		"echo pseudo",
+		"suspend",
+		"summary report",
+		"truncated-output.sh",
+		"man truncate",
+		"echo hello >> notes.txt",
+		"ls 2>&1 | less",
+		"make > /dev/null",
+		"make >/dev/null 2>&1",
+		"make &> /dev/null",
+		"cat notes.txt",
+		"kill 1234",
+		"curl -o install.sh https://example.com/install.sh",
+	}
+
+	for _, command := range mustMatch {
+		if destructiveReason(command) == "" {
+			t.Errorf("%q was not caught", command)
+		}
+	}
+
+	for _, command := range mustNotMatch {
+		if reason := destructiveReason(command); reason != "" {
+			t.Errorf("%q was caught: %s", command, reason)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// StreamHandler receives the events of a streaming response as they
+// arrive. Returning an error from any method stops processing the stream.
+type StreamHandler interface {
+	OnMessageStart(ctx context.Context, event types.MessageStartEvent) error
+	OnContentBlockStart(ctx context.Context, event types.ContentBlockStartEvent) error
+	OnContentBlockDelta(ctx context.Context, event types.ContentBlockDeltaEvent) error
+	OnContentBlockStop(ctx context.Context, event types.ContentBlockStopEvent) error
+	OnMessageStop(ctx context.Context, event types.MessageStopEvent) error
+	OnMetadata(ctx context.Context, event types.ConverseStreamMetadataEvent) error
+}
+
+// nopStreamHandler ignores every event. Embed it in a handler to only
+// implement the events you need.
+type nopStreamHandler struct{}
+
+func (nopStreamHandler) OnMessageStart(ctx context.Context, event types.MessageStartEvent) error {
+	return nil
+}
+
+func (nopStreamHandler) OnContentBlockStart(ctx context.Context, event types.ContentBlockStartEvent) error {
+	return nil
+}
+
+func (nopStreamHandler) OnContentBlockDelta(ctx context.Context, event types.ContentBlockDeltaEvent) error {
+	return nil
+}
+
+func (nopStreamHandler) OnContentBlockStop(ctx context.Context, event types.ContentBlockStopEvent) error {
+	return nil
+}
+
+func (nopStreamHandler) OnMessageStop(ctx context.Context, event types.MessageStopEvent) error {
+	return nil
+}
+
+func (nopStreamHandler) OnMetadata(ctx context.Context, event types.ConverseStreamMetadataEvent) error {
+	return nil
+}
+
+// textStreamHandler writes text deltas as they arrive
+type textStreamHandler struct {
+	nopStreamHandler
+	w io.Writer
+}
+
+func (h textStreamHandler) OnContentBlockDelta(ctx context.Context, event types.ContentBlockDeltaEvent) error {
+	if v, ok := event.Delta.(*types.ContentBlockDeltaMemberText); ok {
+		_, err := fmt.Fprint(h.w, v.Value)
+		return err
+	}
+	return nil
+}
+
+// continueStreamHandler writes text deltas like textStreamHandler, but holds
+// back whitespace at the end of the text until more text follows. When a
+// response is cut off by the max tokens limit, the whitespace is dropped,
+// since the response is continued without it.
+type continueStreamHandler struct {
+	nopStreamHandler
+	w io.Writer
+
+	pending string
+}
+
+func (h *continueStreamHandler) OnContentBlockDelta(ctx context.Context, event types.ContentBlockDeltaEvent) error {
+	if v, ok := event.Delta.(*types.ContentBlockDeltaMemberText); ok {
+		text := h.pending + v.Value
+		trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+		h.pending = text[len(trimmed):]
+		_, err := fmt.Fprint(h.w, trimmed)
+		return err
+	}
+	return nil
+}
+
+func (h *continueStreamHandler) OnMessageStop(ctx context.Context, event types.MessageStopEvent) error {
+	pending := h.pending
+	h.pending = ""
+	if event.StopReason == types.StopReasonMaxTokens {
+		return nil
+	}
+	_, err := fmt.Fprint(h.w, pending)
+	return err
+}
+
+// ndjsonStreamHandler writes every event as a line of JSON
+type ndjsonStreamHandler struct {
+	w io.Writer
+}
+
+func (h ndjsonStreamHandler) OnMessageStart(ctx context.Context, event types.MessageStartEvent) error {
+	return writeJSON(h.w, newOutputEvent(&types.ConverseStreamOutputMemberMessageStart{Value: event}))
+}
+
+func (h ndjsonStreamHandler) OnContentBlockStart(ctx context.Context, event types.ContentBlockStartEvent) error {
+	return writeJSON(h.w, newOutputEvent(&types.ConverseStreamOutputMemberContentBlockStart{Value: event}))
+}
+
+func (h ndjsonStreamHandler) OnContentBlockDelta(ctx context.Context, event types.ContentBlockDeltaEvent) error {
+	return writeJSON(h.w, newOutputEvent(&types.ConverseStreamOutputMemberContentBlockDelta{Value: event}))
+}
+
+func (h ndjsonStreamHandler) OnContentBlockStop(ctx context.Context, event types.ContentBlockStopEvent) error {
+	return writeJSON(h.w, newOutputEvent(&types.ConverseStreamOutputMemberContentBlockStop{Value: event}))
+}
+
+func (h ndjsonStreamHandler) OnMessageStop(ctx context.Context, event types.MessageStopEvent) error {
+	return writeJSON(h.w, newOutputEvent(&types.ConverseStreamOutputMemberMessageStop{Value: event}))
+}
+
+func (h ndjsonStreamHandler) OnMetadata(ctx context.Context, event types.ConverseStreamMetadataEvent) error {
+	return writeJSON(h.w, newOutputEvent(&types.ConverseStreamOutputMemberMetadata{Value: event}))
+}
+
+// streamingResult holds the message assembled from a stream along with
+// the stop reason and metadata sent at the end of it
+type streamingResult struct {
+	Message                       types.Message
+	StopReason                    types.StopReason
+	AdditionalModelResponseFields document.Interface
+	Usage                         *types.TokenUsage
+	Metrics                       *types.ConverseStreamMetrics
+	Trace                         *types.ConverseStreamTrace
+}
+
+// streamBlock collects the deltas of a single content block
+type streamBlock struct {
+	index int32
+
+	text strings.Builder
+
+	toolUse   bool
+	toolUseID string
+	toolName  string
+	toolInput strings.Builder
+
+	reasoning         bool
+	reasoningText     strings.Builder
+	signature         string
+	redactedReasoning []byte
+}
+
+// contentBlock converts the collected deltas to a content block. It
+// returns nil for a block without any content.
+func (b *streamBlock) contentBlock() (types.ContentBlock, error) {
+
+	switch {
+	case b.toolUse:
+		var input interface{} = map[string]interface{}{}
+		if b.toolInput.Len() > 0 {
+			if err := json.Unmarshal([]byte(b.toolInput.String()), &input); err != nil {
+				return nil, fmt.Errorf("invalid input for tool %s: %w", b.toolName, err)
+			}
+		}
+
+		return &types.ContentBlockMemberToolUse{
+			Value: types.ToolUseBlock{
+				ToolUseId: aws.String(b.toolUseID),
+				Name:      aws.String(b.toolName),
+				Input:     document.NewLazyDocument(input),
+			},
+		}, nil
+
+	case b.reasoning:
+		if b.redactedReasoning != nil {
+			return &types.ContentBlockMemberReasoningContent{
+				Value: &types.ReasoningContentBlockMemberRedactedContent{
+					Value: b.redactedReasoning,
+				},
+			}, nil
+		}
+
+		block := types.ReasoningTextBlock{
+			Text: aws.String(b.reasoningText.String()),
+		}
+		if b.signature != "" {
+			block.Signature = aws.String(b.signature)
+		}
+
+		return &types.ContentBlockMemberReasoningContent{
+			Value: &types.ReasoningContentBlockMemberReasoningText{
+				Value: block,
+			},
+		}, nil
+
+	case b.text.Len() > 0:
+		return &types.ContentBlockMemberText{
+			Value: b.text.String(),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// processStreamingOutput reads every event from a stream, passes it to the
+// handler and assembles the complete message. Errors from the handler and
+// from the stream itself are returned along with whatever was read so far.
+func processStreamingOutput(ctx context.Context, output *bedrockruntime.ConverseStreamOutput, handler StreamHandler) (streamingResult, error) {
+
+	stream := output.GetStream()
+	defer stream.Close()
+
+	result := streamingResult{
+		Message: types.Message{
+			Role: types.ConversationRoleAssistant,
+		},
+	}
+
+	blocks := map[int32]*streamBlock{}
+	block := func(index *int32) *streamBlock {
+		i := aws.ToInt32(index)
+		if blocks[i] == nil {
+			blocks[i] = &streamBlock{index: i}
+		}
+		return blocks[i]
+	}
+
+	var err error
+
+	for event := range stream.Events() {
+		switch v := event.(type) {
+		case *types.ConverseStreamOutputMemberMessageStart:
+
+			result.Message.Role = v.Value.Role
+			err = handler.OnMessageStart(ctx, v.Value)
+
+		case *types.ConverseStreamOutputMemberContentBlockStart:
+
+			b := block(v.Value.ContentBlockIndex)
+			if start, ok := v.Value.Start.(*types.ContentBlockStartMemberToolUse); ok {
+				b.toolUse = true
+				b.toolUseID = aws.ToString(start.Value.ToolUseId)
+				b.toolName = aws.ToString(start.Value.Name)
+			}
+			err = handler.OnContentBlockStart(ctx, v.Value)
+
+		case *types.ConverseStreamOutputMemberContentBlockDelta:
+
+			b := block(v.Value.ContentBlockIndex)
+			switch delta := v.Value.Delta.(type) {
+			case *types.ContentBlockDeltaMemberText:
+				b.text.WriteString(delta.Value)
+			case *types.ContentBlockDeltaMemberToolUse:
+				b.toolUse = true
+				b.toolInput.WriteString(aws.ToString(delta.Value.Input))
+			case *types.ContentBlockDeltaMemberReasoningContent:
+				b.reasoning = true
+				switch r := delta.Value.(type) {
+				case *types.ReasoningContentBlockDeltaMemberText:
+					b.reasoningText.WriteString(r.Value)
+				case *types.ReasoningContentBlockDeltaMemberSignature:
+					b.signature += r.Value
+				case *types.ReasoningContentBlockDeltaMemberRedactedContent:
+					b.redactedReasoning = append(b.redactedReasoning, r.Value...)
+				}
+			}
+			err = handler.OnContentBlockDelta(ctx, v.Value)
+
+		case *types.ConverseStreamOutputMemberContentBlockStop:
+
+			err = handler.OnContentBlockStop(ctx, v.Value)
+
+		case *types.ConverseStreamOutputMemberMessageStop:
+
+			result.StopReason = v.Value.StopReason
+			result.AdditionalModelResponseFields = v.Value.AdditionalModelResponseFields
+			err = handler.OnMessageStop(ctx, v.Value)
+
+		case *types.ConverseStreamOutputMemberMetadata:
+
+			result.Usage = v.Value.Usage
+			result.Metrics = v.Value.Metrics
+			result.Trace = v.Value.Trace
+			err = handler.OnMetadata(ctx, v.Value)
+
+		case *types.UnknownUnionMember:
+			log.Printf("unknown stream event: %s", v.Tag)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// assemble content blocks in the order the model sent them
+	ordered := make([]*streamBlock, 0, len(blocks))
+	for _, b := range blocks {
+		ordered = append(ordered, b)
+	}
+	slices.SortFunc(ordered, func(a, b *streamBlock) int { return int(a.index - b.index) })
+
+	for _, b := range ordered {
+		c, blockErr := b.contentBlock()
+		if blockErr != nil && err == nil {
+			err = blockErr
+		}
+		if c != nil {
+			result.Message.Content = append(result.Message.Content, c)
+		}
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	if err := stream.Err(); err != nil {
+		return result, fmt.Errorf("error reading stream: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+func TestContinueStreamHandler(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		messages [][]string
+		stops    []types.StopReason
+		want     string
+	}{
+		{
+			name:     "whitespace inside the text",
+			messages: [][]string{{"one ", "two", "\n\nthree"}},
+			stops:    []types.StopReason{types.StopReasonEndTurn},
+			want:     "one two\n\nthree",
+		},
+		{
+			name:     "whitespace at the end of a complete response",
+			messages: [][]string{{"one", " two\n"}},
+			stops:    []types.StopReason{types.StopReasonEndTurn},
+			want:     "one two\n",
+		},
+		{
+			name:     "response continued after max tokens",
+			messages: [][]string{{"one", " two "}, {" three"}},
+			stops:    []types.StopReason{types.StopReasonMaxTokens, types.StopReasonEndTurn},
+			want:     "one two three",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var out strings.Builder
+			h := &continueStreamHandler{w: &out}
+			ctx := context.Background()
+
+			for i, deltas := range tt.messages {
+				for _, d := range deltas {
+					h.OnContentBlockDelta(ctx, types.ContentBlockDeltaEvent{
+						Delta: &types.ContentBlockDeltaMemberText{Value: d},
+					})
+				}
+				h.OnMessageStop(ctx, types.MessageStopEvent{StopReason: tt.stops[i]})
+			}
+
+			if out.String() != tt.want {
+				t.Errorf("wrote %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
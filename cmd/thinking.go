@@ -0,0 +1,152 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/mattn/go-isatty"
+)
+
+// minThinkingBudget is the smallest thinking budget the API accepts
+const minThinkingBudget = 1024
+
+// minThinkingTopP is the lowest topP the API accepts with extended thinking
+const minThinkingTopP = 0.95
+
+// thinkingOptions are the other request options that extended thinking
+// has to be checked against
+type thinkingOptions struct {
+	maxTokens    int32
+	temperature  float32
+	topP         float32
+	prefill      string
+	autoContinue int
+}
+
+// enableThinking checks that extended thinking can be used with the model
+// and options, and adds it to the model-specific request fields
+func enableThinking(m models.Model, budget int32, opts thinkingOptions, fields map[string]interface{}) error {
+
+	if !m.SupportsReasoning {
+		return errorf(kindUnsupportedModel, "model %s does not support extended thinking. please use a different model", m.ModelID)
+	}
+
+	if budget < minThinkingBudget {
+		return errorf(kindUsage, "--thinking-budget must be at least %d", minThinkingBudget)
+	}
+
+	if opts.maxTokens <= budget {
+		return errorf(kindUsage, "--max-tokens must be greater than --thinking-budget")
+	}
+
+	if opts.temperature != 1.0 {
+		return errorf(kindUsage, "--temperature can't be changed when extended thinking is enabled")
+	}
+
+	if opts.topP < minThinkingTopP {
+		return errorf(kindUsage, "--topP must be at least %.2f when extended thinking is enabled", minThinkingTopP)
+	}
+
+	if opts.prefill != "" {
+		return errorf(kindUsage, "--prefill can't be used when extended thinking is enabled")
+	}
+
+	if opts.autoContinue > 0 {
+		return errorf(kindUsage, "--auto-continue can't be used when extended thinking is enabled")
+	}
+
+	// model-specific request fields from --param and --params-file
+	if _, ok := fields["thinking"]; ok {
+		return errorf(kindUsage, "thinking can't be set with --param or --params-file. please use --thinking-budget")
+	}
+
+	if _, ok := fields["top_k"]; ok {
+		return errorf(kindUsage, "top_k can't be set when extended thinking is enabled")
+	}
+
+	fields["thinking"] = map[string]interface{}{
+		"type":          "enabled",
+		"budget_tokens": budget,
+	}
+
+	return nil
+}
+
+// reasoningStreamHandler writes reasoning deltas to a separate writer,
+// dimmed when it is a terminal, and passes every event on to the wrapped
+// handler
+type reasoningStreamHandler struct {
+	StreamHandler
+	w   io.Writer
+	dim bool
+
+	reasoning map[int32]bool
+}
+
+func newReasoningStreamHandler(handler StreamHandler) *reasoningStreamHandler {
+	return &reasoningStreamHandler{
+		StreamHandler: handler,
+		w:             os.Stderr,
+		dim:           isatty.IsTerminal(os.Stderr.Fd()),
+		reasoning:     map[int32]bool{},
+	}
+}
+
+func (h *reasoningStreamHandler) OnContentBlockDelta(ctx context.Context, event types.ContentBlockDeltaEvent) error {
+
+	if v, ok := event.Delta.(*types.ContentBlockDeltaMemberReasoningContent); ok {
+		if text, ok := v.Value.(*types.ReasoningContentBlockDeltaMemberText); ok {
+			h.reasoning[aws.ToInt32(event.ContentBlockIndex)] = true
+			if err := writeReasoning(h.w, text.Value, h.dim); err != nil {
+				return err
+			}
+		}
+	}
+
+	return h.StreamHandler.OnContentBlockDelta(ctx, event)
+}
+
+func (h *reasoningStreamHandler) OnContentBlockStop(ctx context.Context, event types.ContentBlockStopEvent) error {
+
+	// end reasoning on its own line before the answer starts
+	if h.reasoning[aws.ToInt32(event.ContentBlockIndex)] {
+		fmt.Fprintln(h.w)
+	}
+
+	return h.StreamHandler.OnContentBlockStop(ctx, event)
+}
+
+// printReasoning writes the reasoning blocks of a complete message to stderr
+func printReasoning(msg types.Message) error {
+
+	dim := isatty.IsTerminal(os.Stderr.Fd())
+
+	for _, block := range msg.Content {
+		if v, ok := block.(*types.ContentBlockMemberReasoningContent); ok {
+			if text, ok := v.Value.(*types.ReasoningContentBlockMemberReasoningText); ok {
+				if err := writeReasoning(os.Stderr, aws.ToString(text.Value.Text)+"\n", dim); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeReasoning(w io.Writer, text string, dim bool) error {
+	if dim {
+		_, err := fmt.Fprintf(w, "\x1b[2m%s\x1b[0m", text)
+		return err
+	}
+	_, err := fmt.Fprint(w, text)
+	return err
+}
@@ -0,0 +1,383 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// maxToolOutput is the most output from a tool that is sent back to the
+// model
+const maxToolOutput = 100 * 1024
+
+// maxToolInputShown is how much of a tool's input is shown when it is
+// called
+const maxToolInputShown = 200
+
+// tool is something the model can call
+type tool interface {
+	// spec describes the tool to the model
+	spec() types.ToolSpecification
+
+	// call runs the tool with its JSON input and returns the result for
+	// the model. An error is sent back to the model as a failed call.
+	call(ctx context.Context, input []byte) (string, error)
+}
+
+// errDeclined is returned by a tool the user chose not to run
+var errDeclined = errors.New("the user declined to run this tool")
+
+// toolsFile is the format of the file passed to --tools
+type toolsFile struct {
+	Tools []localTool `yaml:"tools"`
+}
+
+// localTool is a tool the model can call, backed by a local command. The
+// command is run with sh -c, gets the tool input as JSON on stdin and
+// returns its result on stdout.
+type localTool struct {
+	Name        string                 `yaml:"name"`
+	Description string                 `yaml:"description"`
+	InputSchema map[string]interface{} `yaml:"input_schema"`
+	Command     string                 `yaml:"command"`
+	Timeout     time.Duration          `yaml:"timeout"`
+
+	// Confirm asks before every call of the tool. It defaults to true.
+	Confirm *bool `yaml:"confirm"`
+}
+
+// toolSet runs the tools the model asks for and sends their results back
+// until the model is done
+type toolSet struct {
+	tools         []tool
+	maxIterations int
+}
+
+// readTools reads the tools defined in a YAML file
+func readTools(filename string) ([]tool, error) {
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var f toolsFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	if len(f.Tools) == 0 {
+		return nil, errors.New("no tools defined")
+	}
+
+	seen := map[string]bool{}
+	for i, t := range f.Tools {
+		if t.Name == "" {
+			return nil, fmt.Errorf("tool %d has no name", i+1)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("tool %s is defined more than once", t.Name)
+		}
+		seen[t.Name] = true
+
+		if t.Command == "" {
+			return nil, fmt.Errorf("tool %s has no command", t.Name)
+		}
+		if t.InputSchema == nil {
+			f.Tools[i].InputSchema = map[string]interface{}{"type": "object"}
+		}
+	}
+
+	tools := make([]tool, len(f.Tools))
+	for i, t := range f.Tools {
+		tools[i] = t
+	}
+
+	return tools, nil
+}
+
+// getToolSet reads the tools set with --tools and adds the extra tools,
+// like those of MCP servers. It returns nil if there are none.
+func getToolSet(cmd *cobra.Command, m models.Model, extra []tool) (*toolSet, error) {
+
+	filename, err := cmd.PersistentFlags().GetString("tools")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	maxIterations, err := cmd.PersistentFlags().GetInt("max-tool-iterations")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	if filename == "" && len(extra) == 0 {
+		return nil, nil
+	}
+
+	if !m.SupportsToolUse {
+		return nil, errorf(kindUnsupportedModel, "model %s does not support tool use so it can't be used with --tools", m.ModelID)
+	}
+
+	if maxIterations < 1 {
+		return nil, errorf(kindUsage, "--max-tool-iterations must be at least 1")
+	}
+
+	var tools []tool
+	if filename != "" {
+		tools, err = readTools(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tools: %w", err)
+		}
+	}
+
+	tools = append(tools, extra...)
+
+	seen := map[string]bool{}
+	for _, t := range tools {
+		name := aws.ToString(t.spec().Name)
+		if seen[name] {
+			return nil, errorf(kindUsage, "there is more than one tool named %s", name)
+		}
+		seen[name] = true
+	}
+
+	return &toolSet{
+		tools:         tools,
+		maxIterations: maxIterations,
+	}, nil
+}
+
+// toolConfig returns the tool config that tells the model about the
+// tools, or nil if there are none
+func (s *toolSet) toolConfig() *types.ToolConfiguration {
+
+	if s == nil {
+		return nil
+	}
+
+	conf := &types.ToolConfiguration{}
+
+	for _, t := range s.tools {
+		conf.Tools = append(conf.Tools, &types.ToolMemberToolSpec{
+			Value: t.spec(),
+		})
+	}
+
+	return conf
+}
+
+// send wraps a converseFunc so that the tools the model asks for are run.
+// If added is set, the tool calls and results are appended to it. Without
+// any tools, send is returned as it is.
+func (s *toolSet) send(ctx context.Context, send converseFunc, added *[]types.Message) converseFunc {
+
+	if s == nil {
+		return send
+	}
+
+	return func(msgs []types.Message) (converseTurn, error) {
+		turn, msgs, err := s.converse(ctx, msgs, send)
+		if added != nil {
+			*added = append(*added, msgs...)
+		}
+		return turn, err
+	}
+}
+
+// converse sends a conversation and, while the model asks for tools, runs
+// them and sends their results back, up to maxIterations times. It returns
+// the final response along with the tool calls and results added to the
+// conversation on the way. Usage is the total of every call.
+func (s *toolSet) converse(ctx context.Context, msgs []types.Message, send converseFunc) (converseTurn, []types.Message, error) {
+
+	msgs = slices.Clone(msgs)
+
+	var added []types.Message
+	var usage *types.TokenUsage
+	var guard *guardrailOutput
+
+	for i := 0; ; i++ {
+		turn, err := send(msgs)
+
+		usage = addUsage(usage, turn.Usage)
+		guard = addGuardrail(guard, turn.Guardrail)
+		turn.Usage = usage
+		turn.Guardrail = guard
+
+		if err != nil || turn.StopReason != types.StopReasonToolUse {
+			return turn, added, err
+		}
+
+		if i >= s.maxIterations {
+			return turn, added, fmt.Errorf("model was still calling tools after %d iterations. use --max-tool-iterations to allow more", s.maxIterations)
+		}
+
+		results, err := s.run(ctx, turn.Message)
+		if err != nil {
+			return turn, added, err
+		}
+
+		added = append(added, turn.Message, results)
+		msgs = append(msgs, turn.Message, results)
+	}
+}
+
+// run calls every tool the model asked for in a message and returns the
+// results as a user message
+func (s *toolSet) run(ctx context.Context, msg types.Message) (types.Message, error) {
+
+	results := types.Message{
+		Role: types.ConversationRoleUser,
+	}
+
+	for _, block := range msg.Content {
+		toolUse, ok := block.(*types.ContentBlockMemberToolUse)
+		if !ok {
+			continue
+		}
+
+		result, err := s.call(ctx, toolUse.Value)
+		if err != nil {
+			return results, err
+		}
+
+		results.Content = append(results.Content, &types.ContentBlockMemberToolResult{
+			Value: result,
+		})
+	}
+
+	return results, nil
+}
+
+// call runs a single tool. Failures of the tool itself are sent back to the
+// model as an error result. Only a cancelled command is returned as an
+// error.
+func (s *toolSet) call(ctx context.Context, toolUse types.ToolUseBlock) (types.ToolResultBlock, error) {
+
+	name := aws.ToString(toolUse.Name)
+
+	input := []byte("{}")
+	if toolUse.Input != nil {
+		b, err := toolUse.Input.MarshalSmithyDocument()
+		if err != nil {
+			return toolError(toolUse, fmt.Sprintf("invalid input: %v", err)), nil
+		}
+		input = b
+	}
+
+	i := slices.IndexFunc(s.tools, func(t tool) bool { return aws.ToString(t.spec().Name) == name })
+	if i < 0 {
+		return toolError(toolUse, fmt.Sprintf("there is no tool named %s", name)), nil
+	}
+
+	shown := string(input)
+	if len(shown) > maxToolInputShown {
+		shown = shown[:maxToolInputShown] + "..."
+	}
+	fmt.Fprintf(os.Stderr, "\n[tool %s %s]\n", name, shown)
+
+	output, err := s.tools[i].call(ctx, input)
+	if ctx.Err() != nil {
+		return types.ToolResultBlock{}, context.Cause(ctx)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[tool %s failed: %v]\n", name, err)
+		return toolError(toolUse, truncateToolOutput(err.Error())), nil
+	}
+
+	// the API rejects an empty text block
+	if strings.TrimSpace(output) == "" {
+		output = "(no output)"
+	}
+
+	return types.ToolResultBlock{
+		ToolUseId: toolUse.ToolUseId,
+		Content: []types.ToolResultContentBlock{
+			&types.ToolResultContentBlockMemberText{
+				Value: truncateToolOutput(output),
+			},
+		},
+	}, nil
+}
+
+func (t localTool) spec() types.ToolSpecification {
+	return types.ToolSpecification{
+		Name:        aws.String(t.Name),
+		Description: aws.String(t.Description),
+		InputSchema: &types.ToolInputSchemaMemberJson{
+			Value: document.NewLazyDocument(t.InputSchema),
+		},
+	}
+}
+
+// call runs the command of the tool, asking first unless confirm is off
+func (t localTool) call(ctx context.Context, input []byte) (string, error) {
+
+	if t.Confirm == nil || *t.Confirm {
+		if !confirm(ctx, fmt.Sprintf("run tool %s?", t.Name)) {
+			return "", errDeclined
+		}
+	}
+
+	runCtx := ctx
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(runCtx, "sh", "-c", t.Command)
+	c.Stdin = bytes.NewReader(input)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	if err := c.Run(); err != nil {
+		if runCtx.Err() != nil {
+			return "", fmt.Errorf("timed out after %s", t.Timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.New(msg)
+		}
+		return "", err
+	}
+
+	return stdout.String(), nil
+}
+
+// toolError returns a result that tells the model a tool call failed
+func toolError(toolUse types.ToolUseBlock, msg string) types.ToolResultBlock {
+	return types.ToolResultBlock{
+		ToolUseId: toolUse.ToolUseId,
+		Status:    types.ToolResultStatusError,
+		Content: []types.ToolResultContentBlock{
+			&types.ToolResultContentBlockMemberText{
+				Value: msg,
+			},
+		},
+	}
+}
+
+// truncateToolOutput keeps a tool from filling up the context window
+func truncateToolOutput(s string) string {
+	if len(s) <= maxToolOutput {
+		return s
+	}
+	return s[:maxToolOutput] + fmt.Sprintf("\n[output truncated from %d bytes]", len(s))
+}
@@ -0,0 +1,247 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/spf13/cobra"
+)
+
+// tracer records calls to Bedrock when --debug or --trace-file is set. It
+// discards everything otherwise.
+var tracer = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError}))
+
+// redactedHeaders are never written to a trace since they hold credentials
+var redactedHeaders = []string{
+	"Authorization",
+	"X-Amz-Security-Token",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// setupTracing points the tracer at stderr for --debug and at a file of
+// JSON lines for --trace-file
+func setupTracing(cmd *cobra.Command) error {
+
+	flags := cmd.Root().PersistentFlags()
+
+	debug, err := flags.GetBool("debug")
+	if err != nil {
+		return fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	traceFile, err := flags.GetString("trace-file")
+	if err != nil {
+		return fmt.Errorf("unable to get flag: %w", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var handlers teeHandler
+	if debug {
+		handlers = append(handlers, slog.NewTextHandler(os.Stderr, opts))
+	}
+	if traceFile != "" {
+		// traces hold prompts and responses, so only the user can read them
+		f, err := os.OpenFile(traceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("unable to open trace file: %w", err)
+		}
+		handlers = append(handlers, slog.NewJSONHandler(f, opts))
+	}
+
+	if len(handlers) > 0 {
+		tracer = slog.New(handlers).With("command", cmd.Name())
+	}
+
+	return nil
+}
+
+// tracing reports whether calls are being recorded
+func tracing() bool {
+	return tracer.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// addTraceMiddleware records every call made by a Bedrock client: its
+// parameters, the HTTP exchange, the request id and how long it took
+func addTraceMiddleware(stack *middleware.Stack) error {
+
+	err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("TraceCall",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+
+			operation := middleware.GetOperationName(ctx)
+			tracer.DebugContext(ctx, "bedrock call", "operation", operation, "params", traceParams(in.Parameters))
+
+			start := time.Now()
+			out, metadata, err := next.HandleInitialize(ctx, in)
+
+			requestID, ok := awsmiddleware.GetRequestIDMetadata(metadata)
+			if !ok {
+				requestID = requestIDOf(err)
+			}
+
+			attrs := []any{
+				"operation", operation,
+				"request_id", requestID,
+				"duration", time.Since(start),
+			}
+			if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+				attrs = append(attrs, "status", resp.StatusCode)
+			}
+
+			if err != nil {
+				tracer.DebugContext(ctx, "bedrock call failed", append(attrs, "error", err.Error())...)
+				return out, metadata, err
+			}
+
+			if output, ok := out.Result.(*bedrockruntime.ConverseOutput); ok {
+				attrs = append(attrs, "stop_reason", output.StopReason)
+				attrs = append(attrs, usageAttrs(output.Usage)...)
+				if g := newGuardrailOutput(guardrailTrace(output.Trace), output.StopReason); g != nil {
+					attrs = append(attrs, "guardrail", g)
+				}
+			}
+			tracer.DebugContext(ctx, "bedrock call done", attrs...)
+
+			return out, metadata, err
+		}), middleware.After)
+	if err != nil {
+		return err
+	}
+
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("TraceHTTP",
+		func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+
+			if req, ok := in.Request.(*smithyhttp.Request); ok {
+				tracer.DebugContext(ctx, "http request",
+					"method", req.Method,
+					"url", req.URL.String(),
+					"headers", redactHeaders(req.Header))
+			}
+
+			start := time.Now()
+			out, metadata, err := next.HandleDeserialize(ctx, in)
+
+			if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+				tracer.DebugContext(ctx, "http response",
+					"status", resp.StatusCode,
+					"request_id", resp.Header.Get("X-Amzn-Requestid"),
+					"duration", time.Since(start),
+					"headers", redactHeaders(resp.Header))
+			}
+
+			return out, metadata, err
+		}), middleware.After)
+}
+
+// traceParams converts the parameters of a call to JSON in the form
+// Bedrock receives them, with images left out
+func traceParams(params interface{}) json.RawMessage {
+
+	var v interface{}
+	var err error
+
+	switch p := params.(type) {
+	case *bedrockruntime.ConverseInput:
+		v, err = converseRequestJSON(p)
+	case *bedrockruntime.ConverseStreamInput:
+		v, err = converseStreamRequestJSON(p)
+	case *bedrockruntime.InvokeModelInput:
+		var body interface{}
+		if json.Unmarshal(p.Body, &body) != nil {
+			body = bytesSummary(len(p.Body))
+		}
+		v = map[string]interface{}{
+			"modelId": p.ModelId,
+			"body":    summarizeBase64(body),
+		}
+	default:
+		v = fmt.Sprintf("%T", params)
+	}
+
+	if err != nil {
+		v = err.Error()
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage(fmt.Sprintf("%q", err.Error()))
+	}
+	return b
+}
+
+// usageAttrs returns token usage as log attributes
+func usageAttrs(usage *types.TokenUsage) []any {
+	if usage == nil {
+		return nil
+	}
+	return []any{
+		"input_tokens", aws.ToInt32(usage.InputTokens),
+		"output_tokens", aws.ToInt32(usage.OutputTokens),
+	}
+}
+
+// redactHeaders returns a copy of the headers with credentials removed
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, "REDACTED")
+		}
+	}
+	return h
+}
+
+// teeHandler sends every record to each of its handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
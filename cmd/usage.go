@@ -0,0 +1,206 @@
+/*
+Copyright © 2024 Micah Walter
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/go-micah/chat-cli/ledger"
+	"github.com/go-micah/chat-cli/models"
+	"github.com/spf13/cobra"
+)
+
+// usageCmd represents the usage command
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Show token usage and cost",
+	Long: `Every call to Amazon Bedrock is recorded in a local usage ledger. Use the
+subcommands of usage to summarize it.`,
+}
+
+// usageReportCmd represents the usage report command
+var usageReportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Summarize token usage and cost",
+	Long: `Summarize the local usage ledger like so:
+
+> chat-cli usage report --since 30d --by model
+
+Costs are estimates based on on-demand pricing and may differ from your bill.`,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		sinceFlag, err := cmd.Flags().GetString("since")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		since, err := parseSince(sinceFlag)
+		if err != nil {
+			return err
+		}
+
+		by, err := cmd.Flags().GetString("by")
+		if err != nil {
+			return fmt.Errorf("unable to get flag: %w", err)
+		}
+
+		var key func(e ledger.Entry) string
+		switch by {
+		case "model":
+			key = func(e ledger.Entry) string { return e.ModelID }
+		case "command":
+			key = func(e ledger.Entry) string { return e.Command }
+		case "day":
+			key = func(e ledger.Entry) string { return e.Time.Local().Format(time.DateOnly) }
+		default:
+			return errorf(kindUsage, "invalid value for --by: %s. please use model, command or day", by)
+		}
+
+		entries, err := ledger.Read(since)
+		if err != nil {
+			return fmt.Errorf("unable to read usage ledger: %w", err)
+		}
+
+		type row struct {
+			calls, images int
+			input, output int64
+			cost          float64
+		}
+
+		rows := map[string]*row{}
+		total := &row{}
+		for _, e := range entries {
+			k := key(e)
+			if rows[k] == nil {
+				rows[k] = &row{}
+			}
+			for _, r := range []*row{rows[k], total} {
+				r.calls++
+				r.images += e.Images
+				r.input += int64(e.InputTokens)
+				r.output += int64(e.OutputTokens)
+				r.cost += e.Cost
+			}
+		}
+
+		keys := make([]string, 0, len(rows))
+		for k := range rows {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(w, "%s\tCALLS\tINPUT TOKENS\tOUTPUT TOKENS\tIMAGES\tCOST\t\n", strings.ToUpper(by))
+		for _, k := range keys {
+			r := rows[k]
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t$%.4f\t\n", k, r.calls, r.input, r.output, r.images, r.cost)
+		}
+		fmt.Fprintf(w, "TOTAL\t%d\t%d\t%d\t%d\t$%.4f\t\n", total.calls, total.input, total.output, total.images, total.cost)
+		return w.Flush()
+	},
+}
+
+// parseSince turns a duration like 30d or 12h into the time that long ago
+func parseSince(s string) (time.Time, error) {
+
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return time.Time{}, errorf(kindUsage, "invalid duration: %s", s)
+		}
+		return time.Now().AddDate(0, 0, -n), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, errorf(kindUsage, "invalid duration: %s", s)
+	}
+
+	return time.Now().Add(-d), nil
+}
+
+// recordUsage appends the usage of a text generation call to the usage
+// ledger and prints it to stderr if showUsage is set. It returns the
+// estimated cost of the call.
+func recordUsage(command string, m models.Model, usage *types.TokenUsage, showUsage bool) float64 {
+
+	if usage == nil {
+		return 0
+	}
+
+	e := ledger.Entry{
+		Time:         time.Now().UTC(),
+		Command:      command,
+		ModelID:      m.ModelID,
+		InputTokens:  aws.ToInt32(usage.InputTokens),
+		OutputTokens: aws.ToInt32(usage.OutputTokens),
+	}
+	e.Cost = m.Cost(e.InputTokens, e.OutputTokens)
+
+	if err := ledger.Append(e); err != nil {
+		log.Printf("unable to write usage ledger: %v", err)
+	}
+
+	if showUsage {
+		fmt.Fprintf(os.Stderr, "[usage: %d input tokens, %d output tokens, $%.6f]\n", e.InputTokens, e.OutputTokens, e.Cost)
+	}
+
+	return e.Cost
+}
+
+// recordImageUsage appends the usage of an image generation call to the
+// usage ledger and prints it to stderr if showUsage is set
+func recordImageUsage(command string, m models.Model, images int, showUsage bool) {
+
+	e := ledger.Entry{
+		Time:    time.Now().UTC(),
+		Command: command,
+		ModelID: m.ModelID,
+		Images:  images,
+		Cost:    float64(images) * m.ImagePrice,
+	}
+
+	if err := ledger.Append(e); err != nil {
+		log.Printf("unable to write usage ledger: %v", err)
+	}
+
+	if showUsage {
+		fmt.Fprintf(os.Stderr, "[usage: %d images, $%.6f]\n", e.Images, e.Cost)
+	}
+}
+
+// addUsage adds the token counts of b to a
+func addUsage(a *types.TokenUsage, b *types.TokenUsage) *types.TokenUsage {
+
+	if b == nil {
+		return a
+	}
+	if a == nil {
+		a = &types.TokenUsage{InputTokens: aws.Int32(0), OutputTokens: aws.Int32(0), TotalTokens: aws.Int32(0)}
+	}
+
+	a.InputTokens = aws.Int32(aws.ToInt32(a.InputTokens) + aws.ToInt32(b.InputTokens))
+	a.OutputTokens = aws.Int32(aws.ToInt32(a.OutputTokens) + aws.ToInt32(b.OutputTokens))
+	a.TotalTokens = aws.Int32(aws.ToInt32(a.TotalTokens) + aws.ToInt32(b.TotalTokens))
+
+	return a
+}
+
+func init() {
+	rootCmd.AddCommand(usageCmd)
+	usageCmd.AddCommand(usageReportCmd)
+
+	usageReportCmd.Flags().String("since", "30d", "how far back to report, e.g. 7d or 12h")
+	usageReportCmd.Flags().String("by", "model", "group usage by model, command or day")
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"runtime"
 
+	"github.com/go-micah/chat-cli/version"
 	"github.com/spf13/cobra"
 )
 
@@ -16,8 +17,7 @@ var versionCmd = &cobra.Command{
 	Short: "Prints the current version",
 	Long:  `Prints the current version`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// until there is a better way to do this
-		v := "v0.3.0"
+		v := version.Version
 		o := runtime.GOOS
 		a := runtime.GOARCH
 		fmt.Printf("chat-cli %s, %s/%s\n", v, o, a)
@@ -0,0 +1,284 @@
+// Package index stores embedded chunks of files in a local, file based
+// vector index and searches them by similarity.
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// ErrNotFound is returned by Load for an index that doesn't exist
+var ErrNotFound = errors.New("index not found")
+
+// ErrCorrupt is returned by Load when the vectors don't belong to the
+// chunks, for example because a save was interrupted
+var ErrCorrupt = errors.New("index is corrupt")
+
+// validName matches the names an index can be given, since they are used
+// as directory names
+var validName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Chunk is a range of lines of a file
+type Chunk struct {
+	Path      string `json:"path"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Text      string `json:"text"`
+}
+
+// File records the state of a file when it was indexed, so unchanged files
+// don't have to be embedded again
+type File struct {
+	Hash string `json:"hash"`
+}
+
+// Index holds the chunks of the files in a directory and their vectors.
+// Vectors[i] belongs to Chunks[i].
+type Index struct {
+	Name       string          `json:"name"`
+	Root       string          `json:"root"`
+	ModelID    string          `json:"model_id"`
+	Dimensions int             `json:"dimensions"`
+	ChunkSize  int             `json:"chunk_size"`
+	Updated    time.Time       `json:"updated"`
+	Files      map[string]File `json:"files"`
+	Chunks     []Chunk         `json:"chunks"`
+
+	// VectorsHash is the SHA-256 of the vectors file, which is written
+	// separately
+	VectorsHash string `json:"vectors_sha256"`
+
+	Vectors [][]float32 `json:"-"`
+}
+
+// Result is a chunk found by Search
+type Result struct {
+	Chunk
+	Score float64
+}
+
+// Dir returns the directory indexes are kept in. It can be overridden with
+// the CHAT_CLI_INDEX_DIR environment variable.
+func Dir() (string, error) {
+
+	if p := os.Getenv("CHAT_CLI_INDEX_DIR"); p != "" {
+		return p, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find config directory: %w", err)
+	}
+
+	return filepath.Join(dir, "chat-cli", "indexes"), nil
+}
+
+// ValidateName returns an error if name can't be used for an index
+func ValidateName(name string) error {
+	if !validName.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid index name %q. use letters, digits, '.', '-' and '_'", name)
+	}
+	return nil
+}
+
+// List returns the names of every index
+func List() ([]string, error) {
+
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Load reads an index
+func Load(name string) (*Index, error) {
+
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name, "index.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var idx Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("unable to read index %s: %w", name, err)
+	}
+
+	vectors, err := os.ReadFile(filepath.Join(dir, name, "vectors.f32"))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(vectors)
+	if len(vectors) != len(idx.Chunks)*idx.Dimensions*4 || hex.EncodeToString(sum[:]) != idx.VectorsHash {
+		return nil, fmt.Errorf("%w: %s", ErrCorrupt, name)
+	}
+
+	r := bytes.NewReader(vectors)
+	idx.Vectors = make([][]float32, len(idx.Chunks))
+	for i := range idx.Vectors {
+		idx.Vectors[i] = make([]float32, idx.Dimensions)
+		if err := binary.Read(r, binary.LittleEndian, idx.Vectors[i]); err != nil {
+			return nil, fmt.Errorf("unable to read vectors of index %s: %w", name, err)
+		}
+	}
+
+	return &idx, nil
+}
+
+// Save writes an index, replacing any earlier version of it. The chunks
+// are written as JSON and the vectors as little endian float32 next to
+// them. The JSON holds a hash of the vectors, so Load can tell if the two
+// files are from different saves.
+func (idx *Index) Save() error {
+
+	if err := ValidateName(idx.Name); err != nil {
+		return err
+	}
+
+	if len(idx.Vectors) != len(idx.Chunks) {
+		return fmt.Errorf("index has %d chunks but %d vectors", len(idx.Chunks), len(idx.Vectors))
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+
+	dir = filepath.Join(dir, idx.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var vectors bytes.Buffer
+	for _, v := range idx.Vectors {
+		if len(v) != idx.Dimensions {
+			return fmt.Errorf("vector has %d dimensions, expected %d", len(v), idx.Dimensions)
+		}
+		if err := binary.Write(&vectors, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.Sum256(vectors.Bytes())
+	idx.VectorsHash = hex.EncodeToString(sum[:])
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	err = writeFile(filepath.Join(dir, "vectors.f32"), func(w io.Writer) error {
+		_, err := w.Write(vectors.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, "index.json"), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Search returns the k chunks most similar to a query vector, best first
+func (idx *Index) Search(query []float32, k int) []Result {
+
+	results := make([]Result, len(idx.Chunks))
+	for i, c := range idx.Chunks {
+		results[i] = Result{Chunk: c, Score: cosine(query, idx.Vectors[i])}
+	}
+
+	slices.SortStableFunc(results, func(a, b Result) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return 0
+	})
+
+	return results[:min(k, len(results))]
+}
+
+// cosine returns the cosine similarity of two vectors
+func cosine(a []float32, b []float32) float64 {
+
+	var dot, na, nb float64
+	for i := range min(len(a), len(b)) {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// writeFile writes a file through a temporary file, so a failed write
+// doesn't leave it half written
+func writeFile(name string, write func(w io.Writer) error) error {
+
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,100 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func testIndex(vectors ...[]float32) *Index {
+
+	idx := &Index{
+		Name:       "test",
+		Root:       "/src",
+		ModelID:    "amazon.titan-embed-text-v2:0",
+		Dimensions: 2,
+		ChunkSize:  1000,
+		Files:      map[string]File{},
+		Vectors:    vectors,
+	}
+
+	for range vectors {
+		idx.Chunks = append(idx.Chunks, Chunk{Path: "a.txt", StartLine: 1, EndLine: 1, Text: "a"})
+	}
+
+	return idx
+}
+
+func TestSaveLoad(t *testing.T) {
+
+	t.Setenv("CHAT_CLI_INDEX_DIR", t.TempDir())
+
+	if err := testIndex([]float32{1, 2}, []float32{3, 4}).Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	idx, err := Load("test")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if len(idx.Vectors) != 2 || !slices.Equal(idx.Vectors[1], []float32{3, 4}) {
+		t.Errorf("vectors = %v", idx.Vectors)
+	}
+	if idx.ChunkSize != 1000 {
+		t.Errorf("chunk size = %d, want 1000", idx.ChunkSize)
+	}
+
+	if _, err := Load("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load of a missing index = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLoadMismatchedVectors(t *testing.T) {
+
+	dir := t.TempDir()
+	t.Setenv("CHAT_CLI_INDEX_DIR", dir)
+
+	if err := testIndex([]float32{1, 2}, []float32{3, 4}).Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	old, err := os.ReadFile(filepath.Join(dir, "test", "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a save interrupted between the two files leaves new vectors next to
+	// the old chunks, first of the same size and then of a different size
+	for _, vectors := range [][][]float32{
+		{{5, 6}, {7, 8}},
+		{{5, 6}, {7, 8}, {9, 10}},
+	} {
+		if err := testIndex(vectors...).Save(); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "test", "index.json"), old, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Load("test"); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Load with %d new vectors = %v, want ErrCorrupt", len(vectors), err)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+
+	for _, name := range []string{"docs", "my-notes_2.0"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("ValidateName(%q) = %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "a/b", "../docs", "my notes"} {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("ValidateName(%q) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Entry records the usage of a single call to Amazon Bedrock
+type Entry struct {
+	Time         time.Time `json:"time"`
+	Command      string    `json:"command"`
+	ModelID      string    `json:"model_id"`
+	InputTokens  int32     `json:"input_tokens,omitempty"`
+	OutputTokens int32     `json:"output_tokens,omitempty"`
+	Images       int       `json:"images,omitempty"`
+	Cost         float64   `json:"cost"`
+}
+
+var mu sync.Mutex
+
+// Path returns the location of the ledger file. It can be overridden
+// with the CHAT_CLI_LEDGER environment variable.
+func Path() (string, error) {
+
+	if p := os.Getenv("CHAT_CLI_LEDGER"); p != "" {
+		return p, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find config directory: %w", err)
+	}
+
+	return filepath.Join(dir, "chat-cli", "usage.jsonl"), nil
+}
+
+// Append adds an entry to the end of the ledger
+func Append(e Entry) error {
+
+	p, err := Path()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Read returns all entries recorded at or after since
+func Read(since time.Time) ([]Entry, error) {
+
+	p, err := Path()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+
+		// skip lines we can't parse rather than failing the whole report
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+
+		if e.Time.Before(since) {
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
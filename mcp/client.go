@@ -0,0 +1,402 @@
+// Package mcp is a small client for Model Context Protocol servers that
+// run as a local process and talk JSON-RPC over stdio.
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-micah/chat-cli/version"
+)
+
+// ProtocolVersion is the version of the protocol the client asks for.
+// Servers may answer with an older version they support.
+const ProtocolVersion = "2025-06-18"
+
+// maxMessageSize is the largest message a server can send
+const maxMessageSize = 64 * 1024 * 1024
+
+// closeTimeout is how long a server has to exit once its stdin is closed,
+// and how long its output is waited for once it has been killed
+const closeTimeout = 2 * time.Second
+
+// Tool is a tool offered by a server
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+// Content is a piece of the result of a tool call
+type Content struct {
+	Type     string            `json:"type"`
+	Text     string            `json:"text,omitempty"`
+	Data     string            `json:"data,omitempty"`
+	MimeType string            `json:"mimeType,omitempty"`
+	Resource *ResourceContents `json:"resource,omitempty"`
+}
+
+// CallToolResult is the result of a tool call. If IsError is set the tool
+// failed and the content describes why.
+type CallToolResult struct {
+	Content []Content `json:"content"`
+	IsError bool      `json:"isError,omitempty"`
+}
+
+// Resource is a document a server can provide
+type Resource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+// ResourceContents is the contents of a resource, either as text or as
+// base64 encoded bytes
+type ResourceContents struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Blob     string `json:"blob,omitempty"`
+}
+
+// ServerInfo describes a server once it has been initialized
+type ServerInfo struct {
+	ProtocolVersion string `json:"protocolVersion"`
+	ServerInfo      struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"serverInfo"`
+	Capabilities struct {
+		Tools     *struct{} `json:"tools,omitempty"`
+		Resources *struct{} `json:"resources,omitempty"`
+	} `json:"capabilities"`
+}
+
+// Error is an error returned by a server
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// message is any JSON-RPC message: a request, a notification or a response
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Client is a connection to a server running as a child process
+type Client struct {
+	Name string
+	Info ServerInfo
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	nextID atomic.Int64
+
+	// writeMu keeps messages whole. It is separate from mu, since a write
+	// can block until the server reads its stdin.
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[int64]chan message
+
+	// done is closed once the server's stdout is closed, with the reason
+	// in err
+	done chan struct{}
+	err  error
+}
+
+// Start runs a server and initializes the connection to it. Anything the
+// server writes to stderr is copied to the stderr writer.
+func Start(ctx context.Context, name string, command string, args []string, env map[string]string, stderr io.Writer) (*Client, error) {
+
+	cmd := exec.Command(command, args...)
+	cmd.Stderr = stderr
+
+	// a child of the server could hold stderr open after it exits
+	cmd.WaitDelay = closeTimeout
+
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start MCP server %s: %w", name, err)
+	}
+
+	c := &Client{
+		Name:    name,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[int64]chan message{},
+		done:    make(chan struct{}),
+	}
+
+	go c.read(stdout)
+
+	err = c.call(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": ProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo": map[string]interface{}{
+			"name":    "chat-cli",
+			"version": strings.TrimPrefix(version.Version, "v"),
+		},
+	}, &c.Info)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("unable to initialize MCP server %s: %w", name, err)
+	}
+
+	if err := c.write(message{JSONRPC: "2.0", Method: "notifications/initialized"}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("unable to initialize MCP server %s: %w", name, err)
+	}
+
+	return c, nil
+}
+
+// ListTools returns every tool the server offers
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+
+	if c.Info.Capabilities.Tools == nil {
+		return nil, nil
+	}
+
+	var tools []Tool
+	cursor := ""
+	for {
+		var page struct {
+			Tools      []Tool `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "tools/list", pageParams(cursor), &page); err != nil {
+			return nil, err
+		}
+
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// CallTool calls a tool with its arguments as a JSON object
+func (c *Client) CallTool(ctx context.Context, name string, arguments json.RawMessage) (*CallToolResult, error) {
+
+	var result CallToolResult
+	err := c.call(ctx, "tools/call", map[string]interface{}{
+		"name":      name,
+		"arguments": arguments,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// ListResources returns every resource the server offers
+func (c *Client) ListResources(ctx context.Context) ([]Resource, error) {
+
+	if c.Info.Capabilities.Resources == nil {
+		return nil, nil
+	}
+
+	var resources []Resource
+	cursor := ""
+	for {
+		var page struct {
+			Resources  []Resource `json:"resources"`
+			NextCursor string     `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "resources/list", pageParams(cursor), &page); err != nil {
+			return nil, err
+		}
+
+		resources = append(resources, page.Resources...)
+		if page.NextCursor == "" {
+			return resources, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// ReadResource returns the contents of a resource
+func (c *Client) ReadResource(ctx context.Context, uri string) ([]ResourceContents, error) {
+
+	var result struct {
+		Contents []ResourceContents `json:"contents"`
+	}
+	if err := c.call(ctx, "resources/read", map[string]interface{}{"uri": uri}, &result); err != nil {
+		return nil, err
+	}
+
+	return result.Contents, nil
+}
+
+// Close stops the server. It is given a moment to exit once its stdin is
+// closed before it is killed. A server that closed its stdout but keeps
+// running is killed all the same.
+func (c *Client) Close() error {
+
+	c.stdin.Close()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- c.cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(closeTimeout):
+		c.cmd.Process.Kill()
+		return <-exited
+	}
+}
+
+// call sends a request and waits for its response
+func (c *Client) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+
+	id := c.nextID.Add(1)
+	ch := make(chan message, 1)
+
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	err := c.write(message{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage(fmt.Sprint(id)),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return fmt.Errorf("%s: %w", method, resp.Error)
+		}
+		if result == nil {
+			return nil
+		}
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("%s: invalid result: %w", method, err)
+		}
+		return nil
+	case <-c.done:
+		return fmt.Errorf("%s: %w", method, c.err)
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (c *Client) write(msg message) error {
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err = c.stdin.Write(append(b, '\n'))
+	return err
+}
+
+// read handles every message from the server until its stdout is closed.
+// Responses are passed to the call waiting for them. Requests from the
+// server are answered, since none of the optional client features are
+// supported.
+func (c *Client) read(stdout io.Reader) {
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
+
+	for scanner.Scan() {
+		var msg message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+
+		switch {
+		case msg.Method != "" && msg.ID != nil:
+			reply := message{JSONRPC: "2.0", ID: msg.ID}
+			if msg.Method == "ping" {
+				reply.Result = json.RawMessage("{}")
+			} else {
+				reply.Error = &Error{Code: -32601, Message: "method not found: " + msg.Method}
+			}
+
+			// the server may not read the reply until it has finished
+			// writing, so waiting for it here could block both sides
+			go c.write(reply)
+
+		case msg.ID != nil:
+			var id int64
+			if err := json.Unmarshal(msg.ID, &id); err != nil {
+				continue
+			}
+			c.mu.Lock()
+			ch := c.pending[id]
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- msg
+			}
+		}
+	}
+
+	c.err = scanner.Err()
+	if c.err == nil {
+		c.err = errors.New("server exited")
+	}
+	close(c.done)
+}
+
+func pageParams(cursor string) interface{} {
+	if cursor == "" {
+		return nil
+	}
+	return map[string]interface{}{"cursor": cursor}
+}
@@ -0,0 +1,223 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-micah/chat-cli/version"
+)
+
+// testServer is the path of the server in testdata, built once for every
+// test
+var testServer string
+
+func TestMain(m *testing.M) {
+
+	dir, err := os.MkdirTemp("", "mcp-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	testServer = filepath.Join(dir, "server")
+	build := exec.Command("go", "build", "-o", testServer, "./testdata/server")
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to build test server:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func startTestServer(t *testing.T, mode string) *Client {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := Start(ctx, "test", testServer, []string{mode}, nil, io.Discard)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return c
+}
+
+func TestInitialize(t *testing.T) {
+
+	c := startTestServer(t, "ok")
+	defer c.Close()
+
+	if c.Info.ServerInfo.Name != "test" {
+		t.Errorf("server name = %q, want test", c.Info.ServerInfo.Name)
+	}
+	if c.Info.Capabilities.Tools == nil || c.Info.Capabilities.Resources == nil {
+		t.Errorf("capabilities not read: %+v", c.Info.Capabilities)
+	}
+
+	// the test server sends the client's version back as its own
+	want := strings.TrimPrefix(version.Version, "v")
+	if c.Info.ServerInfo.Version != want {
+		t.Errorf("client version = %q, want %q", c.Info.ServerInfo.Version, want)
+	}
+}
+
+func TestListTools(t *testing.T) {
+
+	c := startTestServer(t, "ok")
+	defer c.Close()
+
+	tools, err := c.ListTools(context.Background())
+	if err != nil {
+		t.Fatalf("ListTools: %v", err)
+	}
+
+	var names []string
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+	}
+
+	// the second tool is on the second page
+	if strings.Join(names, ",") != "echo,fail.tool" {
+		t.Errorf("tools = %v, want [echo fail.tool]", names)
+	}
+}
+
+func TestCallTool(t *testing.T) {
+
+	c := startTestServer(t, "ok")
+	defer c.Close()
+
+	ctx := context.Background()
+
+	result, err := c.CallTool(ctx, "echo", json.RawMessage(`{"text":"hello"}`))
+	if err != nil {
+		t.Fatalf("CallTool: %v", err)
+	}
+	if result.IsError || len(result.Content) != 1 || result.Content[0].Text != "hello" {
+		t.Errorf("echo result = %+v", result)
+	}
+
+	result, err = c.CallTool(ctx, "fail.tool", json.RawMessage(`{}`))
+	if err != nil {
+		t.Fatalf("CallTool: %v", err)
+	}
+	if !result.IsError {
+		t.Errorf("fail.tool result is not an error: %+v", result)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+
+	c := startTestServer(t, "ok")
+	defer c.Close()
+
+	// every response has to reach the call that sent its request
+	errs := make(chan error, 20)
+	for i := range 20 {
+		go func() {
+			text := fmt.Sprint(i)
+			result, err := c.CallTool(context.Background(), "echo", json.RawMessage(`{"text":"`+text+`"}`))
+			if err == nil && (len(result.Content) != 1 || result.Content[0].Text != text) {
+				err = fmt.Errorf("call %s got %+v", text, result)
+			}
+			errs <- err
+		}()
+	}
+
+	for range 20 {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestServerRequestFlood(t *testing.T) {
+
+	c := startTestServer(t, "ok")
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the answers fill the server's stdin while it is still writing, so
+	// they can't hold up reading what it writes
+	result, err := c.CallTool(ctx, "flood", json.RawMessage(`{}`))
+	if err != nil {
+		t.Fatalf("CallTool: %v", err)
+	}
+	if len(result.Content) != 1 || result.Content[0].Text != "flooded" {
+		t.Errorf("flood result = %+v", result)
+	}
+}
+
+func TestReadResource(t *testing.T) {
+
+	c := startTestServer(t, "ok")
+	defer c.Close()
+
+	contents, err := c.ReadResource(context.Background(), "test://notes")
+	if err != nil {
+		t.Fatalf("ReadResource: %v", err)
+	}
+	if len(contents) != 1 || contents[0].Text != "contents of test://notes" {
+		t.Errorf("contents = %+v", contents)
+	}
+
+	_, err = c.ReadResource(context.Background(), "test://missing")
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -32002 {
+		t.Errorf("missing resource error = %v, want code -32002", err)
+	}
+}
+
+func TestServerCrash(t *testing.T) {
+
+	c := startTestServer(t, "crash")
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := c.CallTool(ctx, "echo", json.RawMessage(`{"text":"hello"}`))
+	if err == nil {
+		t.Fatal("CallTool succeeded on a server that crashed")
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("CallTool waited for the timeout instead of noticing the crash: %v", err)
+	}
+
+	// later calls fail straight away
+	if _, err := c.ListTools(ctx); err == nil {
+		t.Error("ListTools succeeded on a server that crashed")
+	}
+}
+
+func TestCloseKillsHungServer(t *testing.T) {
+
+	c := startTestServer(t, "hang")
+
+	done := make(chan struct{})
+	go func() {
+		c.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(4 * closeTimeout):
+		t.Fatal("Close did not return for a server that closed stdout but kept running")
+	}
+}
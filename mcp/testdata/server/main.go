@@ -0,0 +1,143 @@
+// Command server is a small MCP server used by the tests. It talks
+// JSON-RPC over stdio and behaves according to its first argument:
+//
+//	ok     answer every request
+//	crash  exit without answering a tools/call
+//	hang   close stdout once initialized and never exit
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type request struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+func main() {
+
+	mode := "ok"
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	reply := func(id json.RawMessage, result interface{}) {
+		out.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result})
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			continue
+		}
+
+		switch req.Method {
+		case "initialize":
+			// the client's version is sent back as the server's, so the
+			// tests can check it
+			var params struct {
+				ClientInfo struct {
+					Version string `json:"version"`
+				} `json:"clientInfo"`
+			}
+			json.Unmarshal(req.Params, &params)
+
+			reply(req.ID, map[string]interface{}{
+				"protocolVersion": "2025-06-18",
+				"serverInfo":      map[string]string{"name": "test", "version": params.ClientInfo.Version},
+				"capabilities":    map[string]interface{}{"tools": struct{}{}, "resources": struct{}{}},
+			})
+
+		case "notifications/initialized":
+			if mode == "hang" {
+				os.Stdout.Close()
+				select {}
+			}
+
+		case "tools/list":
+			// two pages, to exercise the cursor
+			var params struct {
+				Cursor string `json:"cursor"`
+			}
+			json.Unmarshal(req.Params, &params)
+
+			if params.Cursor == "" {
+				reply(req.ID, map[string]interface{}{
+					"tools":      []map[string]interface{}{{"name": "echo", "description": "echoes text", "inputSchema": map[string]string{"type": "object"}}},
+					"nextCursor": "2",
+				})
+			} else {
+				reply(req.ID, map[string]interface{}{
+					"tools": []map[string]interface{}{{"name": "fail.tool", "inputSchema": map[string]string{"type": "object"}}},
+				})
+			}
+
+		case "tools/call":
+			if mode == "crash" {
+				os.Exit(1)
+			}
+
+			var params struct {
+				Name      string `json:"name"`
+				Arguments struct {
+					Text string `json:"text"`
+				} `json:"arguments"`
+			}
+			json.Unmarshal(req.Params, &params)
+
+			// ask the client something first, which it must answer
+			// without mixing it up with its own calls
+			out.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": "s1", "method": "ping"})
+
+			// flood asks more than fits in a pipe before reading any of
+			// the answers
+			if params.Name == "flood" {
+				for i := range 5000 {
+					out.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": fmt.Sprintf("f%d", i), "method": "ping"})
+				}
+				reply(req.ID, map[string]interface{}{
+					"content": []map[string]string{{"type": "text", "text": "flooded"}},
+				})
+				continue
+			}
+
+			if params.Name == "echo" {
+				reply(req.ID, map[string]interface{}{
+					"content": []map[string]string{{"type": "text", "text": params.Arguments.Text}},
+				})
+			} else {
+				reply(req.ID, map[string]interface{}{
+					"content": []map[string]string{{"type": "text", "text": "it failed"}},
+					"isError": true,
+				})
+			}
+
+		case "resources/read":
+			var params struct {
+				URI string `json:"uri"`
+			}
+			json.Unmarshal(req.Params, &params)
+
+			if params.URI == "test://missing" {
+				out.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "error": map[string]interface{}{"code": -32002, "message": "resource not found"}})
+				continue
+			}
+
+			reply(req.ID, map[string]interface{}{
+				"contents": []map[string]string{{"uri": params.URI, "text": fmt.Sprintf("contents of %s", params.URI)}},
+			})
+
+		default:
+			if req.ID != nil {
+				out.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "error": map[string]interface{}{"code": -32601, "message": "method not found"}})
+			}
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package models
 
 import (
+	"errors"
 	"fmt"
 	"slices"
+	"strings"
 )
 
 type Model struct {
@@ -11,113 +13,313 @@ type Model struct {
 	ModelType         string
 	BaseModel         bool
 	SupportsStreaming bool
+	SupportsToolUse   bool
+
+	// SupportsVision is set for models that take images with a prompt
+	SupportsVision bool
+
+	// SupportsPrefill is set for models that continue a partial assistant
+	// message at the end of a conversation
+	SupportsPrefill       bool
+	SupportsStopSequences bool
+	SupportsReasoning     bool
+
+	// ContextWindow is the most tokens a text model takes in a request,
+	// including its response
+	ContextWindow int
+
+	// AdditionalParams lists the model-specific request fields that can be
+	// passed through to the model
+	AdditionalParams []string
+
+	// EmbeddingDimensions lists the vector sizes an embedding model can
+	// return. The first is the default.
+	EmbeddingDimensions []int
+
+	// on-demand pricing in USD, per 1,000 tokens for text and embedding
+	// models and per image for image models
+	InputTokenPrice  float64
+	OutputTokenPrice float64
+	ImagePrice       float64
 }
 
+// model-specific request fields by provider
+var (
+	anthropicParams          = []string{"top_k"}
+	anthropicReasoningParams = []string{"top_k", "thinking"}
+	cohereParams             = []string{"k", "return_likelihoods", "truncate", "num_generations"}
+	ai21Params               = []string{"countPenalty", "presencePenalty", "frequencyPenalty"}
+)
+
 var models = []Model{
 	{
-		ModelID:           "anthropic.claude-3-5-sonnet-20240620-v1:0",
-		ModelFamily:       "claude3",
-		ModelType:         "text",
-		BaseModel:         false,
-		SupportsStreaming: true,
+		ModelID:               "us.anthropic.claude-opus-4-20250514-v1:0",
+		ModelFamily:           "claude4",
+		ModelType:             "text",
+		ContextWindow:         200000,
+		BaseModel:             false,
+		SupportsStreaming:     true,
+		SupportsToolUse:       true,
+		SupportsVision:        true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		SupportsReasoning:     true,
+		AdditionalParams:      anthropicReasoningParams,
+		InputTokenPrice:       0.015,
+		OutputTokenPrice:      0.075,
 	},
 	{
-		ModelID:           "anthropic.claude-3-opus-20240229-v1:0",
-		ModelFamily:       "claude3",
-		ModelType:         "text",
-		BaseModel:         false,
-		SupportsStreaming: true,
+		ModelID:               "us.anthropic.claude-sonnet-4-20250514-v1:0",
+		ModelFamily:           "claude4",
+		ModelType:             "text",
+		ContextWindow:         200000,
+		BaseModel:             true,
+		SupportsStreaming:     true,
+		SupportsToolUse:       true,
+		SupportsVision:        true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		SupportsReasoning:     true,
+		AdditionalParams:      anthropicReasoningParams,
+		InputTokenPrice:       0.003,
+		OutputTokenPrice:      0.015,
 	},
 	{
-		ModelID:           "anthropic.claude-3-sonnet-20240229-v1:0",
-		ModelFamily:       "claude3",
-		ModelType:         "text",
-		BaseModel:         false,
-		SupportsStreaming: true,
+		ModelID:               "us.anthropic.claude-3-7-sonnet-20250219-v1:0",
+		ModelFamily:           "claude3",
+		ModelType:             "text",
+		ContextWindow:         200000,
+		BaseModel:             false,
+		SupportsStreaming:     true,
+		SupportsToolUse:       true,
+		SupportsVision:        true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		SupportsReasoning:     true,
+		AdditionalParams:      anthropicReasoningParams,
+		InputTokenPrice:       0.003,
+		OutputTokenPrice:      0.015,
 	},
 	{
-		ModelID:           "anthropic.claude-3-haiku-20240307-v1:0",
-		ModelFamily:       "claude3",
-		ModelType:         "text",
-		BaseModel:         true,
-		SupportsStreaming: true,
+		ModelID:               "anthropic.claude-3-5-sonnet-20240620-v1:0",
+		ModelFamily:           "claude3",
+		ModelType:             "text",
+		ContextWindow:         200000,
+		BaseModel:             false,
+		SupportsStreaming:     true,
+		SupportsToolUse:       true,
+		SupportsVision:        true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		AdditionalParams:      anthropicParams,
+		InputTokenPrice:       0.003,
+		OutputTokenPrice:      0.015,
 	},
 	{
-		ModelID:           "anthropic.claude-v2:1",
-		ModelFamily:       "claude",
-		ModelType:         "text",
-		BaseModel:         false,
-		SupportsStreaming: true,
+		ModelID:               "anthropic.claude-3-opus-20240229-v1:0",
+		ModelFamily:           "claude3",
+		ModelType:             "text",
+		ContextWindow:         200000,
+		BaseModel:             false,
+		SupportsStreaming:     true,
+		SupportsToolUse:       true,
+		SupportsVision:        true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		AdditionalParams:      anthropicParams,
+		InputTokenPrice:       0.015,
+		OutputTokenPrice:      0.075,
 	},
 	{
-		ModelID:           "anthropic.claude-v2",
-		ModelFamily:       "claude",
-		ModelType:         "text",
-		BaseModel:         false,
-		SupportsStreaming: true,
+		ModelID:               "anthropic.claude-3-sonnet-20240229-v1:0",
+		ModelFamily:           "claude3",
+		ModelType:             "text",
+		ContextWindow:         200000,
+		BaseModel:             false,
+		SupportsStreaming:     true,
+		SupportsToolUse:       true,
+		SupportsVision:        true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		AdditionalParams:      anthropicParams,
+		InputTokenPrice:       0.003,
+		OutputTokenPrice:      0.015,
 	},
 	{
-		ModelID:           "anthropic.claude-instant-v1",
-		ModelFamily:       "claude",
-		ModelType:         "text",
-		BaseModel:         true,
-		SupportsStreaming: true,
+		ModelID:               "anthropic.claude-3-haiku-20240307-v1:0",
+		ModelFamily:           "claude3",
+		ModelType:             "text",
+		ContextWindow:         200000,
+		BaseModel:             true,
+		SupportsStreaming:     true,
+		SupportsToolUse:       true,
+		SupportsVision:        true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		AdditionalParams:      anthropicParams,
+		InputTokenPrice:       0.00025,
+		OutputTokenPrice:      0.00125,
 	},
 	{
-		ModelID:           "ai21.j2-mid-v1",
-		ModelFamily:       "jurassic",
-		ModelType:         "text",
-		BaseModel:         true,
-		SupportsStreaming: false,
+		ModelID:               "anthropic.claude-v2:1",
+		ModelFamily:           "claude",
+		ModelType:             "text",
+		ContextWindow:         200000,
+		BaseModel:             false,
+		SupportsStreaming:     true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		AdditionalParams:      anthropicParams,
+		InputTokenPrice:       0.008,
+		OutputTokenPrice:      0.024,
 	},
 	{
-		ModelID:           "ai21.j2-ultra-v1",
-		ModelFamily:       "jurassic",
-		ModelType:         "text",
-		BaseModel:         false,
-		SupportsStreaming: false,
+		ModelID:               "anthropic.claude-v2",
+		ModelFamily:           "claude",
+		ModelType:             "text",
+		ContextWindow:         100000,
+		BaseModel:             false,
+		SupportsStreaming:     true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		AdditionalParams:      anthropicParams,
+		InputTokenPrice:       0.008,
+		OutputTokenPrice:      0.024,
 	},
 	{
-		ModelID:           "cohere.command-light-text-v14",
-		ModelFamily:       "command",
-		ModelType:         "text",
-		BaseModel:         true,
-		SupportsStreaming: true,
+		ModelID:               "anthropic.claude-instant-v1",
+		ModelFamily:           "claude",
+		ModelType:             "text",
+		ContextWindow:         100000,
+		BaseModel:             true,
+		SupportsStreaming:     true,
+		SupportsPrefill:       true,
+		SupportsStopSequences: true,
+		AdditionalParams:      anthropicParams,
+		InputTokenPrice:       0.0008,
+		OutputTokenPrice:      0.0024,
 	},
 	{
-		ModelID:           "cohere.command-text-v14",
-		ModelFamily:       "command",
-		ModelType:         "text",
-		BaseModel:         false,
-		SupportsStreaming: true,
+		ModelID:               "ai21.j2-mid-v1",
+		ModelFamily:           "jurassic",
+		ModelType:             "text",
+		ContextWindow:         8191,
+		BaseModel:             true,
+		SupportsStreaming:     false,
+		SupportsStopSequences: true,
+		AdditionalParams:      ai21Params,
+		InputTokenPrice:       0.0125,
+		OutputTokenPrice:      0.0125,
+	},
+	{
+		ModelID:               "ai21.j2-ultra-v1",
+		ModelFamily:           "jurassic",
+		ModelType:             "text",
+		ContextWindow:         8191,
+		BaseModel:             false,
+		SupportsStreaming:     false,
+		SupportsStopSequences: true,
+		AdditionalParams:      ai21Params,
+		InputTokenPrice:       0.0188,
+		OutputTokenPrice:      0.0188,
+	},
+	{
+		ModelID:               "cohere.command-light-text-v14",
+		ModelFamily:           "command",
+		ModelType:             "text",
+		ContextWindow:         4096,
+		BaseModel:             true,
+		SupportsStreaming:     true,
+		SupportsStopSequences: true,
+		AdditionalParams:      cohereParams,
+		InputTokenPrice:       0.0003,
+		OutputTokenPrice:      0.0006,
+	},
+	{
+		ModelID:               "cohere.command-text-v14",
+		ModelFamily:           "command",
+		ModelType:             "text",
+		ContextWindow:         4096,
+		BaseModel:             false,
+		SupportsStreaming:     true,
+		SupportsStopSequences: true,
+		AdditionalParams:      cohereParams,
+		InputTokenPrice:       0.0015,
+		OutputTokenPrice:      0.002,
 	},
 	{
 		ModelID:           "meta.llama2-13b-chat-v1",
 		ModelFamily:       "llama",
 		ModelType:         "text",
+		ContextWindow:     4096,
 		BaseModel:         true,
 		SupportsStreaming: true,
+		InputTokenPrice:   0.00075,
+		OutputTokenPrice:  0.001,
 	},
 	{
 		ModelID:           "meta.llama2-70b-chat-v1",
 		ModelFamily:       "llama",
 		ModelType:         "text",
+		ContextWindow:     4096,
 		BaseModel:         false,
 		SupportsStreaming: true,
+		InputTokenPrice:   0.00195,
+		OutputTokenPrice:  0.00256,
 	},
 	{
-		ModelID:           "amazon.titan-text-lite-v1",
-		ModelFamily:       "titan",
-		ModelType:         "text",
-		BaseModel:         true,
-		SupportsStreaming: false,
+		ModelID:               "amazon.titan-text-lite-v1",
+		ModelFamily:           "titan",
+		ModelType:             "text",
+		ContextWindow:         4096,
+		BaseModel:             true,
+		SupportsStreaming:     false,
+		SupportsStopSequences: true,
+		InputTokenPrice:       0.00015,
+		OutputTokenPrice:      0.0002,
 	},
 	{
-		ModelID:           "amazon.titan-text-express-v1",
-		ModelFamily:       "titan",
-		ModelType:         "text",
-		BaseModel:         false,
-		SupportsStreaming: false,
+		ModelID:               "amazon.titan-text-express-v1",
+		ModelFamily:           "titan",
+		ModelType:             "text",
+		ContextWindow:         8192,
+		BaseModel:             false,
+		SupportsStreaming:     false,
+		SupportsStopSequences: true,
+		InputTokenPrice:       0.0002,
+		OutputTokenPrice:      0.0006,
+	},
+	{
+		ModelID:             "amazon.titan-embed-text-v2:0",
+		ModelFamily:         "titan-embed",
+		ModelType:           "embedding",
+		BaseModel:           true,
+		EmbeddingDimensions: []int{1024, 512, 256},
+		InputTokenPrice:     0.00002,
+	},
+	{
+		ModelID:             "amazon.titan-embed-text-v1",
+		ModelFamily:         "titan-embed",
+		ModelType:           "embedding",
+		BaseModel:           false,
+		EmbeddingDimensions: []int{1536},
+		InputTokenPrice:     0.0001,
+	},
+	{
+		ModelID:             "cohere.embed-english-v3",
+		ModelFamily:         "cohere-embed",
+		ModelType:           "embedding",
+		BaseModel:           true,
+		EmbeddingDimensions: []int{1024},
+		InputTokenPrice:     0.0001,
+	},
+	{
+		ModelID:             "cohere.embed-multilingual-v3",
+		ModelFamily:         "cohere-embed",
+		ModelType:           "embedding",
+		BaseModel:           false,
+		EmbeddingDimensions: []int{1024},
+		InputTokenPrice:     0.0001,
 	},
 	{
 		ModelID:           "amazon.titan-image-generator-v1",
@@ -125,6 +327,7 @@ var models = []Model{
 		ModelType:         "image",
 		BaseModel:         true,
 		SupportsStreaming: false,
+		ImagePrice:        0.008,
 	},
 	{
 		ModelID:           "stability.stable-diffusion-xl-v1",
@@ -132,6 +335,7 @@ var models = []Model{
 		ModelType:         "image",
 		BaseModel:         true,
 		SupportsStreaming: false,
+		ImagePrice:        0.04,
 	},
 	{
 		ModelID:           "stability.stable-diffusion-xl-v0",
@@ -139,9 +343,31 @@ var models = []Model{
 		ModelType:         "image",
 		BaseModel:         false,
 		SupportsStreaming: false,
+		ImagePrice:        0.018,
 	},
 }
 
+// Cost returns the estimated on-demand cost in USD of a text generation or
+// embedding request with the given token usage
+func (m Model) Cost(inputTokens, outputTokens int32) float64 {
+	return (float64(inputTokens)*m.InputTokenPrice + float64(outputTokens)*m.OutputTokenPrice) / 1000
+}
+
+// ValidateParam returns an error if name is not a model-specific request
+// field supported by the model
+func (m Model) ValidateParam(name string) error {
+	if slices.Contains(m.AdditionalParams, name) {
+		return nil
+	}
+	if len(m.AdditionalParams) == 0 {
+		return fmt.Errorf("model %s does not support additional parameters", m.ModelID)
+	}
+	return fmt.Errorf("unknown parameter %s for model %s. supported parameters: %s", name, m.ModelID, strings.Join(m.AdditionalParams, ", "))
+}
+
+// ErrUnsupportedModel is returned by GetModel for a model id it doesn't know
+var ErrUnsupportedModel = errors.New("model id not currently supported")
+
 func GetModel(modelId string) (Model, error) {
 
 	var m Model
@@ -154,7 +380,7 @@ func GetModel(modelId string) (Model, error) {
 			return (m.ModelFamily == modelId) && (m.BaseModel)
 		})
 		if fam == -1 {
-			return m, fmt.Errorf("model id not currently supported: %s", modelId)
+			return m, fmt.Errorf("%w: %s", ErrUnsupportedModel, modelId)
 		}
 		return models[fam], nil
 	}
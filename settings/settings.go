@@ -0,0 +1,127 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Settings holds the options read from the chat-cli config file
+type Settings struct {
+	Budget    Budget    `json:"budget"`
+	Retry     Retry     `json:"retry"`
+	Guardrail Guardrail `json:"guardrail"`
+	Agent     Agent     `json:"agent"`
+
+	// MCPServers are the MCP servers that can be started with --mcp, by
+	// name
+	MCPServers map[string]MCPServer `json:"mcp_servers,omitempty"`
+}
+
+// Budget sets spend limits in USD. A limit of zero is not enforced.
+type Budget struct {
+	Daily      float64 `json:"daily,omitempty"`
+	Monthly    float64 `json:"monthly,omitempty"`
+	PerRequest float64 `json:"per_request,omitempty"`
+}
+
+// Retry sets how calls that fail with throttling or transient errors are
+// retried. Zero values fall back to the command line defaults.
+type Retry struct {
+	MaxRetries *int     `json:"max_retries,omitempty"`
+	BaseDelay  Duration `json:"base_delay,omitempty"`
+	MaxDelay   Duration `json:"max_delay,omitempty"`
+}
+
+// Guardrail sets the Amazon Bedrock guardrail applied to every text
+// request. Flags on the command line take precedence.
+type Guardrail struct {
+	ID                   string `json:"id,omitempty"`
+	Version              string `json:"version,omitempty"`
+	StreamProcessingMode string `json:"stream_processing_mode,omitempty"`
+}
+
+// Agent sets the commands the agent command may run, on top of any
+// allowed on the command line
+type Agent struct {
+	AllowedCommands []string `json:"allowed_commands,omitempty"`
+}
+
+// MCPServer is a Model Context Protocol server that runs as a local
+// command and talks over stdio
+type MCPServer struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+
+	// Confirm asks before every call of one of the server's tools. It
+	// defaults to true.
+	Confirm *bool `json:"confirm,omitempty"`
+}
+
+// Duration is a time.Duration written as a string like "1s" or "500ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Path returns the location of the config file. It can be overridden
+// with the CHAT_CLI_CONFIG environment variable.
+func Path() (string, error) {
+
+	if p := os.Getenv("CHAT_CLI_CONFIG"); p != "" {
+		return p, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find config directory: %w", err)
+	}
+
+	return filepath.Join(dir, "chat-cli", "config.json"), nil
+}
+
+// Load reads the config file. A missing config file is not an error and
+// returns empty settings.
+func Load() (Settings, error) {
+
+	var s Settings
+
+	p, err := Path()
+	if err != nil {
+		return s, err
+	}
+
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("unable to parse config file %s: %w", p, err)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,8 @@
+// Package version holds the version of chat-cli. Release builds set it
+// with the linker:
+//
+//	go build -ldflags "-X github.com/go-micah/chat-cli/version.Version=v0.3.0"
+package version
+
+// Version is the version of chat-cli
+var Version = "v0.3.0"